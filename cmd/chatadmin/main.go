@@ -0,0 +1,89 @@
+// chatadmin manages the registered accounts of the budgetchat server.
+//
+//	chatadmin -db accounts.json add <username>     reads the password from the first line of stdin
+//	chatadmin -db accounts.json remove <username>
+//	chatadmin -db accounts.json list
+//
+// Usernames are added only when the server would accept them, pass add the same -name-min, -name-max,
+// -unicode-names and -reserved flags as the server.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/dorimon-1/protohackers/internal/accounts"
+	"github.com/dorimon-1/protohackers/internal/usernames"
+)
+
+func main() {
+	dbPath := flag.String("db", "accounts.json", "path to the accounts database")
+	policy := usernames.DefaultPolicy()
+	flag.IntVar(&policy.MinLength, "name-min", policy.MinLength, "minimum username length in characters")
+	flag.IntVar(&policy.MaxLength, "name-max", policy.MaxLength, "maximum username length in characters, 0 for no limit")
+	flag.BoolVar(&policy.AllowUnicode, "unicode-names", false, "accept unicode letters and numbers in usernames")
+	reserved := flag.String("reserved", "", "comma separated list of usernames no client may use")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	if *reserved != "" {
+		policy.Reserved = strings.Split(*reserved, ",")
+	}
+
+	store, err := accounts.Open(*dbPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	switch {
+	case args[0] == "add" && len(args) == 2:
+		username, err := policy.Verify([]byte(args[1]), store.Usernames())
+		if err != nil {
+			log.Fatalln(err)
+		}
+		password, err := readPassword()
+		if err != nil {
+			log.Fatalln("Failed to read password: ", err)
+		}
+		if err := store.Add(username, password); err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Printf("added %s\n", username)
+	case args[0] == "remove" && len(args) == 2:
+		if err := store.Remove(args[1]); err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Printf("removed %s\n", args[1])
+	case args[0] == "list" && len(args) == 1:
+		for _, username := range store.Usernames() {
+			fmt.Println(username)
+		}
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [-db path] add <username> | remove <username> | list\n", os.Args[0])
+	flag.PrintDefaults()
+}
@@ -0,0 +1,263 @@
+// chatclient is an interactive terminal client for the budgetchat server.
+//
+// The screen is split into a status bar with the members of the room, a scrolling message pane
+// and an input line. Lines typed at the input line are sent to the server as is, so the first
+// line answers the name prompt. When stdout is not a terminal the server lines are printed as they come.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+const (
+	ROOM_PREFIX   = "* The room contains: "
+	ENTER_SUFFIX  = " has entered the room"
+	LEAVE_SUFFIX  = " has left the room"
+	PASSWORD_HINT = "what is the password?"
+
+	ESC         = "\033["
+	BLUE_COLOR  = ESC + "34m"
+	RESET_COLOR = ESC + "0m"
+	REVERSE     = ESC + "7m"
+	CONCEAL     = ESC + "8m"
+)
+
+// usernameColors are the colors usernames are drawn with, a username always gets the same color.
+var usernameColors = []string{ESC + "31m", ESC + "32m", ESC + "33m", ESC + "35m", ESC + "36m", ESC + "91m", ESC + "92m", ESC + "93m"}
+
+func main() {
+	addr := flag.String("addr", "localhost:3000", "address of the budgetchat server")
+	name := flag.String("name", "", "answer the name prompt with this name instead of asking")
+	flag.Parse()
+
+	conn, err := net.Dial("tcp", *addr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer conn.Close()
+
+	ui := NewUI(*addr)
+	ui.Start()
+	defer ui.Stop()
+
+	if *name != "" {
+		ui.username = *name
+		fmt.Fprintf(conn, "%s\n", *name)
+	}
+
+	go func() {
+		ui.ReadInput(conn)
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if line = strings.TrimRight(line, "\r\n"); line != "" {
+			ui.HandleServerLine(line)
+		}
+		if err != nil {
+			ui.Print(BLUE_COLOR + "* disconnected" + RESET_COLOR)
+			return
+		}
+	}
+}
+
+// UI draws the client screen, all drawing is serialized by mu.
+type UI struct {
+	Addr     string
+	tty      bool
+	width    int
+	height   int
+	mu       sync.Mutex
+	members  []string
+	username string
+	// joined is set once the server listed the room, lines typed before are answers to prompts.
+	joined   bool
+	password bool
+}
+
+func NewUI(addr string) *UI {
+	ui := &UI{Addr: addr, members: make([]string, 0)}
+
+	fd := int(os.Stdout.Fd())
+	if term.IsTerminal(fd) {
+		if width, height, err := term.GetSize(fd); err == nil && height >= 5 {
+			ui.tty = true
+			ui.width = width
+			ui.height = height
+		}
+	}
+	return ui
+}
+
+// Start clears the screen and limits scrolling to the message pane, rows 2 to height-2.
+func (ui *UI) Start() {
+	if !ui.tty {
+		return
+	}
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+
+	fmt.Printf("%s2J%s2;%dr", ESC, ESC, ui.height-2)
+	ui.drawStatus()
+	fmt.Printf("%s%d;1H%s", ESC, ui.height-1, strings.Repeat("─", ui.width))
+	ui.drawPrompt()
+}
+
+// Stop restores the full screen scrolling region and leaves the cursor below the client.
+func (ui *UI) Stop() {
+	if !ui.tty {
+		return
+	}
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	fmt.Printf("%sr%s%s%d;1H\n", ESC, RESET_COLOR, ESC, ui.height)
+}
+
+// ReadInput sends every line typed by the user to conn until stdin is closed.
+func (ui *UI) ReadInput(conn net.Conn) {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if _, err := fmt.Fprintf(conn, "%s\n", line); err != nil {
+			return
+		}
+
+		ui.mu.Lock()
+		switch {
+		case ui.password:
+			ui.password = false
+		case !ui.joined && ui.username == "":
+			ui.username = line
+		case ui.joined:
+			ui.printLocked(ui.colorUsername(ui.username) + " " + line)
+		}
+		ui.drawPrompt()
+		ui.mu.Unlock()
+	}
+}
+
+// HandleServerLine updates the member list from presence notices and prints line to the message pane.
+func (ui *UI) HandleServerLine(line string) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+
+	if ui.update(line) {
+		ui.drawStatus()
+	}
+	ui.printLocked(ui.format(line))
+	ui.drawPrompt()
+}
+
+// update follows the room listing, presence notices and password prompts, it reports whether the members changed.
+func (ui *UI) update(line string) bool {
+	switch {
+	case strings.HasPrefix(line, ROOM_PREFIX):
+		ui.joined = true
+		ui.members = ui.members[:0]
+		for _, member := range strings.Split(strings.TrimPrefix(line, ROOM_PREFIX), ", ") {
+			if member != "" {
+				ui.members = append(ui.members, member)
+			}
+		}
+		ui.addMember(ui.username)
+	case strings.HasPrefix(line, "* ") && strings.HasSuffix(line, ENTER_SUFFIX):
+		ui.addMember(strings.TrimSuffix(strings.TrimPrefix(line, "* "), ENTER_SUFFIX))
+	case strings.HasPrefix(line, "* ") && strings.HasSuffix(line, LEAVE_SUFFIX):
+		left := strings.TrimSuffix(strings.TrimPrefix(line, "* "), LEAVE_SUFFIX)
+		ui.members = slices.DeleteFunc(ui.members, func(member string) bool { return member == left })
+	case strings.HasSuffix(line, PASSWORD_HINT):
+		ui.password = true
+		return false
+	default:
+		return false
+	}
+	return true
+}
+
+func (ui *UI) Print(line string) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	ui.printLocked(line)
+}
+
+func (ui *UI) addMember(username string) {
+	if username != "" && !slices.Contains(ui.members, username) {
+		ui.members = append(ui.members, username)
+		slices.Sort(ui.members)
+	}
+}
+
+// format colors the username of chat messages and draws presence lines in blue.
+func (ui *UI) format(line string) string {
+	if strings.HasPrefix(line, "* ") {
+		return BLUE_COLOR + line + RESET_COLOR
+	}
+	if strings.HasPrefix(line, "[") {
+		if end := strings.Index(line, "] "); end > 0 {
+			return ui.colorUsername(line[1:end]) + line[end+1:]
+		}
+	}
+	return line
+}
+
+func (ui *UI) colorUsername(username string) string {
+	h := fnv.New32a()
+	h.Write([]byte(username))
+	color := usernameColors[h.Sum32()%uint32(len(usernameColors))]
+	return fmt.Sprintf("%s[%s]%s", color, username, RESET_COLOR)
+}
+
+// printLocked adds line at the bottom of the message pane, scrolling it up, and puts the cursor back on the input line.
+func (ui *UI) printLocked(line string) {
+	if !ui.tty {
+		fmt.Println(line)
+		return
+	}
+	fmt.Printf("\0337%s%d;1H\n%s%s\0338", ESC, ui.height-2, line, RESET_COLOR)
+}
+
+func (ui *UI) drawStatus() {
+	if !ui.tty {
+		return
+	}
+	status := ui.status()
+	fmt.Printf("\0337%s1;1H%s%s%s%s\0338", ESC, REVERSE, status, strings.Repeat(" ", max(ui.width-len([]rune(status)), 0)), RESET_COLOR)
+}
+
+// status is the text of the status bar, cut short with an ellipsis when it is wider than the terminal.
+// A terminal too narrow for the ellipsis gets as much of the text as fits.
+func (ui *UI) status() string {
+	runes := []rune(fmt.Sprintf(" budgetchat %s | %d online: %s", ui.Addr, len(ui.members), strings.Join(ui.members, ", ")))
+	switch {
+	case len(runes) <= ui.width:
+	case ui.width > 3:
+		runes = append(runes[:ui.width-3], []rune("...")...)
+	default:
+		runes = runes[:max(ui.width, 0)]
+	}
+	return string(runes)
+}
+
+// drawPrompt clears the input line, the password prompt is concealed so it isn't shown on screen.
+func (ui *UI) drawPrompt() {
+	if !ui.tty {
+		return
+	}
+	fmt.Printf("%s%d;1H%s2K%s> ", ESC, ui.height, ESC, RESET_COLOR)
+	if ui.password {
+		fmt.Print(CONCEAL)
+	}
+}
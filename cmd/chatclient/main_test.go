@@ -0,0 +1,75 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestUpdateMembers(t *testing.T) {
+	ui := &UI{members: make([]string, 0), username: "carol"}
+
+	steps := []struct {
+		line    string
+		changed bool
+		want    []string
+	}{
+		{"Welcome to budgetchat! What shall I call you?", false, []string{}},
+		{ROOM_PREFIX + "bob, alice", true, []string{"alice", "bob", "carol"}},
+		{"* dave" + ENTER_SUFFIX, true, []string{"alice", "bob", "carol", "dave"}},
+		{"* dave" + ENTER_SUFFIX, true, []string{"alice", "bob", "carol", "dave"}},
+		{"[bob] * eve" + ENTER_SUFFIX, false, []string{"alice", "bob", "carol", "dave"}},
+		{"* bob" + LEAVE_SUFFIX, true, []string{"alice", "carol", "dave"}},
+		{"* nobody" + LEAVE_SUFFIX, true, []string{"alice", "carol", "dave"}},
+		{"[alice] hi", false, []string{"alice", "carol", "dave"}},
+	}
+	for _, step := range steps {
+		if changed := ui.update(step.line); changed != step.changed {
+			t.Errorf("%q: changed %v, want %v", step.line, changed, step.changed)
+		}
+		if !slices.Equal(ui.members, step.want) {
+			t.Errorf("%q: members %v, want %v", step.line, ui.members, step.want)
+		}
+	}
+	if !ui.joined {
+		t.Error("the room listing didn't mark the client as joined")
+	}
+
+	// An empty room lists nobody, only the client itself.
+	ui = &UI{members: make([]string, 0), username: "carol"}
+	ui.update(ROOM_PREFIX)
+	if !slices.Equal(ui.members, []string{"carol"}) {
+		t.Errorf("members of an empty room %v, want only carol", ui.members)
+	}
+}
+
+func TestUpdatePasswordPrompt(t *testing.T) {
+	ui := &UI{members: make([]string, 0)}
+	if ui.update("alice is a registered name, what is the password?") || !ui.password {
+		t.Error("the password prompt wasn't noticed")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	ui := &UI{Addr: "localhost:3000", members: []string{"alice", "bob"}}
+	full := " budgetchat localhost:3000 | 2 online: alice, bob"
+
+	tests := []struct {
+		width int
+		want  string
+	}{
+		{100, full},
+		{len(full), full},
+		{len(full) - 1, full[:len(full)-4] + "..."},
+		{4, " ..."},
+		{3, " bu"},
+		{1, " "},
+		{0, ""},
+		{-1, ""},
+	}
+	for _, test := range tests {
+		ui.width = test.width
+		if got := ui.status(); got != test.want {
+			t.Errorf("width %d: status %q, want %q", test.width, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// chatlog searches the transcripts recorded by the budgetchat server.
+//
+//	chatlog -dir transcripts -room budgetchat -user alice -since 2h -contains boguscoin
+//
+// -since and -until accept an RFC 3339 timestamp or a duration relative to now.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/dorimon-1/protohackers/internal/transcript"
+)
+
+func main() {
+	dir := flag.String("dir", "transcripts", "transcript directory of the server")
+	room := flag.String("room", "budgetchat", "room to search")
+	user := flag.String("user", "", "only show entries of this user")
+	since := flag.String("since", "", "only show entries after this time")
+	until := flag.String("until", "", "only show entries before this time")
+	contains := flag.String("contains", "", "only show messages containing this text")
+	limit := flag.Int("limit", 0, "show only the newest n entries, 0 for all")
+	flag.Parse()
+
+	q := transcript.Query{
+		User:     *user,
+		Contains: *contains,
+		Limit:    *limit,
+	}
+
+	var err error
+	if q.Since, err = parseTime(*since); err != nil {
+		log.Fatalln("Invalid -since: ", err)
+	}
+	if q.Until, err = parseTime(*until); err != nil {
+		log.Fatalln("Invalid -until: ", err)
+	}
+
+	entries, err := transcript.Search(*dir, *room, q)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	for _, entry := range entries {
+		fmt.Fprintln(os.Stdout, entry.String())
+	}
+}
+
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
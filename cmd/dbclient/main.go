@@ -0,0 +1,380 @@
+// dbclient talks to the unusual database over UDP.
+//
+//	dbclient -addr localhost:3000 get <key>...
+//	dbclient -addr localhost:3000 set <key> <value>
+//	dbclient -addr localhost:3000 load <file>      inserts every key=value line of the file, - reads stdin
+//	dbclient -addr localhost:3000 -n 10000 -c 8 bench
+//	dbclient -addr localhost:3000 watch <key or prefix*>...   prints updates until interrupted, needs a server started with -watch
+//
+// The database doesn't answer inserts and doesn't answer retrieves of keys it doesn't have, so a retrieve is sent again
+// until a response arrives or -retries is exhausted, and with -verify every insert is read back the same way.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MAX_DATAGRAM_SIZE is the spec's limit, requests and responses have to be shorter than it.
+const MAX_DATAGRAM_SIZE = 1000
+
+// BENCH_KEYS is how many keys every bench client cycles through. A retrieve only takes the response for its own key,
+// so a late response to an earlier retrieve that was counted as lost is discarded, unless it is BENCH_KEYS retrieves late.
+const BENCH_KEYS = 64
+
+var ErrNoResponse = errors.New("no response")
+
+func main() {
+	addr := flag.String("addr", "localhost:3000", "address of the database")
+	timeout := flag.Duration("timeout", 500*time.Millisecond, "how long to wait for a response before retrying")
+	retries := flag.Int("retries", 3, "how many times a request is sent again when no response arrives")
+	verify := flag.Bool("verify", false, "read every insert back, inserting again until the value is found")
+	rate := flag.Int("rate", 0, "maximum datagrams per second for load, 0 for no limit")
+	requests := flag.Int("n", 10000, "number of retrieves sent by bench")
+	concurrency := flag.Int("c", 8, "number of concurrent clients used by bench")
+	renew := flag.Duration("renew", time.Minute, "how often watch renews its subscriptions, has to be below the -watch-ttl of the server")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	newClient := func() *Client {
+		client, err := Dial(*addr)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		client.Timeout = *timeout
+		client.Retries = *retries
+		return client
+	}
+
+	switch {
+	case args[0] == "get" && len(args) >= 2:
+		client := newClient()
+		defer client.Close()
+		failed := false
+		for _, key := range args[1:] {
+			value, err := client.Get(key)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", key, err)
+				failed = true
+				continue
+			}
+			fmt.Printf("%s=%s\n", key, value)
+		}
+		if failed {
+			os.Exit(1)
+		}
+
+	case args[0] == "set" && len(args) == 3:
+		client := newClient()
+		defer client.Close()
+		if err := client.Set(args[1], args[2], *verify); err != nil {
+			log.Fatalln(err)
+		}
+
+	case args[0] == "load" && len(args) == 2:
+		client := newClient()
+		defer client.Close()
+		if err := load(client, args[1], *rate, *verify); err != nil {
+			log.Fatalln(err)
+		}
+
+	case args[0] == "bench" && len(args) == 1:
+		if err := bench(newClient, *requests, *concurrency); err != nil {
+			log.Fatalln(err)
+		}
+
+	case args[0] == "watch" && len(args) >= 2:
+		client := newClient()
+		defer client.Close()
+		if err := client.Watch(args[1:], *renew, func(key, value string) {
+			fmt.Printf("%s=%s\n", key, value)
+		}); err != nil {
+			log.Fatalln(err)
+		}
+
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+// Client sends requests to the database from a single UDP socket, it is not safe for concurrent use.
+type Client struct {
+	Timeout time.Duration
+	Retries int
+
+	conn *net.UDPConn
+	buf  []byte
+}
+
+func Dial(addr string) (*Client, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		Timeout: 500 * time.Millisecond,
+		Retries: 3,
+		conn:    conn,
+		buf:     make([]byte, MAX_DATAGRAM_SIZE),
+	}, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Get retrieves key, a key the database doesn't have is reported as ErrNoResponse once every retry timed out.
+func (c *Client) Get(key string) (string, error) {
+	if strings.ContainsRune(key, '=') {
+		return "", fmt.Errorf("key %q contains '='", key)
+	}
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		value, err := c.get(key, c.Timeout)
+		if !errors.Is(err, ErrNoResponse) {
+			return value, err
+		}
+	}
+	return "", ErrNoResponse
+}
+
+// get sends a single retrieve and waits up to timeout for its response, responses to other keys are skipped.
+func (c *Client) get(key string, timeout time.Duration) (string, error) {
+	if len(key) >= MAX_DATAGRAM_SIZE {
+		return "", fmt.Errorf("key is %d bytes, requests have to be shorter than %d", len(key), MAX_DATAGRAM_SIZE)
+	}
+	if _, err := c.conn.Write([]byte(key)); err != nil {
+		return "", err
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		n, err := c.conn.Read(c.buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return "", ErrNoResponse
+			}
+			return "", err
+		}
+		if responseKey, value, ok := strings.Cut(string(c.buf[:n]), "="); ok && responseKey == key {
+			return value, nil
+		}
+	}
+}
+
+// Set inserts key, with verify it is read back and inserted again until the database returns value.
+func (c *Client) Set(key, value string, verify bool) error {
+	if strings.ContainsRune(key, '=') {
+		return fmt.Errorf("key %q contains '='", key)
+	}
+	request := key + "=" + value
+	if len(request) >= MAX_DATAGRAM_SIZE {
+		return fmt.Errorf("insert is %d bytes, requests have to be shorter than %d", len(request), MAX_DATAGRAM_SIZE)
+	}
+
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		if _, err := c.conn.Write([]byte(request)); err != nil {
+			return err
+		}
+		if !verify {
+			return nil
+		}
+		got, err := c.get(key, c.Timeout)
+		if err == nil && got == value {
+			return nil
+		}
+		if err != nil && !errors.Is(err, ErrNoResponse) {
+			return err
+		}
+	}
+	return fmt.Errorf("%s was not stored after %d attempts", key, c.Retries+1)
+}
+
+// Watch subscribes to patterns, renewing the subscriptions every renew, and calls fn with every update until reading fails.
+// The confirm=<token> the server asks a new subscriber for is sent back, it is never passed to fn.
+func (c *Client) Watch(patterns []string, renew time.Duration, fn func(key, value string)) error {
+	subscribe := func() error {
+		for _, pattern := range patterns {
+			if _, err := fmt.Fprintf(c.conn, "watch=%s", pattern); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := subscribe(); err != nil {
+		return err
+	}
+
+	renewAt := time.Now().Add(renew)
+	for {
+		c.conn.SetReadDeadline(renewAt)
+		n, err := c.conn.Read(c.buf)
+		if err != nil {
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				return err
+			}
+			if err := subscribe(); err != nil {
+				return err
+			}
+			renewAt = time.Now().Add(renew)
+			continue
+		}
+		key, value, ok := strings.Cut(string(c.buf[:n]), "=")
+		switch {
+		case !ok:
+		case key == "confirm":
+			if _, err := c.conn.Write(c.buf[:n]); err != nil {
+				return err
+			}
+		default:
+			fn(key, value)
+		}
+	}
+}
+
+// load inserts every key=value line of path, empty lines are skipped.
+func load(client *Client, path string, rate int, verify bool) error {
+	var input io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+	}
+
+	var tick <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	scanner := bufio.NewScanner(input)
+	inserted, failed := 0, 0
+	for line := 1; scanner.Scan(); line++ {
+		if scanner.Text() == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			return fmt.Errorf("line %d: expected key=value", line)
+		}
+		if tick != nil {
+			<-tick
+		}
+		if err := client.Set(key, value, verify); err != nil {
+			fmt.Fprintf(os.Stderr, "line %d: %s\n", line, err)
+			failed++
+			continue
+		}
+		inserted++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	fmt.Printf("inserted %d keys, %d failed\n", inserted, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d inserts failed", failed)
+	}
+	return nil
+}
+
+// bench inserts BENCH_KEYS keys for each of c concurrent clients, which retrieve them in turn n times in total.
+// A retrieve that isn't answered within the timeout counts as lost and isn't retried.
+func bench(newClient func() *Client, n, c int) error {
+	benchKey := func(client, i int) string {
+		return fmt.Sprintf("dbclient-bench-%d-%d-%d", os.Getpid(), client, i%BENCH_KEYS)
+	}
+	setup := newClient()
+	for client := 0; client < c; client++ {
+		for i := 0; i < BENCH_KEYS; i++ {
+			if err := setup.Set(benchKey(client, i), "value", true); err != nil {
+				setup.Close()
+				return fmt.Errorf("setting up the bench keys: %w", err)
+			}
+		}
+	}
+	setup.Close()
+
+	var (
+		mu        sync.Mutex
+		latencies = make([]time.Duration, 0, n)
+		lost      int
+		wg        sync.WaitGroup
+		requests  = make(chan struct{}, n)
+	)
+	for i := 0; i < n; i++ {
+		requests <- struct{}{}
+	}
+	close(requests)
+
+	start := time.Now()
+	for i := 0; i < c; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := newClient()
+			defer client.Close()
+
+			sequence := 0
+			for range requests {
+				key := benchKey(i, sequence)
+				sequence++
+				sent := time.Now()
+				_, err := client.get(key, client.Timeout)
+				latency := time.Since(sent)
+
+				mu.Lock()
+				if err != nil {
+					lost++
+				} else {
+					latencies = append(latencies, latency)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	fmt.Printf("%d requests from %d clients in %s, %.0f requests/s\n", n, c, elapsed.Round(time.Millisecond), float64(n)/elapsed.Seconds())
+	fmt.Printf("lost %d (%.2f%%)\n", lost, 100*float64(lost)/float64(n))
+	if len(latencies) > 0 {
+		slices.Sort(latencies)
+		percentile := func(p float64) time.Duration {
+			return latencies[int(p*float64(len(latencies)-1))]
+		}
+		fmt.Printf("latency p50 %s p90 %s p99 %s max %s\n", percentile(0.5), percentile(0.9), percentile(0.99), latencies[len(latencies)-1])
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [flags] get <key>... | set <key> <value> | load <file> | bench | watch <pattern>...\n", os.Args[0])
+	flag.PrintDefaults()
+}
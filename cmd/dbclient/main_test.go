@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDatabase answers the datagrams of a client with handle, it records every request it received.
+type fakeDatabase struct {
+	conn *net.UDPConn
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func startFakeDatabase(t *testing.T, handle func(request string, reply func(string))) *fakeDatabase {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	db := &fakeDatabase{conn: conn}
+	go func() {
+		buf := make([]byte, MAX_DATAGRAM_SIZE)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			request := string(buf[:n])
+			db.mu.Lock()
+			db.requests = append(db.requests, request)
+			db.mu.Unlock()
+			handle(request, func(response string) { conn.WriteToUDP([]byte(response), addr) })
+		}
+	}()
+	return db
+}
+
+func (db *fakeDatabase) Requests() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]string(nil), db.requests...)
+}
+
+func dialFake(t *testing.T, db *fakeDatabase) *Client {
+	t.Helper()
+	client, err := Dial(db.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	client.Timeout = 200 * time.Millisecond
+	client.Retries = 2
+	return client
+}
+
+func TestGetSkipsOtherKeys(t *testing.T) {
+	db := startFakeDatabase(t, func(request string, reply func(string)) {
+		// A late response to an earlier retrieve arrives first.
+		reply("other=stale")
+		reply("noequals")
+		if request == "key" {
+			reply("key=value")
+		}
+	})
+	client := dialFake(t, db)
+
+	if got, err := client.Get("key"); err != nil || got != "value" {
+		t.Errorf("Get(key) = %q, %v, want value", got, err)
+	}
+	if got, err := client.Get("missing"); err != ErrNoResponse {
+		t.Errorf("Get(missing) = %q, %v, want ErrNoResponse", got, err)
+	}
+	if got := len(db.Requests()); got != 1+1+client.Retries {
+		t.Errorf("the database received %d requests, want one for key and %d for missing", got, 1+client.Retries)
+	}
+	if _, err := client.Get("a=b"); err == nil {
+		t.Error("Get of a key with '=' succeeded")
+	}
+}
+
+func TestSetVerifies(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		values  = make(map[string]string)
+		inserts int
+	)
+	db := startFakeDatabase(t, func(request string, reply func(string)) {
+		mu.Lock()
+		defer mu.Unlock()
+		key, value, isInsert := strings.Cut(request, "=")
+		if isInsert {
+			// The first insert is lost on the way.
+			if inserts++; inserts > 1 {
+				values[key] = value
+			}
+			return
+		}
+		if value, ok := values[key]; ok {
+			reply(key + "=" + value)
+		}
+	})
+	client := dialFake(t, db)
+
+	if err := client.Set("key", "value", true); err != nil {
+		t.Fatalf("Set with verify: %s", err)
+	}
+	want := []string{"key=value", "key", "key=value", "key"}
+	if got := db.Requests(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("requests %q, want %q", got, want)
+	}
+
+	// Without verify a single insert is sent and nothing is read back, the Get waits for it to arrive.
+	if err := client.Set("other", "value", false); err != nil {
+		t.Fatalf("Set without verify: %s", err)
+	}
+	if got, err := client.Get("other"); err != nil || got != "value" {
+		t.Fatalf("Get(other) = %q, %v, want value", got, err)
+	}
+	want = append(want, "other=value", "other")
+	if got := db.Requests(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("requests %q, want %q", got, want)
+	}
+
+	// An insert that is never stored fails once every retry was read back.
+	mu.Lock()
+	inserts = -100
+	mu.Unlock()
+	if err := client.Set("never", "stored", true); err == nil {
+		t.Error("Set of an insert the database drops succeeded")
+	}
+}
+
+func TestWatchConfirms(t *testing.T) {
+	db := startFakeDatabase(t, func(request string, reply func(string)) {
+		switch request {
+		case "watch=user*":
+			reply("confirm=token")
+		case "confirm=token":
+			reply("user1=alice")
+		}
+	})
+	client := dialFake(t, db)
+
+	updates := make(chan string, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Watch([]string{"user*"}, time.Hour, func(key, value string) {
+			updates <- key + "=" + value
+		})
+	}()
+
+	select {
+	case got := <-updates:
+		if got != "user1=alice" {
+			t.Errorf("first update %q, want user1=alice", got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no update after the confirmation, the database received %q", db.Requests())
+	}
+	if got := db.Requests(); len(got) != 2 || got[1] != "confirm=token" {
+		t.Errorf("requests %q, want the subscription and its confirmation", got)
+	}
+
+	client.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Watch returned nil after the client was closed")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Watch didn't return after the client was closed")
+	}
+	if len(updates) != 0 {
+		t.Errorf("unexpected update %q", <-updates)
+	}
+}
@@ -0,0 +1,108 @@
+// mitmreplay replays the client side of sessions recorded by middlemob against a server.
+//
+//	mitmreplay -capture capture.jsonl -list
+//	mitmreplay -capture capture.jsonl -addr localhost:3000 -session 1697712345000000001 -speed 0
+//
+// Every session is replayed on its own connection, all of them at once with the delays they were recorded with,
+// and everything the servers send is printed quoted, prefixed with the session it was sent to.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dorimon-1/protohackers/internal/mitm"
+)
+
+func main() {
+	capturePath := flag.String("capture", "capture.jsonl", "capture file recorded by middlemob")
+	addr := flag.String("addr", "localhost:3000", "server to replay the sessions against")
+	session := flag.Uint64("session", 0, "replay only this session, 0 replays all of them")
+	speed := flag.Float64("speed", 1, "multiplies the recorded delays, 0 sends everything at once")
+	wait := flag.Duration("wait", time.Second, "how long to keep reading after a session sent everything")
+	list := flag.Bool("list", false, "list the sessions of the capture instead of replaying them")
+	flag.Parse()
+
+	file, err := os.Open(*capturePath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	events := make([]mitm.Event, 0)
+	err = mitm.ReadCapture(file, func(e mitm.Event) error {
+		if *session == 0 || e.Session == *session {
+			events = append(events, e)
+		}
+		return nil
+	})
+	file.Close()
+	if err != nil {
+		log.Fatalln("Failed to read capture: ", err)
+	}
+
+	if *list {
+		listSessions(events)
+		return
+	}
+
+	var mu sync.Mutex
+	replayer := &mitm.Replayer{
+		Dial:  func() (net.Conn, error) { return net.Dial("tcp", *addr) },
+		Speed: *speed,
+		Wait:  *wait,
+		Output: func(session uint64, data []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			fmt.Printf("%d < %q\n", session, data)
+		},
+	}
+	if err := replayer.Replay(events); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+type sessionSummary struct {
+	id      uint64
+	client  string
+	start   time.Time
+	end     time.Time
+	c2s     int
+	s2c     int
+	closing string
+}
+
+func listSessions(events []mitm.Event) {
+	sessions := make(map[uint64]*sessionSummary)
+	for _, e := range events {
+		s, ok := sessions[e.Session]
+		if !ok {
+			s = &sessionSummary{id: e.Session, start: e.Time}
+			sessions[e.Session] = s
+		}
+		s.end = e.Time
+		switch {
+		case e.Kind == mitm.EVENT_OPEN:
+			s.client = e.Client
+		case e.Kind == mitm.EVENT_DATA && e.Direction == mitm.CLIENT_TO_SERVER:
+			s.c2s += len(e.Data)
+		case e.Kind == mitm.EVENT_DATA && e.Direction == mitm.SERVER_TO_CLIENT:
+			s.s2c += len(e.Data)
+		case e.Kind == mitm.EVENT_CLOSE:
+			s.closing = e.Error
+		}
+	}
+
+	summaries := make([]*sessionSummary, 0, len(sessions))
+	for _, s := range sessions {
+		summaries = append(summaries, s)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].start.Before(summaries[j].start) })
+	for _, s := range summaries {
+		fmt.Printf("%d %s %s %s c2s=%dB s2c=%dB %s\n", s.id, s.client, s.start.Format(time.RFC3339), s.end.Sub(s.start).Round(time.Millisecond), s.c2s, s.s2c, s.closing)
+	}
+}
@@ -1,3 +1,11 @@
 module github.com/dorimon-1/protohackers
 
 go 1.22.2
+
+require (
+	golang.org/x/crypto v0.31.0
+	golang.org/x/term v0.27.0
+	golang.org/x/text v0.21.0
+)
+
+require golang.org/x/sys v0.28.0 // indirect
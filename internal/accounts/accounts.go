@@ -0,0 +1,199 @@
+// Package accounts stores registered budgetchat usernames and their passwords.
+// The database is a JSON file mapping a username to its bcrypt hash, it is shared
+// between the chat server (which only reads it) and the chatadmin cmd (which edits it).
+package accounts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrEmptyUsername = errors.New("username must not be empty")
+	ErrEmptyPassword = errors.New("password must not be empty")
+	ErrNotFound      = errors.New("account not found")
+)
+
+type Store struct {
+	path    string
+	mu      sync.Mutex
+	modTime time.Time
+	hashes  map[string]string
+}
+
+// Open accepts a path to the accounts file and loads it.
+// A missing file is treated as an empty database, it is created on the first Add.
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:   path,
+		hashes: make(map[string]string),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Registered reports whether the username belongs to a registered account.
+func (s *Store) Registered(username string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.refresh()
+	_, ok := s.hashes[username]
+	return ok
+}
+
+// Authenticate reports whether password matches the stored hash of username.
+func (s *Store) Authenticate(username, password string) bool {
+	s.mu.Lock()
+	s.refresh()
+	hash, ok := s.hashes[username]
+	s.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// Add registers username with the given password, replacing the password of an existing account.
+func (s *Store) Add(username, password string) error {
+	if username == "" {
+		return ErrEmptyUsername
+	}
+	if password == "" {
+		return ErrEmptyPassword
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return err
+	}
+
+	s.hashes[username] = string(hash)
+	return s.save()
+}
+
+// Remove deletes the account of username.
+func (s *Store) Remove(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.reload(); err != nil {
+		return err
+	}
+
+	if _, ok := s.hashes[username]; !ok {
+		return ErrNotFound
+	}
+
+	delete(s.hashes, username)
+	return s.save()
+}
+
+// Usernames returns all registered usernames sorted alphabetically.
+func (s *Store) Usernames() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.refresh()
+	usernames := make([]string, 0, len(s.hashes))
+	for username := range s.hashes {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	return usernames
+}
+
+// refresh reloads the file when it was modified by another process, e.g chatadmin while the server is running.
+// On failure the previously loaded accounts are kept.
+func (s *Store) refresh() {
+	info, err := os.Stat(s.path)
+	if err != nil || info.ModTime().Equal(s.modTime) {
+		return
+	}
+	_ = s.reload()
+}
+
+func (s *Store) reload() error {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.hashes = make(map[string]string)
+		s.modTime = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	hashes := make(map[string]string)
+	if len(data) != 0 {
+		if err := json.Unmarshal(data, &hashes); err != nil {
+			return fmt.Errorf("parsing %s: %w", s.path, err)
+		}
+	}
+
+	s.hashes = hashes
+	s.modTime = info.ModTime()
+	return nil
+}
+
+// save writes the accounts to a temporary file and renames it over the database,
+// so a running server never reads a partially written file.
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.hashes, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	s.modTime = info.ModTime()
+	return nil
+}
@@ -0,0 +1,43 @@
+package accounts
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Add("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second store sees changes made by another process.
+	server, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !server.Registered("alice") {
+		t.Fatal("alice should be registered")
+	}
+	if !server.Authenticate("alice", "secret") {
+		t.Error("correct password was rejected")
+	}
+	if server.Authenticate("alice", "wrong") {
+		t.Error("wrong password was accepted")
+	}
+	if server.Registered("bob") {
+		t.Error("bob should not be registered")
+	}
+
+	if err := store.Remove("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Remove("alice"); err != ErrNotFound {
+		t.Errorf("removing a missing account returned %v, want %v", err, ErrNotFound)
+	}
+}
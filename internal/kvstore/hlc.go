@@ -0,0 +1,71 @@
+package kvstore
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Timestamp is a hybrid logical clock reading, the node name breaks ties between concurrent writes.
+type Timestamp struct {
+	Wall    int64
+	Logical uint32
+	Node    string
+}
+
+// Less orders timestamps by wall time, then logical counter, then node name.
+func (t Timestamp) Less(other Timestamp) bool {
+	if t.Wall != other.Wall {
+		return t.Wall < other.Wall
+	}
+	if t.Logical != other.Logical {
+		return t.Logical < other.Logical
+	}
+	return t.Node < other.Node
+}
+
+func (t Timestamp) String() string {
+	return fmt.Sprintf("%d.%d@%s", t.Wall, t.Logical, t.Node)
+}
+
+// Clock is a hybrid logical clock, its readings never go backwards and always follow every timestamp it observed,
+// even when the wall clocks of the nodes disagree.
+type Clock struct {
+	Node string
+	// WallTime returns the physical time in nanoseconds, it is replaced in tests.
+	WallTime func() int64
+
+	mu   sync.Mutex
+	last Timestamp
+}
+
+func NewClock(node string) *Clock {
+	return &Clock{
+		Node:     node,
+		WallTime: func() int64 { return time.Now().UnixNano() },
+	}
+}
+
+// Now returns a timestamp for a local write.
+func (c *Clock) Now() Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wall := c.WallTime()
+	if wall > c.last.Wall {
+		c.last = Timestamp{Wall: wall}
+	} else {
+		c.last.Logical++
+	}
+	return Timestamp{Wall: c.last.Wall, Logical: c.last.Logical, Node: c.Node}
+}
+
+// Observe moves the clock past a timestamp received from another node.
+func (c *Clock) Observe(t Timestamp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if t.Wall > c.last.Wall || t.Wall == c.last.Wall && t.Logical > c.last.Logical {
+		c.last = Timestamp{Wall: t.Wall, Logical: t.Logical}
+	}
+}
@@ -0,0 +1,211 @@
+package kvstore
+
+import (
+	"container/list"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NAMESPACE_SEPARATOR splits a key into its namespace and name, "users/alice" is in the "users" namespace.
+// Keys without a separator belong to the default namespace "".
+const NAMESPACE_SEPARATOR = "/"
+
+// Limits bound what a namespace may hold, zero values mean no limit.
+type Limits struct {
+	TTL      time.Duration
+	MaxKeys  int
+	MaxBytes int64
+}
+
+// Policy holds the limits of every namespace, namespaces without their own limits use Default.
+// MaxBytes caps the size of all keys and values together, the least recently used keys are evicted first.
+type Policy struct {
+	Default    Limits
+	Namespaces map[string]Limits
+	MaxBytes   int64
+}
+
+func NewPolicy() *Policy {
+	return &Policy{Namespaces: make(map[string]Limits)}
+}
+
+// Evicts reports whether any limit can evict keys, only then the order in which keys are read matters.
+func (p *Policy) Evicts() bool {
+	if p.MaxBytes > 0 || p.Default.MaxKeys > 0 || p.Default.MaxBytes > 0 {
+		return true
+	}
+	for _, limits := range p.Namespaces {
+		if limits.MaxKeys > 0 || limits.MaxBytes > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) Limits(namespace string) Limits {
+	if limits, ok := p.Namespaces[namespace]; ok {
+		return limits
+	}
+	return p.Default
+}
+
+// ParseNamespaceLimits parses "<namespace>:ttl=5m,max-keys=100,max-bytes=4096", as used by the -namespace flag.
+func ParseNamespaceLimits(value string) (string, Limits, error) {
+	var limits Limits
+	namespace, options, ok := strings.Cut(value, ":")
+	if !ok {
+		return "", limits, fmt.Errorf("%q is missing the namespace, expected <namespace>:<limits>", value)
+	}
+
+	for _, option := range strings.Split(options, ",") {
+		name, optionValue, _ := strings.Cut(option, "=")
+		var err error
+		switch name {
+		case "ttl":
+			limits.TTL, err = time.ParseDuration(optionValue)
+		case "max-keys":
+			limits.MaxKeys, err = strconv.Atoi(optionValue)
+		case "max-bytes":
+			limits.MaxBytes, err = strconv.ParseInt(optionValue, 10, 64)
+		default:
+			err = fmt.Errorf("unknown limit %q", name)
+		}
+		if err != nil {
+			return "", limits, fmt.Errorf("namespace %q: %w", namespace, err)
+		}
+	}
+	return namespace, limits, nil
+}
+
+func namespaceOf(key string) string {
+	namespace, _, ok := strings.Cut(key, NAMESPACE_SEPARATOR)
+	if !ok {
+		return ""
+	}
+	return namespace
+}
+
+// usage tracks the size of every namespace and the order in which keys were used, least recently used at the front.
+type usage struct {
+	namespaces  map[string]*namespaceUsage
+	elements    map[string]*list.Element
+	bytes       int64
+	clock       uint64
+	evictions   uint64
+	expirations uint64
+}
+
+type namespaceUsage struct {
+	lru   *list.List
+	bytes int64
+}
+
+type usedKey struct {
+	key      string
+	size     int64
+	lastUsed uint64
+}
+
+func newUsage() *usage {
+	return &usage{
+		namespaces: make(map[string]*namespaceUsage),
+		elements:   make(map[string]*list.Element),
+	}
+}
+
+// touch marks key as the most recently used key and records its current size.
+func (u *usage) touch(key string, size int64) {
+	u.clock++
+
+	if element, ok := u.elements[key]; ok {
+		used := element.Value.(*usedKey)
+		ns := u.namespaces[namespaceOf(key)]
+		ns.bytes += size - used.size
+		u.bytes += size - used.size
+		used.size = size
+		used.lastUsed = u.clock
+		ns.lru.MoveToBack(element)
+		return
+	}
+
+	namespace := namespaceOf(key)
+	ns, ok := u.namespaces[namespace]
+	if !ok {
+		ns = &namespaceUsage{lru: list.New()}
+		u.namespaces[namespace] = ns
+	}
+	u.elements[key] = ns.lru.PushBack(&usedKey{key: key, size: size, lastUsed: u.clock})
+	ns.bytes += size
+	u.bytes += size
+}
+
+// used marks key as the most recently used key, if it is tracked.
+func (u *usage) used(key string) {
+	if element, ok := u.elements[key]; ok {
+		u.clock++
+		element.Value.(*usedKey).lastUsed = u.clock
+		u.namespaces[namespaceOf(key)].lru.MoveToBack(element)
+	}
+}
+
+func (u *usage) remove(key string) {
+	element, ok := u.elements[key]
+	if !ok {
+		return
+	}
+
+	used := element.Value.(*usedKey)
+	ns := u.namespaces[namespaceOf(key)]
+	ns.lru.Remove(element)
+	ns.bytes -= used.size
+	u.bytes -= used.size
+	delete(u.elements, key)
+}
+
+// victim returns the least recently used key that has to go to bring the usage back within policy, or false when nothing has to.
+// Namespace limits are checked before the global MaxBytes.
+func (u *usage) victim(policy *Policy) (string, bool) {
+	for namespace, ns := range u.namespaces {
+		limits := policy.Limits(namespace)
+		overKeys := limits.MaxKeys > 0 && ns.lru.Len() > limits.MaxKeys
+		overBytes := limits.MaxBytes > 0 && ns.bytes > limits.MaxBytes
+		if (overKeys || overBytes) && ns.lru.Len() > 0 {
+			return ns.lru.Front().Value.(*usedKey).key, true
+		}
+	}
+
+	if policy.MaxBytes <= 0 || u.bytes <= policy.MaxBytes {
+		return "", false
+	}
+
+	var oldest *usedKey
+	for _, ns := range u.namespaces {
+		if ns.lru.Len() == 0 {
+			continue
+		}
+		if front := ns.lru.Front().Value.(*usedKey); oldest == nil || front.lastUsed < oldest.lastUsed {
+			oldest = front
+		}
+	}
+	if oldest == nil {
+		return "", false
+	}
+	return oldest.key, true
+}
+
+func entrySize(key string, entry Entry) int64 {
+	return int64(len(key) + len(entry.Value))
+}
+
+// expired reports whether entry outlived the TTL of its namespace.
+// The TTL counts from the timestamp of the write, so replicated keys expire at the same time on every node.
+// Entries without a timestamp were written before replication and never expire.
+func (p *Policy) expired(key string, entry Entry, now time.Time) bool {
+	ttl := p.Limits(namespaceOf(key)).TTL
+	if ttl <= 0 || entry.Timestamp.Wall == 0 {
+		return false
+	}
+	return now.UnixNano() >= entry.Timestamp.Wall+int64(ttl)
+}
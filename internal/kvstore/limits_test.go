@@ -0,0 +1,90 @@
+package kvstore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPolicyEvictsLeastRecentlyUsed(t *testing.T) {
+	db := New("test")
+	db.SetReadOnly("version", "1.0")
+	db.Policy.MaxBytes = 6
+
+	db.Set("a", "1")
+	db.Set("b", "2")
+	db.Set("c", "3")
+	// Reading a makes b the least recently used key.
+	db.Get("a")
+	db.Set("d", "4")
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if _, ok := db.Get(key); ok != want {
+			t.Errorf("%s present = %v, want %v", key, ok, want)
+		}
+	}
+
+	if _, ok := db.Get("version"); !ok {
+		t.Error("version must never be evicted")
+	}
+	if stats, _ := db.Get("stats"); stats != "keys=3 bytes=6 evictions=1 expired=0" {
+		t.Errorf("stats = %q", stats)
+	}
+}
+
+func TestPolicyNamespaceLimits(t *testing.T) {
+	db := New("test")
+	db.Policy.Namespaces["tmp"] = Limits{MaxKeys: 1}
+
+	db.Set("tmp/x", "1")
+	db.Set("tmp/y", "2")
+	db.Set("x", "1")
+	db.Set("y", "2")
+
+	for key, want := range map[string]bool{"tmp/x": false, "tmp/y": true, "x": true, "y": true} {
+		if _, ok := db.Get(key); ok != want {
+			t.Errorf("%s present = %v, want %v", key, ok, want)
+		}
+	}
+}
+
+func TestPolicyExpiresKeys(t *testing.T) {
+	db := New("test")
+	db.Policy.Namespaces["session"] = Limits{TTL: time.Minute}
+
+	db.Clock.WallTime = func() int64 { return time.Now().Add(-2 * time.Minute).UnixNano() }
+	db.Set("session/old", "1")
+	db.Set("forever", "1")
+	db.Clock.WallTime = func() int64 { return time.Now().UnixNano() }
+	db.Set("session/new", "1")
+
+	if _, ok := db.Get("session/old"); ok {
+		t.Error("session/old should have expired")
+	}
+	db.ExpireKeys()
+	for _, key := range []string{"forever", "session/new"} {
+		if _, ok := db.Get(key); !ok {
+			t.Errorf("%s should not have expired", key)
+		}
+	}
+
+	db.Set("stats", "overwritten")
+	if stats, _ := db.Get("stats"); stats != "keys=2 bytes=20 evictions=0 expired=1" {
+		t.Errorf("stats = %q", stats)
+	}
+}
+
+func TestParseNamespaceLimits(t *testing.T) {
+	namespace, limits, err := ParseNamespaceLimits("cache:ttl=5m,max-keys=10,max-bytes=2048")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if namespace != "cache" || limits != (Limits{TTL: 5 * time.Minute, MaxKeys: 10, MaxBytes: 2048}) {
+		t.Errorf("got %q %+v", namespace, limits)
+	}
+
+	for _, bad := range []string{"ttl=5m", "cache:ttl=forever", "cache:size=1"} {
+		if _, _, err := ParseNamespaceLimits(bad); err == nil {
+			t.Errorf("%q should not parse", bad)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+// Package kvstore is the storage engine of the unusual database: a replicated, persistent string map
+// with last-writer-wins merging, expiry and LRU eviction. The UDP, HTTP and line protocol front-ends all share one DB.
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// STATS_KEY is always read-only, its value is computed from the usage of the store on every read.
+const STATS_KEY = "stats"
+
+// MAX_ENTRY_SIZE bounds the size of a key and value together, so every write fits in a single record.
+const MAX_ENTRY_SIZE = 64 << 10
+
+// SHARD_COUNT is how many independently locked maps the keys are spread over.
+const SHARD_COUNT = 64
+
+var (
+	ErrReadOnly = errors.New("key is read-only")
+	ErrTooLarge = errors.New("key and value are too large")
+)
+
+// Store is the interface the front-ends use, every method is safe for concurrent use.
+type Store interface {
+	// Get returns the value of key, false when it is not set.
+	Get(key string) (string, bool)
+	Set(key, value string) error
+	Delete(key string) error
+	// Keys returns the keys starting with prefix in sorted order, the read-only keys are not listed.
+	Keys(prefix string) []string
+}
+
+// Entry is a write of a key, a delete is a write too: it leaves a tombstone behind so that
+// an older write replicated from another node can't bring the key back.
+type Entry struct {
+	Value     string
+	Timestamp Timestamp
+	Deleted   bool
+}
+
+// DB is the Store of a single node.
+// The keys are spread over shards so that reads of different keys don't contend. Writes are serialized by mu,
+// which also guards the usage and the write-ahead log, which is appended to in order anyway. Snapshots are written
+// from a copy of the shards without it.
+// A shard is only modified with both mu and its own lock held, so holding mu is enough to read every shard.
+type DB struct {
+	Clock       *Clock
+	Persistence *Persistence
+	Policy      *Policy
+	// SnapshotInterval is how often the write-ahead log is compacted into a snapshot.
+	SnapshotInterval time.Duration
+	// OnWrite is called with every Set and Delete of a client of this node once it is applied, but not with merged writes.
+	// It is called with mu held, so in the order of the timestamps, and must return quickly.
+	// It is set before the DB is used and must not call back into it.
+	OnWrite func(key string, entry Entry)
+	// OnChange is called with every write that changed the DB, merged writes included, once mu is released.
+	// It is set before the DB is used and must not call back into it.
+	OnChange func(key string, entry Entry)
+	// Logger receives a line for every write and the failures of the persistence, it defaults to the standard logger.
+	Logger *log.Logger
+
+	mu           sync.Mutex
+	shards       [SHARD_COUNT]shard
+	readOnly     sync.Map
+	usage        *usage
+	lastSnapshot time.Time
+	snapshotting bool
+	snapshots    sync.WaitGroup
+}
+
+type shard struct {
+	mu      sync.RWMutex
+	entries map[string]Entry
+}
+
+var _ Store = (*DB)(nil)
+
+// New accepts the node name and returns an empty in-memory DB.
+func New(node string) *DB {
+	db := &DB{
+		Clock:            NewClock(node),
+		Policy:           NewPolicy(),
+		SnapshotInterval: time.Minute,
+		Logger:           log.Default(),
+		usage:            newUsage(),
+		lastSnapshot:     time.Now(),
+	}
+	for i := range db.shards {
+		db.shards[i].entries = make(map[string]Entry)
+	}
+	return db
+}
+
+// shard returns the shard of key, picked by its FNV-1a hash.
+func (db *DB) shard(key string) *shard {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return &db.shards[hash%SHARD_COUNT]
+}
+
+// Open recovers the database persisted in dir and logs every following write there.
+// Writes of read-only keys found on disk are dropped.
+func (db *DB) Open(dir string, sync bool) error {
+	persistence, entries, err := OpenPersistence(dir, db.Logger)
+	if err != nil {
+		return err
+	}
+	persistence.Sync = sync
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for key, entry := range entries {
+		if db.isReadOnly(key) {
+			continue
+		}
+		db.set(key, entry)
+		if !entry.Deleted {
+			db.usage.touch(key, entrySize(key, entry))
+		}
+	}
+	db.Persistence = persistence
+	db.Logger.Printf("Recovered %d keys from %s", len(db.usage.elements), dir)
+	return nil
+}
+
+// Close waits for a snapshot that is being written and closes the log.
+func (db *DB) Close() error {
+	if db.Persistence == nil {
+		return nil
+	}
+	db.snapshots.Wait()
+	return db.Persistence.Close()
+}
+
+// SetReadOnly pins key to value, clients can read it but never write it.
+func (db *DB) SetReadOnly(key, value string) {
+	db.readOnly.Store(key, value)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.remove(key)
+}
+
+func (db *DB) isReadOnly(key string) bool {
+	_, ok := db.readOnly.Load(key)
+	return ok || key == STATS_KEY
+}
+
+// Get only takes the lock of the shard of key, unless the key expired or the policy evicts keys and the read has to be recorded.
+func (db *DB) Get(key string) (string, bool) {
+	if key == STATS_KEY {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		return db.stats(), true
+	}
+	if value, ok := db.readOnly.Load(key); ok {
+		return value.(string), true
+	}
+
+	shard := db.shard(key)
+	shard.mu.RLock()
+	entry, ok := shard.entries[key]
+	shard.mu.RUnlock()
+	if !ok || entry.Deleted {
+		return "", false
+	}
+
+	if db.Policy.expired(key, entry, time.Now()) {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		// The key may have been written again since we read it.
+		if current, ok := shard.entries[key]; ok && current.Timestamp == entry.Timestamp {
+			db.remove(key)
+			db.usage.expirations++
+		}
+		return "", false
+	}
+
+	if db.Policy.Evicts() {
+		db.mu.Lock()
+		db.usage.used(key)
+		db.mu.Unlock()
+	}
+	return entry.Value, true
+}
+
+// Set stores a value written by a client of this node.
+func (db *DB) Set(key, value string) error {
+	if len(key)+len(value) > MAX_ENTRY_SIZE {
+		return ErrTooLarge
+	}
+	return db.write(key, Entry{Value: value})
+}
+
+// Delete removes a key written by a client of this node, deleting a key that isn't set is not an error.
+func (db *DB) Delete(key string) error {
+	return db.write(key, Entry{Deleted: true})
+}
+
+func (db *DB) write(key string, entry Entry) error {
+	db.mu.Lock()
+	if db.isReadOnly(key) {
+		db.mu.Unlock()
+		return ErrReadOnly
+	}
+	entry.Timestamp = db.Clock.Now()
+	applied, err := db.apply(key, entry)
+	if applied && db.OnWrite != nil {
+		db.OnWrite(key, entry)
+	}
+	db.mu.Unlock()
+
+	if err != nil || !applied {
+		return err
+	}
+	if entry.Deleted {
+		db.Logger.Printf("DATABASE DELETE: %s", key)
+	} else {
+		db.Logger.Printf("DATABASE UPDATE: %s=%s", key, entry.Value)
+	}
+	if db.OnChange != nil {
+		db.OnChange(key, entry)
+	}
+	return nil
+}
+
+// Merge applies a write replicated from another node, the write with the newest timestamp wins.
+func (db *DB) Merge(key string, entry Entry) {
+	db.Clock.Observe(entry.Timestamp)
+	if db.isReadOnly(key) {
+		return
+	}
+
+	db.mu.Lock()
+	applied, err := db.apply(key, entry)
+	db.mu.Unlock()
+
+	if err != nil {
+		db.Logger.Printf("Failed to merge %s: %s", key, err)
+		return
+	}
+	if applied {
+		db.Logger.Printf("REPLICATED UPDATE: %s=%s (%s, deleted=%v)", key, entry.Value, entry.Timestamp, entry.Deleted)
+		if db.OnChange != nil {
+			db.OnChange(key, entry)
+		}
+	}
+}
+
+// apply reports whether entry replaced the current value of key, the write is logged before it is applied.
+func (db *DB) apply(key string, entry Entry) (bool, error) {
+	if current, ok := db.shard(key).entries[key]; ok && !current.Timestamp.Less(entry.Timestamp) {
+		return false, nil
+	}
+
+	if db.Persistence != nil {
+		if err := db.Persistence.LogInsert(key, entry); err != nil {
+			return false, fmt.Errorf("logging write: %w", err)
+		}
+	}
+	db.set(key, entry)
+	if entry.Deleted {
+		db.usage.remove(key)
+	} else {
+		db.usage.touch(key, entrySize(key, entry))
+		db.enforcePolicy()
+	}
+
+	if db.Persistence != nil && !db.snapshotting && time.Since(db.lastSnapshot) >= db.SnapshotInterval {
+		db.startSnapshot()
+	}
+	return true, nil
+}
+
+// startSnapshot rotates the log and writes a copy of the database to a snapshot in the background, mu has to be held.
+// Copying the shards is much cheaper than writing them out, writes only wait for the copy.
+func (db *DB) startSnapshot() {
+	db.lastSnapshot = time.Now()
+	generation, err := db.Persistence.Rotate()
+	if err != nil {
+		db.Logger.Println("Failed to rotate the write-ahead log: ", err)
+		return
+	}
+	shards := make([]map[string]Entry, 0, SHARD_COUNT)
+	for i := range db.shards {
+		shards = append(shards, maps.Clone(db.shards[i].entries))
+	}
+
+	db.snapshotting = true
+	db.snapshots.Add(1)
+	go func() {
+		defer db.snapshots.Done()
+		if err := db.Persistence.WriteSnapshot(generation, shards...); err != nil {
+			db.Logger.Println("Failed to write snapshot: ", err)
+		}
+		db.mu.Lock()
+		db.snapshotting = false
+		db.mu.Unlock()
+	}()
+}
+
+func (db *DB) Keys(prefix string) []string {
+	now := time.Now()
+	keys := make([]string, 0)
+	for i := range db.shards {
+		shard := &db.shards[i]
+		shard.mu.RLock()
+		for key, entry := range shard.entries {
+			if !entry.Deleted && strings.HasPrefix(key, prefix) && !db.Policy.expired(key, entry, now) {
+				keys = append(keys, key)
+			}
+		}
+		shard.mu.RUnlock()
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ExpireKeys drops every key that outlived its TTL, keys are also dropped when they are read after expiring.
+// Tombstones expire too, the writes they shadow are older so they expired as well.
+func (db *DB) ExpireKeys() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := time.Now()
+	for i := range db.shards {
+		shard := &db.shards[i]
+		shard.mu.Lock()
+		for key, entry := range shard.entries {
+			if db.Policy.expired(key, entry, now) {
+				if !entry.Deleted {
+					db.usage.expirations++
+				}
+				delete(shard.entries, key)
+				db.usage.remove(key)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// RunJanitor calls ExpireKeys every interval, it never returns.
+func (db *DB) RunJanitor(interval time.Duration) {
+	for range time.Tick(interval) {
+		db.ExpireKeys()
+	}
+}
+
+// EnforcePolicy evicts keys until the database is within the limits of the policy, e.g after the policy changed.
+func (db *DB) EnforcePolicy() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.enforcePolicy()
+}
+
+func (db *DB) enforcePolicy() {
+	for {
+		key, ok := db.usage.victim(db.Policy)
+		if !ok {
+			return
+		}
+		db.Logger.Println("EVICT: ", key)
+		db.remove(key)
+		db.usage.evictions++
+	}
+}
+
+// set stores entry in the shard of key, mu has to be held.
+func (db *DB) set(key string, entry Entry) {
+	shard := db.shard(key)
+	shard.mu.Lock()
+	shard.entries[key] = entry
+	shard.mu.Unlock()
+}
+
+// remove drops key from this node only, unlike Delete it leaves no tombstone and isn't replicated. mu has to be held.
+func (db *DB) remove(key string) {
+	shard := db.shard(key)
+	shard.mu.Lock()
+	delete(shard.entries, key)
+	shard.mu.Unlock()
+	db.usage.remove(key)
+}
+
+// stats is the value of the read-only "stats" key.
+func (db *DB) stats() string {
+	return fmt.Sprintf("keys=%d bytes=%d evictions=%d expired=%d",
+		len(db.usage.elements), db.usage.bytes, db.usage.evictions, db.usage.expirations)
+}
+
+// Entries calls fn with every write in the database, tombstones included, fn must not call back into the DB.
+func (db *DB) Entries(fn func(key string, entry Entry)) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for i := range db.shards {
+		for key, entry := range db.shards[i].entries {
+			fn(key, entry)
+		}
+	}
+}
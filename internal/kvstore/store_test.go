@@ -0,0 +1,172 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDeleteLeavesTombstone(t *testing.T) {
+	db := New("a")
+	wall := int64(1000)
+	db.Clock.WallTime = func() int64 { return wall }
+
+	db.Set("key", "value")
+	older := Entry{Value: "stale", Timestamp: Timestamp{Wall: 500, Node: "b"}}
+	if err := db.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.Get("key"); ok {
+		t.Fatal("key is still set after Delete")
+	}
+
+	// A write older than the delete, replicated late, must not bring the key back.
+	db.Merge("key", older)
+	if _, ok := db.Get("key"); ok {
+		t.Error("an older write resurrected a deleted key")
+	}
+
+	db.Merge("key", Entry{Value: "newer", Timestamp: Timestamp{Wall: 5000, Node: "b"}})
+	if value, _ := db.Get("key"); value != "newer" {
+		t.Errorf("key = %q after a newer write, want newer", value)
+	}
+	if stats, _ := db.Get(STATS_KEY); stats != "keys=1 bytes=8 evictions=0 expired=0" {
+		t.Errorf("stats = %q", stats)
+	}
+}
+
+func TestReadOnlyKeys(t *testing.T) {
+	db := New("a")
+	db.SetReadOnly("version", "1.0")
+
+	for _, key := range []string{"version", STATS_KEY} {
+		if err := db.Set(key, "x"); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("Set(%s) = %v, want ErrReadOnly", key, err)
+		}
+		if err := db.Delete(key); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("Delete(%s) = %v, want ErrReadOnly", key, err)
+		}
+	}
+	db.Merge("version", Entry{Value: "2.0", Timestamp: db.Clock.Now()})
+	if value, _ := db.Get("version"); value != "1.0" {
+		t.Errorf("version = %q, want 1.0", value)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	db := New("a")
+	db.SetReadOnly("version", "1.0")
+	for _, key := range []string{"users/bob", "users/alice", "other", "users/gone"} {
+		db.Set(key, "1")
+	}
+	db.Delete("users/gone")
+
+	if keys := db.Keys("users/"); !slices.Equal(keys, []string{"users/alice", "users/bob"}) {
+		t.Errorf("Keys(users/) = %v", keys)
+	}
+	if keys := db.Keys(""); len(keys) != 3 {
+		t.Errorf("Keys() = %v, want 3 keys", keys)
+	}
+}
+
+func TestOpenRecoversTombstones(t *testing.T) {
+	dir := t.TempDir()
+	db := New("a")
+	if err := db.Open(dir, false); err != nil {
+		t.Fatal(err)
+	}
+	db.Set("kept", "1")
+	db.Set("deleted", "2")
+	db.Delete("deleted")
+	db.Close()
+
+	db = New("a")
+	db.SetReadOnly("version", "1.0")
+	if err := db.Open(dir, false); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := db.Get("kept"); value != "1" {
+		t.Errorf("kept = %q, want 1", value)
+	}
+	if _, ok := db.Get("deleted"); ok {
+		t.Error("deleted came back after recovery")
+	}
+}
+
+func TestSnapshotsWhileWriting(t *testing.T) {
+	dir := t.TempDir()
+	db := New("a")
+	db.Logger = log.New(io.Discard, "", 0)
+	db.SnapshotInterval = 0
+	if err := db.Open(dir, false); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 200 {
+		if err := db.Set(fmt.Sprint("key", i), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	if rotated, _ := rotatedLogs(dir); len(rotated) != 0 {
+		t.Errorf("rotated logs %v were left behind by finished snapshots", rotated)
+	}
+	db = New("a")
+	db.Logger = log.New(io.Discard, "", 0)
+	if err := db.Open(dir, false); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 200 {
+		if value, _ := db.Get(fmt.Sprint("key", i)); value != fmt.Sprint(i) {
+			t.Fatalf("key%d = %q after recovery, want %d", i, value, i)
+		}
+	}
+}
+
+func TestClockNeverGoesBackwards(t *testing.T) {
+	clock := NewClock("a")
+	wall := int64(100)
+	clock.WallTime = func() int64 { return wall }
+
+	first := clock.Now()
+	wall = 50
+	second := clock.Now()
+	if !first.Less(second) {
+		t.Errorf("%s is not after %s", second, first)
+	}
+
+	clock.Observe(Timestamp{Wall: 500, Logical: 3, Node: "b"})
+	third := clock.Now()
+	if !(Timestamp{Wall: 500, Logical: 3, Node: "b"}).Less(third) {
+		t.Errorf("%s is not after the observed timestamp", third)
+	}
+}
+
+func BenchmarkDBParallel(b *testing.B) {
+	for _, reads := range []int{50, 90, 99} {
+		b.Run(fmt.Sprintf("reads=%d%%", reads), func(b *testing.B) {
+			db := New("bench")
+			db.Logger = log.New(io.Discard, "", 0)
+			for i := 0; i < 1024; i++ {
+				db.Set(fmt.Sprintf("key%d", i), "value")
+			}
+
+			var next atomic.Uint64
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := next.Add(1)
+					key := fmt.Sprintf("key%d", i%1024)
+					if i%100 < uint64(reads) {
+						db.Get(key)
+					} else {
+						db.Set(key, "value")
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,354 @@
+package kvstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	WAL_FILE      = "wal.log"
+	SNAPSHOT_FILE = "snapshot.db"
+
+	OP_PUT    byte = 2
+	OP_DELETE byte = 3
+
+	// RECORD_HEADER_SIZE is the crc32 of the payload followed by the payload length, both big endian uint32.
+	RECORD_HEADER_SIZE = 8
+	MAX_RECORD_SIZE    = 1 << 20
+)
+
+var (
+	ErrCorruptRecord = errors.New("corrupt record")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Persistence keeps the database on disk as a snapshot and a write-ahead log of the writes since the snapshot.
+// Every record in both files is | crc32 | length | payload |, the payload of an OP_PUT is
+// | op | wall (int64) | logical (uint32) | node length (uvarint) | node | key length (uvarint) | key | value |.
+// An OP_DELETE is the tombstone of a key, its payload is the same without the value.
+//
+// A snapshot is taken in two steps so the database doesn't have to be locked while it is written: Rotate moves
+// the log aside to WAL_FILE.<generation> and WriteSnapshot writes a copy of the database taken at the rotation
+// and removes the rotated logs it covers.
+type Persistence struct {
+	Dir string
+	// Sync flushes the log to stable storage after every insert.
+	Sync bool
+
+	wal         *os.File
+	records     int
+	generations int
+}
+
+// OpenPersistence accepts a data directory, it recovers the database stored in it and opens the log for appending.
+// A record cut short at the end of the log, e.g by a crash in the middle of a write, is dropped and reported to logger.
+func OpenPersistence(dir string, logger *log.Logger) (*Persistence, map[string]Entry, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, err
+	}
+
+	db := make(map[string]Entry)
+	if _, err := readRecordFile(filepath.Join(dir, SNAPSHOT_FILE), db); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, fmt.Errorf("reading snapshot: %w", err)
+	}
+
+	// Rotated logs are left behind when we stopped before their snapshot was written.
+	generations, err := rotatedLogs(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, generation := range generations {
+		path := rotatedLogPath(dir, generation)
+		if records, err := readRecordFile(path, db); err != nil {
+			logger.Printf("Dropping the rest of %s after %d records: %s", path, records.count, err)
+		}
+	}
+
+	walPath := filepath.Join(dir, WAL_FILE)
+	records, err := readRecordFile(walPath, db)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case errors.Is(err, ErrCorruptRecord) || errors.Is(err, io.ErrUnexpectedEOF):
+		logger.Printf("Dropping the torn tail of the write-ahead log after %d records", records.count)
+		if err := os.Truncate(walPath, records.offset); err != nil {
+			return nil, nil, err
+		}
+	case err != nil:
+		return nil, nil, fmt.Errorf("reading write-ahead log: %w", err)
+	}
+
+	wal, err := os.OpenFile(walPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p := &Persistence{Dir: dir, wal: wal, records: records.count}
+	if len(generations) > 0 {
+		p.generations = generations[len(generations)-1]
+	}
+	return p, db, nil
+}
+
+// LogInsert appends a write to the write-ahead log, it has to be called before the write is applied.
+func (p *Persistence) LogInsert(key string, entry Entry) error {
+	if _, err := p.wal.Write(EncodeRecord(key, entry)); err != nil {
+		return err
+	}
+	p.records++
+
+	if p.Sync {
+		return p.wal.Sync()
+	}
+	return nil
+}
+
+// Pending returns the number of records in the log that are not part of the snapshot yet.
+func (p *Persistence) Pending() int {
+	return p.records
+}
+
+// Rotate moves the log aside and starts an empty one, it returns the generation of the rotated log.
+// Like LogInsert it has to be called with the writes stopped, the database at that point is what the snapshot has to hold.
+func (p *Persistence) Rotate() (int, error) {
+	walPath := filepath.Join(p.Dir, WAL_FILE)
+	rotatedPath := rotatedLogPath(p.Dir, p.generations+1)
+	if err := os.Rename(walPath, rotatedPath); err != nil {
+		return 0, err
+	}
+	wal, err := os.OpenFile(walPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return 0, errors.Join(err, os.Rename(rotatedPath, walPath))
+	}
+
+	p.wal.Close()
+	p.wal = wal
+	p.records = 0
+	p.generations++
+	return p.generations, nil
+}
+
+// WriteSnapshot writes the database as it was when the log of generation was rotated, which may be split over several maps,
+// to a new snapshot and removes the logs it covers. It may run alongside LogInsert and Rotate but not another WriteSnapshot.
+// The snapshot replaces the old one atomically, if we crash before the logs are removed their records are replayed on top of it.
+func (p *Persistence) WriteSnapshot(generation int, maps ...map[string]Entry) error {
+	tmpPath := filepath.Join(p.Dir, SNAPSHOT_FILE+".tmp")
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	writer := bufio.NewWriter(tmp)
+	for _, db := range maps {
+		for key, entry := range db {
+			if _, err := writer.Write(EncodeRecord(key, entry)); err != nil {
+				tmp.Close()
+				return err
+			}
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, filepath.Join(p.Dir, SNAPSHOT_FILE)); err != nil {
+		return err
+	}
+
+	generations, err := rotatedLogs(p.Dir)
+	if err != nil {
+		return err
+	}
+	for _, rotated := range generations {
+		if rotated > generation {
+			break
+		}
+		if err := os.Remove(rotatedLogPath(p.Dir, rotated)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshot rotates the log and writes the whole database to a new snapshot, the writes have to be stopped until it returns.
+func (p *Persistence) Snapshot(maps ...map[string]Entry) error {
+	generation, err := p.Rotate()
+	if err != nil {
+		return err
+	}
+	return p.WriteSnapshot(generation, maps...)
+}
+
+func (p *Persistence) Close() error {
+	return p.wal.Close()
+}
+
+func rotatedLogPath(dir string, generation int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s.%d", WAL_FILE, generation))
+}
+
+// rotatedLogs returns the generations of the rotated logs in dir, oldest first.
+func rotatedLogs(dir string) ([]int, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, WAL_FILE+".*"))
+	if err != nil {
+		return nil, err
+	}
+	generations := make([]int, 0, len(paths))
+	for _, path := range paths {
+		generation, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(path), WAL_FILE+"."))
+		if err == nil && generation > 0 {
+			generations = append(generations, generation)
+		}
+	}
+	slices.Sort(generations)
+	return generations, nil
+}
+
+// EncodeRecord returns the record of a write, as it is stored on disk and sent to replicas.
+func EncodeRecord(key string, entry Entry) []byte {
+	ts := entry.Timestamp
+	op := OP_PUT
+	if entry.Deleted {
+		op = OP_DELETE
+	}
+	payload := make([]byte, 0, 1+8+4+2*binary.MaxVarintLen64+len(ts.Node)+len(key)+len(entry.Value))
+	payload = append(payload, op)
+	payload = binary.BigEndian.AppendUint64(payload, uint64(ts.Wall))
+	payload = binary.BigEndian.AppendUint32(payload, ts.Logical)
+	payload = binary.AppendUvarint(payload, uint64(len(ts.Node)))
+	payload = append(payload, ts.Node...)
+	payload = binary.AppendUvarint(payload, uint64(len(key)))
+	payload = append(payload, key...)
+	if !entry.Deleted {
+		payload = append(payload, entry.Value...)
+	}
+
+	record := make([]byte, RECORD_HEADER_SIZE, RECORD_HEADER_SIZE+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], crc32.Checksum(payload, crcTable))
+	binary.BigEndian.PutUint32(record[4:8], uint32(len(payload)))
+	return append(record, payload...)
+}
+
+// recordsRead is how far readRecords got, offset is the end of the last valid record.
+type recordsRead struct {
+	count  int
+	offset int64
+}
+
+// readRecordFile applies every record of the file at path to db, a record never replaces a newer entry of the same key.
+func readRecordFile(path string, db map[string]Entry) (recordsRead, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return recordsRead{}, err
+	}
+	defer file.Close()
+
+	return readRecords(bufio.NewReader(file), func(key string, entry Entry) {
+		if current, ok := db[key]; !ok || !entry.Timestamp.Less(current.Timestamp) {
+			db[key] = entry
+		}
+	})
+}
+
+// ReadRecords calls apply with every record read from reader until EOF, it stops at the first record that is incomplete or corrupt.
+func ReadRecords(reader io.Reader, apply func(key string, entry Entry)) error {
+	_, err := readRecords(reader, apply)
+	return err
+}
+
+// readRecords calls apply with every record read from reader until EOF.
+// It stops at the first record that is incomplete or fails its checksum and returns how far it got.
+func readRecords(reader io.Reader, apply func(key string, entry Entry)) (recordsRead, error) {
+	var read recordsRead
+
+	header := make([]byte, RECORD_HEADER_SIZE)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return read, nil
+			}
+			return read, err
+		}
+
+		checksum := binary.BigEndian.Uint32(header[0:4])
+		length := binary.BigEndian.Uint32(header[4:8])
+		if length > MAX_RECORD_SIZE {
+			return read, ErrCorruptRecord
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			if err == io.EOF {
+				return read, io.ErrUnexpectedEOF
+			}
+			return read, err
+		}
+		if crc32.Checksum(payload, crcTable) != checksum {
+			return read, ErrCorruptRecord
+		}
+
+		key, entry, err := decodeRecord(payload)
+		if err != nil {
+			return read, err
+		}
+		apply(key, entry)
+		read.count++
+		read.offset += int64(RECORD_HEADER_SIZE + length)
+	}
+}
+
+func decodeRecord(payload []byte) (string, Entry, error) {
+	var entry Entry
+	if len(payload) == 0 {
+		return "", entry, ErrCorruptRecord
+	}
+
+	op, payload := payload[0], payload[1:]
+	if op != OP_PUT && op != OP_DELETE || len(payload) < 12 {
+		return "", entry, ErrCorruptRecord
+	}
+	entry.Deleted = op == OP_DELETE
+	entry.Timestamp.Wall = int64(binary.BigEndian.Uint64(payload[0:8]))
+	entry.Timestamp.Logical = binary.BigEndian.Uint32(payload[8:12])
+	node, payload, ok := readString(payload[12:])
+	if !ok {
+		return "", entry, ErrCorruptRecord
+	}
+	entry.Timestamp.Node = node
+
+	key, value, ok := readString(payload)
+	if !ok || entry.Deleted && len(value) > 0 {
+		return "", entry, ErrCorruptRecord
+	}
+	entry.Value = string(value)
+	return key, entry, nil
+}
+
+// readString reads a uvarint length prefixed string from buf and returns it with the rest of buf.
+func readString(buf []byte) (string, []byte, bool) {
+	length, n := binary.Uvarint(buf)
+	if n <= 0 || length > uint64(len(buf)-n) {
+		return "", nil, false
+	}
+	end := n + int(length)
+	return string(buf[n:end]), buf[end:], true
+}
@@ -0,0 +1,149 @@
+package kvstore
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPersistenceRecovery(t *testing.T) {
+	dir := t.TempDir()
+
+	p, db, err := OpenPersistence(dir, log.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := NewClock("test")
+	insert := func(key, value string) {
+		t.Helper()
+		entry := Entry{Value: value, Timestamp: clock.Now()}
+		if err := p.LogInsert(key, entry); err != nil {
+			t.Fatal(err)
+		}
+		db[key] = entry
+	}
+
+	insert("foo", "1")
+	insert("bar", "a=b")
+	if err := p.Snapshot(db); err != nil {
+		t.Fatal(err)
+	}
+	insert("foo", "2")
+	insert("empty", "")
+	insert("gone", "soon")
+	deleted := Entry{Timestamp: clock.Now(), Deleted: true}
+	if err := p.LogInsert("gone", deleted); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+
+	_, recovered, err := OpenPersistence(dir, log.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"foo": "2", "bar": "a=b", "empty": "", "gone": ""}
+	if len(recovered) != len(want) {
+		t.Fatalf("recovered %v, want %v", recovered, want)
+	}
+	if recovered["gone"] != deleted {
+		t.Errorf("recovered %+v for gone, want the tombstone %+v", recovered["gone"], deleted)
+	}
+	for key, value := range want {
+		if recovered[key].Value != value {
+			t.Errorf("recovered %s=%q, want %q", key, recovered[key].Value, value)
+		}
+	}
+}
+
+func TestPersistenceTornTail(t *testing.T) {
+	dir := t.TempDir()
+
+	p, _, err := OpenPersistence(dir, log.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.LogInsert("a", Entry{Value: "1"})
+	p.LogInsert("b", Entry{Value: "2"})
+	p.Close()
+
+	walPath := filepath.Join(dir, WAL_FILE)
+	info, err := os.Stat(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cut the last record in half as if we crashed while writing it.
+	if err := os.Truncate(walPath, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	p, db, err := OpenPersistence(dir, log.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db["a"].Value != "1" || len(db) != 1 {
+		t.Fatalf("recovered %v, want only a=1", db)
+	}
+
+	// The torn record is gone, so new records are readable after it.
+	p.LogInsert("c", Entry{Value: "3"})
+	p.Close()
+	_, db, err = OpenPersistence(dir, log.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db["a"].Value != "1" || db["c"].Value != "3" || len(db) != 2 {
+		t.Fatalf("recovered %v, want a=1 and c=3", db)
+	}
+}
+
+func TestPersistenceRecoversRotatedLogs(t *testing.T) {
+	dir := t.TempDir()
+
+	p, _, err := OpenPersistence(dir, log.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := NewClock("test")
+	p.LogInsert("a", Entry{Value: "1", Timestamp: clock.Now()})
+	generation, err := p.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.LogInsert("b", Entry{Value: "2", Timestamp: clock.Now()})
+	// We stop before the snapshot of the rotated log is written.
+	p.Close()
+
+	p, db, err := OpenPersistence(dir, log.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db["a"].Value != "1" || db["b"].Value != "2" || len(db) != 2 {
+		t.Fatalf("recovered %v, want a=1 and b=2", db)
+	}
+
+	// The next rotation doesn't reuse the generation of the log that is still around.
+	next, err := p.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next <= generation {
+		t.Fatalf("rotated generation %d after %d", next, generation)
+	}
+	if err := p.WriteSnapshot(next, db); err != nil {
+		t.Fatal(err)
+	}
+	if rotated, _ := rotatedLogs(dir); len(rotated) != 0 {
+		t.Errorf("rotated logs %v are covered by the snapshot", rotated)
+	}
+	p.Close()
+
+	_, db, err = OpenPersistence(dir, log.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db["a"].Value != "1" || db["b"].Value != "2" || len(db) != 2 {
+		t.Fatalf("recovered %v from the snapshot, want a=1 and b=2", db)
+	}
+}
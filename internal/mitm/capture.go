@@ -0,0 +1,120 @@
+package mitm
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event kinds of a capture.
+const (
+	EVENT_OPEN  = "open"
+	EVENT_DATA  = "data"
+	EVENT_EOF   = "eof"
+	EVENT_CLOSE = "close"
+)
+
+// Event is a line of a capture file. Data holds the bytes as they were read from the side the direction starts at,
+// Rewritten the bytes that were relayed instead when a rule changed them. Both are base64 in the JSON.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Session   uint64    `json:"session"`
+	Kind      string    `json:"kind"`
+	Direction Direction `json:"direction,omitempty"`
+	Client    string    `json:"client,omitempty"`
+	Data      []byte    `json:"data,omitempty"`
+	Rewritten []byte    `json:"rewritten,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Recorder writes the events of every proxied session to a JSON-lines capture, it is safe for concurrent use.
+// Every event is flushed as it is recorded so a capture survives the proxy being killed.
+type Recorder struct {
+	mu          sync.Mutex
+	out         io.Writer
+	writer      *bufio.Writer
+	nextSession atomic.Uint64
+	err         error
+}
+
+func NewRecorder(out io.Writer) *Recorder {
+	return &Recorder{out: out, writer: bufio.NewWriter(out)}
+}
+
+// CreateRecorder appends the capture to the file at path, creating it if needed.
+func CreateRecorder(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return NewRecorder(file), nil
+}
+
+// NewSession returns the id of a new session and records that client opened it.
+// Ids start at the current time in nanoseconds so sessions appended to an existing capture don't collide.
+func (r *Recorder) NewSession(client string) uint64 {
+	r.nextSession.CompareAndSwap(0, uint64(time.Now().UnixNano()))
+	id := r.nextSession.Add(1)
+	r.Record(Event{Session: id, Kind: EVENT_OPEN, Client: client})
+	return id
+}
+
+// Record writes e, setting its time when it is zero. The first write error is kept and returned by Close.
+func (r *Recorder) Record(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	line = append(line, '\n')
+	if _, err := r.writer.Write(line); err != nil {
+		r.err = err
+		return
+	}
+	r.err = r.writer.Flush()
+}
+
+// Close closes the underlying file, if it is one, and returns the first error the recorder hit.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if closer, ok := r.out.(io.Closer); ok {
+		if err := closer.Close(); err != nil && r.err == nil {
+			r.err = err
+		}
+	}
+	return r.err
+}
+
+// ReadCapture calls fn with every event of a capture in order, it stops at the first error fn returns.
+func ReadCapture(input io.Reader, fn func(Event) error) error {
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,134 @@
+package mitm
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startUpperServer answers every line with the line in upper case and closes when the client stops writing.
+func startUpperServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					io.WriteString(conn, strings.ToUpper(line))
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	upstream := startUpperServer(t)
+	capturePath := filepath.Join(t.TempDir(), "capture.jsonl")
+	recorder, err := CreateRecorder(capturePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recorder.Close()
+	addr := startProxy(t, &Proxy{
+		Dial:     func() (net.Conn, error) { return net.Dial("tcp", upstream) },
+		Rules:    boguscoinRules(t),
+		Recorder: recorder,
+	})
+
+	client := dialClient(t, addr)
+	client.send("hello\n")
+	client.expect("HELLO\n")
+	client.send("pay " + TEST_COIN + "\n")
+	// The upper cased address is a Boguscoin too, so it is rewritten on the way back as well.
+	client.expect("PAY " + TEST_TONY + "\n")
+	client.conn.CloseWrite()
+	client.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	io.ReadAll(client.reader)
+
+	// The session is recorded once the proxy saw both sides close.
+	var events []Event
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		events = events[:0]
+		capture, err := os.ReadFile(capturePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ReadCapture(bytes.NewReader(capture), func(e Event) error {
+			events = append(events, e)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) > 0 && events[len(events)-1].Kind == EVENT_CLOSE {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("session was not closed, recorded %d events", len(events))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	got := make([]string, 0)
+	for _, e := range events {
+		got = append(got, fmt.Sprintf("%s %s %q %q", e.Kind, e.Direction, e.Data, e.Rewritten))
+	}
+	want := []string{
+		`open  "" ""`,
+		`data c2s "hello\n" ""`,
+		`data s2c "HELLO\n" ""`,
+		fmt.Sprintf(`data c2s "pay %s\n" "pay %s\n"`, TEST_COIN, TEST_TONY),
+		fmt.Sprintf(`data s2c "PAY %s\n" "PAY %s\n"`, strings.ToUpper(TEST_TONY), TEST_TONY),
+		`eof c2s "" ""`,
+		`eof s2c "" ""`,
+		`close  "" ""`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("recorded\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Replaying sends what the client sent, not what the proxy rewrote it to.
+	var (
+		mu     sync.Mutex
+		output bytes.Buffer
+	)
+	replayer := &Replayer{
+		Dial: func() (net.Conn, error) { return net.Dial("tcp", upstream) },
+		Wait: time.Second,
+		Output: func(session uint64, data []byte) {
+			mu.Lock()
+			output.Write(data)
+			mu.Unlock()
+		},
+	}
+	if err := replayer.Replay(events); err != nil {
+		t.Fatal(err)
+	}
+	if want := "HELLO\nPAY " + strings.ToUpper(TEST_COIN) + "\n"; output.String() != want {
+		t.Errorf("replay received %q, want %q", output.String(), want)
+	}
+}
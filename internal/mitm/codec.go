@@ -0,0 +1,47 @@
+package mitm
+
+import (
+	"bufio"
+	"bytes"
+)
+
+// Codec frames the stream of one direction into messages and rewrites them.
+//
+// Framing only decides what is rewritten as a unit, every byte that is read is relayed,
+// so a message the codec can't make sense of is relayed as it is.
+type Codec interface {
+	// ReadMessage returns the next message of reader. At the end of the stream it returns the bytes of
+	// a message that was cut short, which may be empty, with the error of the reader.
+	ReadMessage(reader *bufio.Reader) ([]byte, error)
+	// Rewrite returns msg as it should be relayed in direction, it returns msg itself when nothing changed.
+	Rewrite(direction Direction, msg []byte) []byte
+	// EncodeError returns the message that tells a client msg in the codec's protocol.
+	EncodeError(msg string) []byte
+}
+
+// LineCodec frames newline separated text and rewrites every line with Rules.
+type LineCodec struct {
+	Rules Rules
+}
+
+func (c LineCodec) ReadMessage(reader *bufio.Reader) ([]byte, error) {
+	return reader.ReadBytes('\n')
+}
+
+// Rewrite rewrites the line without its newline, so a last line without one is rewritten too.
+func (c LineCodec) Rewrite(direction Direction, msg []byte) []byte {
+	line, terminated := bytes.CutSuffix(msg, []byte("\n"))
+	rewritten := c.Rules.Rewrite(direction, string(line))
+	if rewritten == string(line) {
+		return msg
+	}
+	if terminated {
+		rewritten += "\n"
+	}
+	return []byte(rewritten)
+}
+
+// EncodeError returns msg as a line.
+func (c LineCodec) EncodeError(msg string) []byte {
+	return []byte(msg + "\n")
+}
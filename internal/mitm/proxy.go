@@ -0,0 +1,179 @@
+// Package mitm is a man in the middle for TCP protocols, it relays every client to an upstream server
+// and rewrites the messages travelling in either direction, newline separated lines unless a Codec frames them.
+package mitm
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// UNAVAILABLE is sent to a client the proxy couldn't find an upstream for, before it is closed.
+	UNAVAILABLE = "* The server is not available right now, please try again later"
+	// DEFAULT_LINGER is how long a half closed session waits for the side that is left to send something.
+	DEFAULT_LINGER = 10 * time.Second
+)
+
+// Proxy relays messages between its clients and an upstream server, rewriting them with its Codec.
+type Proxy struct {
+	// Dial connects to the upstream server, it is called once for every client.
+	Dial func() (net.Conn, error)
+	// Codec frames and rewrites the messages, nil relays newline separated lines rewritten with Rules.
+	Codec Codec
+	Rules Rules
+	// Recorder captures both directions of every session, nil records nothing.
+	Recorder *Recorder
+	// Linger is how long a side may stay silent once the other side closed its writing half,
+	// 0 means DEFAULT_LINGER.
+	Linger time.Duration
+}
+
+// Serve accepts clients on ln until it is closed.
+func (p *Proxy) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Println("Error accepting connection: ", err)
+			continue
+		}
+		go p.Handle(conn)
+	}
+}
+
+// Handle relays a single client until the session is over, it closes client before returning.
+//
+// When one side closes its writing half the other side's writing half is closed too, once the messages still
+// in flight were relayed, and the session is over when both directions are done. The direction left open
+// only lingers while it keeps sending, a side that stays silent for Linger after the other one left ends the session.
+// A connection that breaks ends the session in both directions.
+func (p *Proxy) Handle(client net.Conn) {
+	defer client.Close()
+
+	var session uint64
+	if p.Recorder != nil {
+		session = p.Recorder.NewSession(client.RemoteAddr().String())
+	}
+
+	upstream, err := p.Dial()
+	if err != nil {
+		log.Printf("Failed to connect %s upstream: %s", client.RemoteAddr().String(), err)
+		client.Write(p.codec().EncodeError(UNAVAILABLE))
+		p.record(Event{Session: session, Kind: EVENT_CLOSE, Error: err.Error()})
+		return
+	}
+	defer upstream.Close()
+
+	var lingering atomic.Bool
+	done := make(chan relayResult, 2)
+	go func() {
+		done <- relayResult{CLIENT_TO_SERVER, p.relay(session, client, upstream, CLIENT_TO_SERVER, &lingering)}
+	}()
+	go func() {
+		done <- relayResult{SERVER_TO_CLIENT, p.relay(session, upstream, client, SERVER_TO_CLIENT, &lingering)}
+	}()
+
+	first := <-done
+	if first.err == nil {
+		// The side that is left can still answer, the side that left still reads.
+		remaining := upstream
+		if first.direction == CLIENT_TO_SERVER {
+			first.err = closeWrite(upstream)
+		} else {
+			remaining = client
+			first.err = closeWrite(client)
+		}
+		lingering.Store(true)
+		remaining.SetReadDeadline(time.Now().Add(p.linger()))
+	}
+	if first.err != nil {
+		client.Close()
+		upstream.Close()
+	}
+	second := <-done
+
+	for _, result := range []relayResult{first, second} {
+		if result.err != nil {
+			log.Printf("Session of %s ended: %s", client.RemoteAddr().String(), result.err)
+			p.record(Event{Session: session, Kind: EVENT_CLOSE, Error: result.err.Error()})
+			return
+		}
+	}
+	p.record(Event{Session: session, Kind: EVENT_CLOSE})
+}
+
+type relayResult struct {
+	direction Direction
+	err       error
+}
+
+func (p *Proxy) record(e Event) {
+	if p.Recorder != nil {
+		p.Recorder.Record(e)
+	}
+}
+
+func (p *Proxy) linger() time.Duration {
+	if p.Linger == 0 {
+		return DEFAULT_LINGER
+	}
+	return p.Linger
+}
+
+func (p *Proxy) codec() Codec {
+	if p.Codec == nil {
+		return LineCodec{Rules: p.Rules}
+	}
+	return p.Codec
+}
+
+// relay copies messages from src to dst until src reaches EOF, which it reports as nil.
+// A last message that was cut short is handed to the codec to rewrite as well.
+// Once the session is lingering every message gives src another Linger to send the next one.
+func (p *Proxy) relay(session uint64, src, dst net.Conn, direction Direction, lingering *atomic.Bool) error {
+	codec := p.codec()
+	reader := bufio.NewReader(src)
+	for {
+		msg, err := codec.ReadMessage(reader)
+		if len(msg) > 0 {
+			log.Printf("[%s] Message Received: %q", direction, msg)
+			rewritten := codec.Rewrite(direction, msg)
+
+			e := Event{Session: session, Kind: EVENT_DATA, Direction: direction, Data: msg}
+			if !bytes.Equal(rewritten, msg) {
+				e.Rewritten = rewritten
+			}
+			p.record(e)
+			if _, err := dst.Write(rewritten); err != nil {
+				return err
+			}
+			if lingering.Load() {
+				src.SetReadDeadline(time.Now().Add(p.linger()))
+			}
+		}
+
+		switch {
+		case err == io.EOF:
+			p.record(Event{Session: session, Kind: EVENT_EOF, Direction: direction})
+			return nil
+		case err != nil:
+			return err
+		}
+	}
+}
+
+// closeWrite shuts down the writing half of conn, connections that can't be half closed are closed.
+func closeWrite(conn net.Conn) error {
+	if halfCloser, ok := conn.(interface{ CloseWrite() error }); ok {
+		return halfCloser.CloseWrite()
+	}
+	return conn.Close()
+}
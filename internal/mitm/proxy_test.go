@@ -0,0 +1,315 @@
+package mitm
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	TEST_COIN = "7F1u3wSD5RbOHQmupo9nx4TnhQ"
+	TEST_TONY = "7YWHMfk9JZe0LM0g1ZauHuiSxhI"
+)
+
+// fakeChat is a budgetchat server that is just enough for the proxy: it asks for a name and
+// relays every line to the other members as "[name] line".
+type fakeChat struct {
+	ln      net.Listener
+	mu      sync.Mutex
+	members map[net.Conn]string
+}
+
+func startFakeChat(t *testing.T) *fakeChat {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	chat := &fakeChat{ln: ln, members: make(map[net.Conn]string)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go chat.handle(conn)
+		}
+	}()
+	return chat
+}
+
+func (chat *fakeChat) handle(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintln(conn, "Welcome to budgetchat! What shall I call you?")
+
+	reader := bufio.NewReader(conn)
+	name, err := reader.ReadString('\n')
+	if err != nil {
+		return
+	}
+	name = strings.TrimSuffix(name, "\n")
+	chat.mu.Lock()
+	fmt.Fprintf(conn, "* The room contains: %d others\n", len(chat.members))
+	chat.members[conn] = name
+	chat.mu.Unlock()
+	defer func() {
+		chat.mu.Lock()
+		delete(chat.members, conn)
+		chat.mu.Unlock()
+	}()
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		chat.mu.Lock()
+		for member := range chat.members {
+			if member != conn {
+				fmt.Fprintf(member, "[%s] %s", name, line)
+			}
+		}
+		chat.mu.Unlock()
+	}
+}
+
+func (chat *fakeChat) dial() (net.Conn, error) {
+	return net.Dial("tcp", chat.ln.Addr().String())
+}
+
+func boguscoinRules(t *testing.T) Rules {
+	t.Helper()
+	rule := &Rule{Name: "boguscoin", Token: "7[a-zA-Z0-9]{25,34}", Replace: TEST_TONY}
+	if err := rule.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	return Rules{rule}
+}
+
+// startProxy serves a proxy on a loopback port and returns its address.
+func startProxy(t *testing.T, proxy *Proxy) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go proxy.Serve(ln)
+	return ln.Addr().String()
+}
+
+type testClient struct {
+	t      *testing.T
+	conn   *net.TCPConn
+	reader *bufio.Reader
+}
+
+func dialClient(t *testing.T, addr string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn.(*net.TCPConn), reader: bufio.NewReader(conn)}
+}
+
+func (c *testClient) send(line string) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.conn, line); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) expect(want string) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("reading %q: %s", want, err)
+	}
+	if line != want {
+		c.t.Fatalf("got %q, want %q", line, want)
+	}
+}
+
+// join answers the name prompt and waits for the room listing.
+func (c *testClient) join(name string) {
+	c.t.Helper()
+	c.expect("Welcome to budgetchat! What shall I call you?\n")
+	c.send(name + "\n")
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.reader.ReadString('\n'); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func TestProxyRewritesBothDirections(t *testing.T) {
+	chat := startFakeChat(t)
+	addr := startProxy(t, &Proxy{Dial: chat.dial, Rules: boguscoinRules(t)})
+
+	victim := dialClient(t, addr)
+	victim.join("victim")
+	direct := dialClient(t, chat.ln.Addr().String())
+	direct.join("direct")
+
+	victim.send("send to " + TEST_COIN + " please\n")
+	direct.expect("[victim] send to " + TEST_TONY + " please\n")
+
+	direct.send(TEST_COIN + "\n")
+	victim.expect("[direct] " + TEST_TONY + "\n")
+}
+
+// TestProxyClosesWhenClientLeaves checks that a last line without a newline is relayed without one,
+// and that the upstream's writing half is closed once the client closed its own.
+func TestProxyClosesWhenClientLeaves(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		received <- data
+	}()
+
+	addr := startProxy(t, &Proxy{
+		Dial:  func() (net.Conn, error) { return net.Dial("tcp", ln.Addr().String()) },
+		Rules: boguscoinRules(t),
+	})
+	client := dialClient(t, addr)
+	client.send("line\npartial " + TEST_COIN)
+	client.conn.CloseWrite()
+
+	select {
+	case data := <-received:
+		if want := "line\npartial " + TEST_TONY; string(data) != want {
+			t.Errorf("upstream received %q, want %q", data, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the upstream was never closed")
+	}
+	client.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.reader.ReadByte(); err != io.EOF {
+		t.Errorf("read after the client left = %v, want EOF", err)
+	}
+}
+
+// TestProxyHalfClose checks that a client closing its writing half still gets the upstream's last words,
+// and that a last line without a newline is relayed without one.
+func TestProxyHalfClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// The upstream reads until EOF and answers with everything it received.
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		fmt.Fprintf(conn, "received %q\n", data)
+		io.WriteString(conn, "partial "+TEST_COIN)
+	}()
+
+	addr := startProxy(t, &Proxy{
+		Dial:  func() (net.Conn, error) { return net.Dial("tcp", ln.Addr().String()) },
+		Rules: boguscoinRules(t),
+	})
+	client := dialClient(t, addr)
+	client.send("line\npartial " + TEST_COIN)
+	client.conn.CloseWrite()
+
+	client.expect(fmt.Sprintf("received %q\n", "line\npartial "+TEST_TONY))
+	client.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	rest, err := io.ReadAll(client.reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "partial "+TEST_TONY {
+		t.Errorf("last line = %q, want the rewritten partial line", rest)
+	}
+}
+
+func TestProxyUpstreamDialFailure(t *testing.T) {
+	addr := startProxy(t, &Proxy{
+		Dial: func() (net.Conn, error) { return nil, errors.New("connection refused") },
+	})
+
+	client := dialClient(t, addr)
+	client.expect(UNAVAILABLE + "\n")
+	if _, err := client.reader.ReadByte(); err != io.EOF {
+		t.Errorf("read after a failed dial = %v, want EOF", err)
+	}
+}
+
+// TestProxyClosesWhenUpstreamLeaves checks that the session ends once the upstream left and the client
+// stayed silent for Linger, even though it never closes.
+func TestProxyClosesWhenUpstreamLeaves(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		io.WriteString(conn, "bye\npartial "+TEST_COIN)
+		conn.Close()
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	proxy := &Proxy{
+		Dial:   func() (net.Conn, error) { return net.Dial("tcp", upstream.Addr().String()) },
+		Rules:  boguscoinRules(t),
+		Linger: 100 * time.Millisecond,
+	}
+	handled := make(chan struct{})
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		proxy.Handle(conn)
+		close(handled)
+	}()
+
+	client := dialClient(t, ln.Addr().String())
+	client.expect("bye\n")
+	client.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	rest, err := io.ReadAll(client.reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "partial "+TEST_TONY {
+		t.Errorf("last line = %q, want the rewritten partial line", rest)
+	}
+	select {
+	case <-handled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the session outlived the upstream")
+	}
+}
@@ -0,0 +1,116 @@
+package mitm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Replayer sends the recorded client side of captured sessions to a server again.
+type Replayer struct {
+	// Dial connects to the server, once for every session.
+	Dial func() (net.Conn, error)
+	// Speed scales the recorded delays, 1 replays in real time and 0 sends everything at once.
+	Speed float64
+	// Wait is how long to keep reading what the server sends after the last client event, unless it closes first.
+	Wait time.Duration
+	// Output is called with everything the server sends, it may be called from several goroutines at once.
+	Output func(session uint64, data []byte)
+}
+
+// Replay replays every session of events concurrently, starting them with the delays they were recorded with.
+// The client side is replayed as it was read from the client, before any rewriting.
+func (r *Replayer) Replay(events []Event) error {
+	sessions := make(map[uint64][]Event)
+	var start time.Time
+	for _, e := range events {
+		if e.Kind == EVENT_OPEN && (start.IsZero() || e.Time.Before(start)) {
+			start = e.Time
+		}
+		sessions[e.Session] = append(sessions[e.Session], e)
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for id, session := range sessions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := r.replaySession(id, session, start); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("session %d: %w", id, err))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (r *Replayer) replaySession(id uint64, events []Event, start time.Time) error {
+	events = slices.Clone(events)
+	slices.SortStableFunc(events, func(a, b Event) int { return a.Time.Compare(b.Time) })
+	if len(events) == 0 || events[0].Kind != EVENT_OPEN {
+		return errors.New("the capture doesn't contain the start of the session")
+	}
+
+	began := time.Now()
+	sleepUntil := func(t time.Time) {
+		offset := time.Duration(float64(t.Sub(start)) * r.Speed)
+		time.Sleep(time.Until(began.Add(offset)))
+	}
+
+	sleepUntil(events[0].Time)
+	conn, err := r.Dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	received := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 && r.Output != nil {
+				r.Output(id, slices.Clone(buf[:n]))
+			}
+			if err != nil {
+				if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+					err = nil
+				}
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					err = nil
+				}
+				received <- err
+				return
+			}
+		}
+	}()
+
+	for _, e := range events[1:] {
+		if e.Direction != CLIENT_TO_SERVER {
+			continue
+		}
+		sleepUntil(e.Time)
+		switch e.Kind {
+		case EVENT_DATA:
+			if _, err := conn.Write(e.Data); err != nil {
+				return err
+			}
+		case EVENT_EOF:
+			closeWrite(conn)
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(r.Wait))
+	return <-received
+}
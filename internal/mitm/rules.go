@@ -0,0 +1,103 @@
+package mitm
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Direction is the way a line travels through the proxy.
+type Direction string
+
+const (
+	CLIENT_TO_SERVER Direction = "c2s"
+	SERVER_TO_CLIENT Direction = "s2c"
+	BOTH             Direction = "both"
+)
+
+// Rule rewrites the lines travelling in Direction, it matches either a Regex anywhere in the line
+// or a Token, a regex that has to match a whole word between Separators.
+// Replace may refer to the groups of the match as $1 or ${name}.
+type Rule struct {
+	Name    string `json:"name"`
+	Regex   string `json:"regex,omitempty"`
+	Token   string `json:"token,omitempty"`
+	Replace string `json:"replace"`
+	// Separators are the characters words are split on, empty splits on spaces only as the spec does.
+	// The separators are relayed untouched.
+	Separators string    `json:"separators,omitempty"`
+	Direction  Direction `json:"direction"`
+
+	re *regexp.Regexp
+}
+
+// Compile validates the rule, it has to be called before the rule is applied.
+func (r *Rule) Compile() error {
+	if err := compileDirection(r.Name, &r.Direction); err != nil {
+		return err
+	}
+
+	var err error
+	switch {
+	case r.Regex != "" && r.Token != "":
+		return fmt.Errorf("rule %q: set either regex or token, not both", r.Name)
+	case r.Regex != "":
+		r.re, err = regexp.Compile(r.Regex)
+	case r.Token != "":
+		r.re, err = regexp.Compile("^(?:" + r.Token + ")$")
+	default:
+		return fmt.Errorf("rule %q: regex or token is required", r.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("rule %q: %w", r.Name, err)
+	}
+	return nil
+}
+
+// compileDirection defaults an empty direction of the rule called name to BOTH and rejects unknown ones.
+func compileDirection(name string, direction *Direction) error {
+	if *direction == "" {
+		*direction = BOTH
+	}
+	switch *direction {
+	case CLIENT_TO_SERVER, SERVER_TO_CLIENT, BOTH:
+		return nil
+	default:
+		return fmt.Errorf("rule %q: unknown direction %q, expected c2s, s2c or both", name, *direction)
+	}
+}
+
+func (r *Rule) applies(direction Direction) bool {
+	return r.Direction == BOTH || r.Direction == direction
+}
+
+// Apply returns msg with every match of the rule replaced.
+func (r *Rule) Apply(msg string) string {
+	if r.Regex != "" {
+		return r.re.ReplaceAllString(msg, r.Replace)
+	}
+
+	tokens := Tokenize(msg, r.Separators)
+	caught := false
+	for i, token := range tokens {
+		if !token.Separator && r.re.MatchString(token.Text) {
+			tokens[i].Text = r.re.ReplaceAllString(token.Text, r.Replace)
+			caught = true
+		}
+	}
+	if !caught {
+		return msg
+	}
+	return JoinTokens(tokens)
+}
+
+type Rules []*Rule
+
+// Rewrite applies every rule for direction to msg, in order.
+func (rules Rules) Rewrite(direction Direction, msg string) string {
+	for _, rule := range rules {
+		if rule.applies(direction) {
+			msg = rule.Apply(msg)
+		}
+	}
+	return msg
+}
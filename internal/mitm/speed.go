@@ -0,0 +1,259 @@
+package mitm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strings"
+)
+
+// Message types of the speed daemon protocol.
+const (
+	SPEED_ERROR           byte = 0x10
+	SPEED_PLATE           byte = 0x20
+	SPEED_TICKET          byte = 0x21
+	SPEED_WANT_HEARTBEAT  byte = 0x40
+	SPEED_HEARTBEAT       byte = 0x41
+	SPEED_I_AM_CAMERA     byte = 0x80
+	SPEED_I_AM_DISPATCHER byte = 0x81
+)
+
+// speedLayouts are the fields following the type byte of every message: 1, 2 and 4 are big endian integers
+// of that many bytes, s is a string prefixed with its u8 length and a is a u8 count of u16s followed by them.
+var speedLayouts = map[byte]string{
+	SPEED_ERROR:           "s",
+	SPEED_PLATE:           "s4",
+	SPEED_TICKET:          "s224242",
+	SPEED_WANT_HEARTBEAT:  "4",
+	SPEED_HEARTBEAT:       "",
+	SPEED_I_AM_CAMERA:     "222",
+	SPEED_I_AM_DISPATCHER: "a",
+}
+
+var ErrNotDecodable = errors.New("only Plate and Ticket messages are decoded")
+
+// SpeedMessage is a decoded Plate or Ticket message of the speed daemon protocol.
+// A Plate only has Plate and Timestamp, a Ticket has every field but Timestamp.
+type SpeedMessage struct {
+	Type       byte
+	Plate      string
+	Timestamp  uint32
+	Road       uint16
+	Mile1      uint16
+	Timestamp1 uint32
+	Mile2      uint16
+	Timestamp2 uint32
+	// Speed is in hundredths of miles per hour.
+	Speed uint16
+}
+
+// DecodeSpeedMessage decodes a whole Plate or Ticket message, type byte included.
+func DecodeSpeedMessage(msg []byte) (*SpeedMessage, error) {
+	if len(msg) == 0 || (msg[0] != SPEED_PLATE && msg[0] != SPEED_TICKET) {
+		return nil, ErrNotDecodable
+	}
+	m := &SpeedMessage{Type: msg[0]}
+	body := msg[1:]
+
+	if len(body) < 1 || len(body) < 1+int(body[0]) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	m.Plate = string(body[1 : 1+body[0]])
+	body = body[1+body[0]:]
+
+	want := 4
+	if m.Type == SPEED_TICKET {
+		want = 16
+	}
+	if len(body) != want {
+		return nil, fmt.Errorf("message 0x%02x has %d bytes after the plate, want %d", m.Type, len(body), want)
+	}
+	if m.Type == SPEED_PLATE {
+		m.Timestamp = binary.BigEndian.Uint32(body)
+		return m, nil
+	}
+	m.Road = binary.BigEndian.Uint16(body)
+	m.Mile1 = binary.BigEndian.Uint16(body[2:])
+	m.Timestamp1 = binary.BigEndian.Uint32(body[4:])
+	m.Mile2 = binary.BigEndian.Uint16(body[8:])
+	m.Timestamp2 = binary.BigEndian.Uint32(body[10:])
+	m.Speed = binary.BigEndian.Uint16(body[14:])
+	return m, nil
+}
+
+// Encode returns the message as it is sent on the wire.
+func (m *SpeedMessage) Encode() ([]byte, error) {
+	if len(m.Plate) > math.MaxUint8 {
+		return nil, fmt.Errorf("plate of %d bytes doesn't fit a string", len(m.Plate))
+	}
+	msg := []byte{m.Type, byte(len(m.Plate))}
+	msg = append(msg, m.Plate...)
+
+	switch m.Type {
+	case SPEED_PLATE:
+		msg = binary.BigEndian.AppendUint32(msg, m.Timestamp)
+	case SPEED_TICKET:
+		msg = binary.BigEndian.AppendUint16(msg, m.Road)
+		msg = binary.BigEndian.AppendUint16(msg, m.Mile1)
+		msg = binary.BigEndian.AppendUint32(msg, m.Timestamp1)
+		msg = binary.BigEndian.AppendUint16(msg, m.Mile2)
+		msg = binary.BigEndian.AppendUint32(msg, m.Timestamp2)
+		msg = binary.BigEndian.AppendUint16(msg, m.Speed)
+	default:
+		return nil, ErrNotDecodable
+	}
+	return msg, nil
+}
+
+// Actions of a SpeedRule.
+const (
+	REDACT_PLATE = "redact-plate"
+	SCALE_SPEED  = "scale-speed"
+)
+
+// SpeedRule rewrites the Plate and Ticket messages travelling in Direction whose plate matches Plate.
+// redact-plate replaces the plate of both with Replace, scale-speed multiplies the speed of tickets by Factor.
+type SpeedRule struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	// Plate is a regex the whole plate has to match, empty matches every plate.
+	Plate string `json:"plate,omitempty"`
+	// Replace is the plate redacted plates get, empty replaces every character of the plate with X.
+	Replace   string    `json:"replace,omitempty"`
+	Factor    float64   `json:"factor,omitempty"`
+	Direction Direction `json:"direction"`
+
+	re *regexp.Regexp
+}
+
+// Compile validates the rule, it has to be called before the rule is applied.
+func (r *SpeedRule) Compile() error {
+	if err := compileDirection(r.Name, &r.Direction); err != nil {
+		return err
+	}
+	switch r.Action {
+	case REDACT_PLATE:
+	case SCALE_SPEED:
+		if r.Factor <= 0 {
+			return fmt.Errorf("rule %q: scale-speed needs a positive factor", r.Name)
+		}
+	default:
+		return fmt.Errorf("rule %q: unknown action %q, expected redact-plate or scale-speed", r.Name, r.Action)
+	}
+
+	plate := r.Plate
+	if plate == "" {
+		plate = ".*"
+	}
+	var err error
+	if r.re, err = regexp.Compile("^(?:" + plate + ")$"); err != nil {
+		return fmt.Errorf("rule %q: %w", r.Name, err)
+	}
+	return nil
+}
+
+// Apply rewrites m and reports whether it changed.
+func (r *SpeedRule) Apply(m *SpeedMessage) bool {
+	if !r.re.MatchString(m.Plate) {
+		return false
+	}
+
+	switch r.Action {
+	case REDACT_PLATE:
+		redacted := r.Replace
+		if redacted == "" {
+			redacted = strings.Repeat("X", len(m.Plate))
+		}
+		changed := redacted != m.Plate
+		m.Plate = redacted
+		return changed
+	case SCALE_SPEED:
+		if m.Type != SPEED_TICKET {
+			return false
+		}
+		speed := uint16(min(math.Round(float64(m.Speed)*r.Factor), math.MaxUint16))
+		changed := speed != m.Speed
+		m.Speed = speed
+		return changed
+	}
+	return false
+}
+
+type SpeedRules []*SpeedRule
+
+// Rewrite applies every rule for direction to m, in order, and reports whether any of them changed it.
+func (rules SpeedRules) Rewrite(direction Direction, m *SpeedMessage) bool {
+	changed := false
+	for _, rule := range rules {
+		if rule.Direction == BOTH || rule.Direction == direction {
+			changed = rule.Apply(m) || changed
+		}
+	}
+	return changed
+}
+
+// SpeedCodec frames the messages of the speed daemon protocol and rewrites Plate and Ticket messages with Rules.
+// A type byte it doesn't know is a message of its own, the server answers it with an error anyway.
+type SpeedCodec struct {
+	Rules SpeedRules
+}
+
+func (c SpeedCodec) ReadMessage(reader *bufio.Reader) ([]byte, error) {
+	msgType, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	msg := []byte{msgType}
+
+	for _, field := range speedLayouts[msgType] {
+		var size int
+		switch field {
+		case '1', '2', '4':
+			size = int(field - '0')
+		case 's', 'a':
+			length, err := reader.ReadByte()
+			if err != nil {
+				return msg, err
+			}
+			msg = append(msg, length)
+			size = int(length)
+			if field == 'a' {
+				size *= 2
+			}
+		}
+
+		start := len(msg)
+		msg = append(msg, make([]byte, size)...)
+		n, err := io.ReadFull(reader, msg[start:])
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return msg[:start+n], err
+		}
+	}
+	return msg, nil
+}
+
+// Rewrite relays messages that aren't Plates or Tickets, or that no rule changed, as they are.
+func (c SpeedCodec) Rewrite(direction Direction, msg []byte) []byte {
+	m, err := DecodeSpeedMessage(msg)
+	if err != nil || !c.Rules.Rewrite(direction, m) {
+		return msg
+	}
+	rewritten, err := m.Encode()
+	if err != nil {
+		return msg
+	}
+	return rewritten
+}
+
+// EncodeError returns an Error message, msg is cut to the 255 bytes a string can hold.
+func (c SpeedCodec) EncodeError(msg string) []byte {
+	msg = msg[:min(len(msg), math.MaxUint8)]
+	return append([]byte{SPEED_ERROR, byte(len(msg))}, msg...)
+}
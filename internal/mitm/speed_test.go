@@ -0,0 +1,193 @@
+package mitm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func speedString(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func plateMessage(plate string, timestamp uint32) []byte {
+	msg := append([]byte{SPEED_PLATE}, speedString(plate)...)
+	return binary.BigEndian.AppendUint32(msg, timestamp)
+}
+
+func ticketMessage(t *testing.T, plate string, speed uint16) []byte {
+	t.Helper()
+	msg, err := (&SpeedMessage{
+		Type: SPEED_TICKET, Plate: plate, Road: 66, Mile1: 100, Timestamp1: 123456, Mile2: 110, Timestamp2: 123816, Speed: speed,
+	}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestSpeedCodecFramesMessages(t *testing.T) {
+	messages := [][]byte{
+		{SPEED_I_AM_CAMERA, 0, 66, 0, 100, 0, 60},
+		plateMessage("UN1X", 1000),
+		{SPEED_WANT_HEARTBEAT, 0, 0, 0, 10},
+		{SPEED_HEARTBEAT},
+		{SPEED_I_AM_DISPATCHER, 3, 0, 66, 1, 0x70, 0x04, 0x4e},
+		ticketMessage(t, "UN1X", 8000),
+		append([]byte{SPEED_ERROR}, speedString("bad")...),
+		{0x99},
+	}
+	stream := bytes.Join(messages, nil)
+
+	codec := SpeedCodec{}
+	reader := bufio.NewReader(bytes.NewReader(stream))
+	for i, want := range messages {
+		got, err := codec.ReadMessage(reader)
+		if err != nil {
+			t.Fatalf("message %d: %s", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("message %d = %x, want %x", i, got, want)
+		}
+	}
+	if msg, err := codec.ReadMessage(reader); err != io.EOF || len(msg) != 0 {
+		t.Errorf("after the last message got %x, %v, want EOF", msg, err)
+	}
+
+	// A message cut short is returned with EOF so the proxy still relays it.
+	partial := plateMessage("UN1X", 1000)[:7]
+	msg, err := codec.ReadMessage(bufio.NewReader(bytes.NewReader(partial)))
+	if err != io.EOF || !bytes.Equal(msg, partial) {
+		t.Errorf("partial message got %x, %v, want %x, EOF", msg, err, partial)
+	}
+}
+
+func TestSpeedMessageRoundTrip(t *testing.T) {
+	for _, msg := range [][]byte{plateMessage("RE05BKG", 123456), ticketMessage(t, "RE05BKG", 6000)} {
+		m, err := DecodeSpeedMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := m.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(encoded, msg) {
+			t.Errorf("encoded %x, want %x", encoded, msg)
+		}
+	}
+
+	if _, err := DecodeSpeedMessage([]byte{SPEED_HEARTBEAT}); err != ErrNotDecodable {
+		t.Errorf("decoding a heartbeat = %v, want ErrNotDecodable", err)
+	}
+	if _, err := DecodeSpeedMessage(plateMessage("UN1X", 1)[:6]); err == nil {
+		t.Error("decoded a truncated plate")
+	}
+}
+
+func compileSpeedRules(t *testing.T, rules ...*SpeedRule) SpeedRules {
+	t.Helper()
+	for _, rule := range rules {
+		if err := rule.Compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rules
+}
+
+func TestSpeedCodecRewrite(t *testing.T) {
+	codec := SpeedCodec{Rules: compileSpeedRules(t,
+		&SpeedRule{Name: "hide", Action: REDACT_PLATE, Plate: "UN[0-9]+X", Direction: CLIENT_TO_SERVER},
+		&SpeedRule{Name: "rename", Action: REDACT_PLATE, Plate: "RE05BKG", Replace: "NOPLATE"},
+		&SpeedRule{Name: "double", Action: SCALE_SPEED, Factor: 2, Direction: SERVER_TO_CLIENT},
+	)}
+
+	tests := []struct {
+		name      string
+		direction Direction
+		msg, want []byte
+	}{
+		{"redacted", CLIENT_TO_SERVER, plateMessage("UN12X", 7), plateMessage("XXXXX", 7)},
+		{"other direction", SERVER_TO_CLIENT, plateMessage("UN12X", 7), plateMessage("UN12X", 7)},
+		{"unmatched", CLIENT_TO_SERVER, plateMessage("AB12", 7), plateMessage("AB12", 7)},
+		{"replaced", CLIENT_TO_SERVER, plateMessage("RE05BKG", 7), plateMessage("NOPLATE", 7)},
+		{"scaled", SERVER_TO_CLIENT, ticketMessage(t, "AB12", 6000), ticketMessage(t, "AB12", 12000)},
+		{"scale saturates", SERVER_TO_CLIENT, ticketMessage(t, "AB12", 40000), ticketMessage(t, "AB12", 65535)},
+		{"both rules", SERVER_TO_CLIENT, ticketMessage(t, "RE05BKG", 100), ticketMessage(t, "NOPLATE", 200)},
+		{"not decoded", SERVER_TO_CLIENT, []byte{SPEED_HEARTBEAT}, []byte{SPEED_HEARTBEAT}},
+	}
+	for _, test := range tests {
+		if got := codec.Rewrite(test.direction, test.msg); !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got %x, want %x", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSpeedRuleCompileRejects(t *testing.T) {
+	for name, rule := range map[string]*SpeedRule{
+		"no action":       {Name: "a"},
+		"unknown action":  {Name: "a", Action: "explode"},
+		"no factor":       {Name: "a", Action: SCALE_SPEED},
+		"bad plate regex": {Name: "a", Action: REDACT_PLATE, Plate: "("},
+		"bad direction":   {Name: "a", Action: REDACT_PLATE, Direction: "up"},
+	} {
+		if err := rule.Compile(); err == nil {
+			t.Errorf("%s: compiled without an error", name)
+		}
+	}
+}
+
+func TestProxySpeedCodec(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	camera := []byte{SPEED_I_AM_CAMERA, 0, 66, 0, 100, 0, 60}
+	// The upstream answers a camera's plate with a ticket for it and leaves.
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data := make([]byte, len(camera)+len(plateMessage("UN1X", 1000)))
+		io.ReadFull(conn, data)
+		received <- data
+		conn.Write(ticketMessage(t, "UN1X", 6000))
+	}()
+
+	addr := startProxy(t, &Proxy{
+		Dial: func() (net.Conn, error) { return net.Dial("tcp", ln.Addr().String()) },
+		Codec: SpeedCodec{Rules: compileSpeedRules(t,
+			&SpeedRule{Name: "hide", Action: REDACT_PLATE, Direction: CLIENT_TO_SERVER},
+			&SpeedRule{Name: "slow", Action: SCALE_SPEED, Factor: 0.5, Direction: SERVER_TO_CLIENT},
+		)},
+	})
+	client := dialClient(t, addr)
+	client.conn.Write(camera)
+	client.conn.Write(plateMessage("UN1X", 1000))
+
+	select {
+	case data := <-received:
+		if want := append(camera, plateMessage("XXXX", 1000)...); !bytes.Equal(data, want) {
+			t.Errorf("upstream received %x, want %x", data, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream never got the plate")
+	}
+
+	client.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, err := io.ReadAll(client.reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ticketMessage(t, "UN1X", 3000); !bytes.Equal(data, want) {
+		t.Errorf("client received %x, want %x", data, want)
+	}
+}
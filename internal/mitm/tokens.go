@@ -0,0 +1,49 @@
+package mitm
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// SPACE is the only separator of the Mob in the Middle spec, an address has to start at the start of the message
+// or after a space and end at the end of the message or before a space. Tabs, carriage returns and
+// every other character are part of the word next to them.
+const SPACE = " "
+
+// Token is a word of a message, or a run of the separators between two words.
+type Token struct {
+	Text      string
+	Separator bool
+}
+
+// Tokenize splits msg into words and the runs of separators between them, every byte of msg is in exactly
+// one token so joining the tokens gives msg back. Separators is a set of characters, empty uses SPACE.
+func Tokenize(msg string, separators string) []Token {
+	if separators == "" {
+		separators = SPACE
+	}
+
+	tokens := make([]Token, 0)
+	for msg != "" {
+		first, _ := utf8.DecodeRuneInString(msg)
+		isSeparator := strings.ContainsRune(separators, first)
+		end := strings.IndexFunc(msg, func(r rune) bool {
+			return strings.ContainsRune(separators, r) != isSeparator
+		})
+		if end == -1 {
+			end = len(msg)
+		}
+		tokens = append(tokens, Token{Text: msg[:end], Separator: isSeparator})
+		msg = msg[end:]
+	}
+	return tokens
+}
+
+// JoinTokens is the inverse of Tokenize.
+func JoinTokens(tokens []Token) string {
+	var b strings.Builder
+	for _, token := range tokens {
+		b.WriteString(token.Text)
+	}
+	return b.String()
+}
@@ -0,0 +1,50 @@
+package mitm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		msg        string
+		separators string
+		want       []Token
+	}{
+		{"", "", []Token{}},
+		{"one", "", []Token{{"one", false}}},
+		{"a b", "", []Token{{"a", false}, {" ", true}, {"b", false}}},
+		{"  a  ", "", []Token{{"  ", true}, {"a", false}, {"  ", true}}},
+		{"a\tb c", "", []Token{{"a\tb", false}, {" ", true}, {"c", false}}},
+		{"a\tb c", " \t", []Token{{"a", false}, {"\t", true}, {"b", false}, {" ", true}, {"c", false}}},
+		{"é ü", "", []Token{{"é", false}, {" ", true}, {"ü", false}}},
+		{"a\xffb c", "", []Token{{"a\xffb", false}, {" ", true}, {"c", false}}},
+	}
+	for _, test := range tests {
+		got := Tokenize(test.msg, test.separators)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Tokenize(%q, %q) = %v, want %v", test.msg, test.separators, got, test.want)
+		}
+		if joined := JoinTokens(got); joined != test.msg {
+			t.Errorf("JoinTokens(Tokenize(%q)) = %q", test.msg, joined)
+		}
+	}
+}
+
+func TestTokenRuleSeparators(t *testing.T) {
+	spec := &Rule{Name: "spec", Token: "7[a-zA-Z0-9]{25,34}", Replace: TEST_TONY}
+	tabs := &Rule{Name: "tabs", Token: "7[a-zA-Z0-9]{25,34}", Replace: TEST_TONY, Separators: " \t"}
+	for _, rule := range []*Rule{spec, tabs} {
+		if err := rule.Compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msg := "pay\t" + TEST_COIN + "  or " + TEST_COIN
+	if got, want := spec.Apply(msg), "pay\t"+TEST_COIN+"  or "+TEST_TONY; got != want {
+		t.Errorf("spec rule rewrote %q to %q, want %q", msg, got, want)
+	}
+	if got, want := tabs.Apply(msg), "pay\t"+TEST_TONY+"  or "+TEST_TONY; got != want {
+		t.Errorf("tab separated rule rewrote %q to %q, want %q", msg, got, want)
+	}
+}
@@ -0,0 +1,366 @@
+package mitm
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// POOL_BUFFER_SIZE is how much an idle pooled connection may receive before a client takes it, the welcome
+// of a server fits in it and a connection that receives more is closed.
+const POOL_BUFFER_SIZE = 4096
+
+var (
+	ErrNoUpstream   = errors.New("no upstream is available")
+	errPoolOverflow = errors.New("idle connection received too much")
+)
+
+// Upstreams connects to one of several upstream servers, it prefers them in the order they were given and
+// fails over to the next one when a server can't be reached.
+//
+// Every server is healthy until dialing it fails, and healthy again once dialing it succeeds, whether the dial
+// was for a client or for a health check. Dial tries the healthy servers first and the others after them,
+// so it still finds a server that came back before the next health check noticed it.
+//
+// With a PoolSize Dial hands out connections that were opened ahead of time to the preferred server, and opens
+// another one in the background. Every client still gets a session of its own, the pool only saves it the dial,
+// so a pooled connection is never returned to the pool. What the server sends while a connection is idle,
+// e.g a welcome, is kept and read by the client that takes it.
+type Upstreams struct {
+	// DialTimeout bounds every attempt to connect.
+	DialTimeout time.Duration
+	// Retries is how many more times Dial goes over all the servers when none of them could be reached.
+	Retries int
+	// Backoff is the pause before the first retry, it doubles for every retry after it.
+	Backoff time.Duration
+	// PoolSize is how many idle connections are kept open ahead of the clients, 0 dials for every client.
+	PoolSize int
+	// MaxIdle is how long a connection stays in the pool, older ones are closed and opened again.
+	MaxIdle time.Duration
+
+	servers []*server
+
+	poolMu  sync.Mutex
+	pool    []*pooled
+	filling bool
+	closed  bool
+}
+
+type server struct {
+	addr    string
+	mu      sync.Mutex
+	healthy bool
+}
+
+// NewUpstreams returns healthy upstreams for addrs, with a 5 second dial timeout and two retries 100ms apart.
+// Nothing is pooled until PoolSize is set.
+func NewUpstreams(addrs ...string) *Upstreams {
+	u := &Upstreams{
+		DialTimeout: 5 * time.Second,
+		Retries:     2,
+		Backoff:     100 * time.Millisecond,
+		MaxIdle:     30 * time.Second,
+	}
+	for _, addr := range addrs {
+		u.servers = append(u.servers, &server{addr: addr, healthy: true})
+	}
+	return u
+}
+
+// Dial takes a pooled connection to the preferred server, or connects to the first server that answers.
+// It returns an error wrapping ErrNoUpstream and the reason of every server when none did.
+func (u *Upstreams) Dial() (net.Conn, error) {
+	if u.PoolSize > 0 {
+		defer u.fillPool()
+		if conn, ok := u.takePooled(); ok {
+			return conn, nil
+		}
+	}
+
+	backoff := u.Backoff
+	var errs []error
+	for attempt := 0; attempt <= u.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		errs = errs[:0]
+		for _, s := range u.candidates() {
+			conn, err := u.dial(s)
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+		}
+	}
+	return nil, fmt.Errorf("%w: %w", ErrNoUpstream, errors.Join(errs...))
+}
+
+// candidates are the healthy servers and then the others, each in the order they were given.
+func (u *Upstreams) candidates() []*server {
+	healthy := make([]*server, 0, len(u.servers))
+	unhealthy := make([]*server, 0)
+	for _, s := range u.servers {
+		if s.isHealthy() {
+			healthy = append(healthy, s)
+		} else {
+			unhealthy = append(unhealthy, s)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (u *Upstreams) dial(s *server) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", s.addr, u.DialTimeout)
+	s.mark(err)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.addr, err)
+	}
+	return conn, nil
+}
+
+// CheckHealth connects to every server and hangs up right away, marking the server healthy when it answered.
+func (u *Upstreams) CheckHealth() {
+	var wg sync.WaitGroup
+	for _, s := range u.servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if conn, err := u.dial(s); err == nil {
+				conn.Close()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// RunHealthChecks checks the health of the servers every interval, and tops up the pool after every check.
+func (u *Upstreams) RunHealthChecks(interval time.Duration) {
+	for range time.Tick(interval) {
+		u.CheckHealth()
+		u.fillPool()
+	}
+}
+
+// Healthy returns the addresses of the servers that are healthy, in order.
+func (u *Upstreams) Healthy() []string {
+	addrs := make([]string, 0, len(u.servers))
+	for _, s := range u.servers {
+		if s.isHealthy() {
+			addrs = append(addrs, s.addr)
+		}
+	}
+	return addrs
+}
+
+func (s *server) isHealthy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.healthy
+}
+
+// mark records the result of dialing the server, logging when it went down or came back.
+func (s *server) mark(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case err != nil && s.healthy:
+		log.Printf("Upstream %s is down: %s", s.addr, err)
+	case err == nil && !s.healthy:
+		log.Printf("Upstream %s is back up", s.addr)
+	}
+	s.healthy = err == nil
+}
+
+// Close closes the idle connections of the pool, Dial doesn't pool connections after it.
+func (u *Upstreams) Close() {
+	u.poolMu.Lock()
+	idle := u.pool
+	u.pool = nil
+	u.closed = true
+	u.poolMu.Unlock()
+
+	for _, p := range idle {
+		p.conn.Close()
+	}
+}
+
+// Pooled returns how many idle connections are in the pool.
+func (u *Upstreams) Pooled() int {
+	u.poolMu.Lock()
+	defer u.poolMu.Unlock()
+	return len(u.pool)
+}
+
+// preferred is the first healthy server, nil when none is.
+func (u *Upstreams) preferred() *server {
+	for _, s := range u.servers {
+		if s.isHealthy() {
+			return s
+		}
+	}
+	return nil
+}
+
+// takePooled returns the newest idle connection that is still open, to a server that is still preferred.
+// The connections it passes over are closed, a server that came back first shouldn't keep serving from the backup.
+func (u *Upstreams) takePooled() (net.Conn, bool) {
+	preferred := u.preferred()
+	for {
+		u.poolMu.Lock()
+		if len(u.pool) == 0 {
+			u.poolMu.Unlock()
+			return nil, false
+		}
+		p := u.pool[len(u.pool)-1]
+		u.pool = u.pool[:len(u.pool)-1]
+		u.poolMu.Unlock()
+
+		if p.server != preferred || time.Since(p.dialed) > u.MaxIdle {
+			p.conn.Close()
+			continue
+		}
+		if conn, ok := p.take(); ok {
+			return conn, true
+		}
+	}
+}
+
+// fillPool closes the connections that were idle for longer than MaxIdle or that the server closed, and opens
+// connections to the preferred server in the background until there are PoolSize of them.
+func (u *Upstreams) fillPool() {
+	u.poolMu.Lock()
+	defer u.poolMu.Unlock()
+	if u.PoolSize == 0 || u.filling || u.closed {
+		return
+	}
+
+	open := u.pool[:0]
+	for _, p := range u.pool {
+		if time.Since(p.dialed) > u.MaxIdle || p.isDone() {
+			p.conn.Close()
+			continue
+		}
+		open = append(open, p)
+	}
+	clear(u.pool[len(open):])
+	u.pool = open
+	if len(u.pool) >= u.PoolSize {
+		return
+	}
+
+	u.filling = true
+	go func() {
+		defer func() {
+			u.poolMu.Lock()
+			u.filling = false
+			u.poolMu.Unlock()
+		}()
+
+		for {
+			s := u.preferred()
+			if s == nil {
+				return
+			}
+			u.poolMu.Lock()
+			full := u.closed || len(u.pool) >= u.PoolSize
+			u.poolMu.Unlock()
+			if full {
+				return
+			}
+
+			conn, err := u.dial(s)
+			if err != nil {
+				// The server is marked down, the next Dial or health check fills the pool again.
+				return
+			}
+			p := &pooled{conn: conn, server: s, dialed: time.Now(), done: make(chan struct{})}
+			go p.read()
+
+			u.poolMu.Lock()
+			if u.closed {
+				u.poolMu.Unlock()
+				conn.Close()
+				return
+			}
+			u.pool = append(u.pool, p)
+			u.poolMu.Unlock()
+		}
+	}()
+}
+
+// pooled is an idle connection, its reader keeps what the server sends until a client takes it.
+type pooled struct {
+	conn   net.Conn
+	server *server
+	dialed time.Time
+
+	// buf and err belong to read until done is closed.
+	buf  []byte
+	err  error
+	done chan struct{}
+}
+
+func (p *pooled) read() {
+	defer close(p.done)
+	chunk := make([]byte, 512)
+	for {
+		n, err := p.conn.Read(chunk)
+		p.buf = append(p.buf, chunk[:n]...)
+		if err == nil && len(p.buf) > POOL_BUFFER_SIZE {
+			err = errPoolOverflow
+		}
+		if err != nil {
+			p.err = err
+			return
+		}
+	}
+}
+
+// isDone reports whether the reader stopped, i.e the server closed the connection or sent too much.
+func (p *pooled) isDone() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// take stops the reader and returns the connection with what it read, the connection is closed instead
+// when the reader stopped for any other reason.
+func (p *pooled) take() (net.Conn, bool) {
+	p.conn.SetReadDeadline(time.Now())
+	<-p.done
+	if !errors.Is(p.err, os.ErrDeadlineExceeded) {
+		p.conn.Close()
+		return nil, false
+	}
+	p.conn.SetReadDeadline(time.Time{})
+	return &pooledConn{Conn: p.conn, buf: p.buf}, true
+}
+
+// pooledConn is a connection taken from the pool, it is read from buf until buf is empty.
+type pooledConn struct {
+	net.Conn
+	buf []byte
+}
+
+func (c *pooledConn) Read(b []byte) (int, error) {
+	if len(c.buf) > 0 {
+		n := copy(b, c.buf)
+		c.buf = c.buf[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *pooledConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
@@ -0,0 +1,244 @@
+package mitm
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// listenUpstream accepts connections on a loopback port and sends each its address, so a client can tell
+// which upstream it reached.
+func listenUpstream(t *testing.T, addr string) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(ln.Addr().String() + "\n"))
+			conn.Close()
+		}
+	}()
+	return ln
+}
+
+// deadAddr returns a loopback address nothing listens on.
+func deadAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	return ln.Addr().String()
+}
+
+func reached(t *testing.T, upstreams *Upstreams) string {
+	t.Helper()
+	conn, err := upstreams.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n-1])
+}
+
+func TestUpstreamsFailover(t *testing.T) {
+	primary := deadAddr(t)
+	backup := listenUpstream(t, "127.0.0.1:0").Addr().String()
+	upstreams := NewUpstreams(primary, backup)
+
+	if got := reached(t, upstreams); got != backup {
+		t.Fatalf("reached %s, want the backup %s", got, backup)
+	}
+	if healthy := upstreams.Healthy(); !slices.Equal(healthy, []string{backup}) {
+		t.Errorf("healthy upstreams %v, want only the backup", healthy)
+	}
+
+	// Once the primary is back a health check makes it preferred again.
+	listenUpstream(t, primary)
+	upstreams.CheckHealth()
+	if healthy := upstreams.Healthy(); !slices.Equal(healthy, []string{primary, backup}) {
+		t.Errorf("healthy upstreams %v, want both", healthy)
+	}
+	if got := reached(t, upstreams); got != primary {
+		t.Errorf("reached %s, want the primary %s", got, primary)
+	}
+}
+
+func TestUpstreamsRetryWithBackoff(t *testing.T) {
+	upstreams := NewUpstreams(deadAddr(t), deadAddr(t))
+	upstreams.Retries = 2
+	upstreams.Backoff = 20 * time.Millisecond
+
+	start := time.Now()
+	_, err := upstreams.Dial()
+	if !errors.Is(err, ErrNoUpstream) {
+		t.Fatalf("dial = %v, want ErrNoUpstream", err)
+	}
+	// Two retries wait 20ms and then 40ms.
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("gave up after %s, want at least 60ms of backoff", elapsed)
+	}
+	if healthy := upstreams.Healthy(); len(healthy) != 0 {
+		t.Errorf("healthy upstreams %v, want none", healthy)
+	}
+}
+
+func TestUpstreamsRetryFindsServerComingBack(t *testing.T) {
+	addr := deadAddr(t)
+	upstreams := NewUpstreams(addr)
+	upstreams.Retries = 5
+	upstreams.Backoff = 50 * time.Millisecond
+
+	dialed := make(chan error, 1)
+	go func() {
+		conn, err := upstreams.Dial()
+		if err == nil {
+			conn.Close()
+		}
+		dialed <- err
+	}()
+	time.Sleep(60 * time.Millisecond)
+	listenUpstream(t, addr)
+	if err := <-dialed; err != nil {
+		t.Errorf("dial while the server came back = %v", err)
+	}
+}
+
+func TestProxyNoUpstreamAvailable(t *testing.T) {
+	upstreams := NewUpstreams(deadAddr(t), deadAddr(t))
+	upstreams.Retries = 0
+	addr := startProxy(t, &Proxy{Dial: upstreams.Dial, Codec: SpeedCodec{}})
+
+	client := dialClient(t, addr)
+	client.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msg, err := SpeedCodec{}.ReadMessage(client.reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (SpeedCodec{}).EncodeError(UNAVAILABLE); string(msg) != string(want) {
+		t.Errorf("client received %q, want the error %q", msg, want)
+	}
+}
+
+// listenWelcome accepts connections on a loopback port, greets each with its number and then echoes it.
+func listenWelcome(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for accepted := 1; ; accepted++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				fmt.Fprintf(conn, "welcome %d\n", accepted)
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func waitPooled(t *testing.T, upstreams *Upstreams, want int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for upstreams.Pooled() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d pooled connections, want %d", upstreams.Pooled(), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestUpstreamsPool(t *testing.T) {
+	upstreams := NewUpstreams(listenWelcome(t))
+	upstreams.PoolSize = 2
+	t.Cleanup(upstreams.Close)
+	upstreams.fillPool()
+	waitPooled(t, upstreams, 2)
+
+	// The newest pooled connection is taken, with the welcome it received while idle, and another one is opened.
+	conn, err := upstreams.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+	if line, err := reader.ReadString('\n'); line != "welcome 2\n" || err != nil {
+		t.Fatalf("read %q, %v, want the welcome of the second pooled connection", line, err)
+	}
+	fmt.Fprintf(conn, "ping\n")
+	if line, err := reader.ReadString('\n'); line != "ping\n" || err != nil {
+		t.Errorf("read %q, %v, want the echo", line, err)
+	}
+	if err := closeWrite(conn); err != nil {
+		t.Errorf("half closing a pooled connection: %s", err)
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("read after half closing = %v, want EOF", err)
+	}
+	waitPooled(t, upstreams, 2)
+
+	// Connections idle for longer than MaxIdle are closed, the client gets a fresh one.
+	upstreams.MaxIdle = 0
+	conn, err = upstreams.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); line != "welcome 4\n" || err != nil {
+		t.Errorf("read %q, %v, want the welcome of a fresh connection", line, err)
+	}
+}
+
+func TestUpstreamsPoolSkipsClosedConnections(t *testing.T) {
+	// listenUpstream hangs up right after sending its address, so every pooled connection is closed by the server.
+	addr := listenUpstream(t, "127.0.0.1:0").Addr().String()
+	upstreams := NewUpstreams(addr)
+	upstreams.PoolSize = 2
+	t.Cleanup(upstreams.Close)
+	upstreams.fillPool()
+	waitPooled(t, upstreams, 2)
+
+	closed := func() bool {
+		upstreams.poolMu.Lock()
+		defer upstreams.poolMu.Unlock()
+		return upstreams.pool[0].isDone() && upstreams.pool[1].isDone()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !closed() {
+		if time.Now().After(deadline) {
+			t.Fatal("the server didn't close the pooled connections")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := reached(t, upstreams); got != addr {
+		t.Errorf("reached %q, want a fresh connection to %s", got, addr)
+	}
+}
@@ -0,0 +1,272 @@
+// Package transcript records budgetchat traffic to rotating JSON lines files and searches them.
+// Each room has its own files in the transcript directory, named <room>-<creation time>.jsonl,
+// or <room>-<creation time>.<n>.jsonl for the nth file created within the same microsecond.
+package transcript
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Kind string
+
+const (
+	MESSAGE Kind = "message"
+	JOIN    Kind = "join"
+	LEAVE   Kind = "leave"
+)
+
+const fileTimeLayout = "20060102T150405.000000"
+
+type Entry struct {
+	Time time.Time `json:"time"`
+	Room string    `json:"room"`
+	Kind Kind      `json:"kind"`
+	User string    `json:"user"`
+	Text string    `json:"text,omitempty"`
+}
+
+func (e Entry) String() string {
+	timestamp := e.Time.Local().Format(time.DateTime)
+	switch e.Kind {
+	case JOIN:
+		return fmt.Sprintf("%s * %s has entered the room", timestamp, e.User)
+	case LEAVE:
+		return fmt.Sprintf("%s * %s has left the room", timestamp, e.User)
+	default:
+		return fmt.Sprintf("%s [%s] %s", timestamp, e.User, e.Text)
+	}
+}
+
+// Writer appends entries of a single room, it starts a new file every day or when the current file reaches MaxSize.
+type Writer struct {
+	Dir     string
+	Room    string
+	MaxSize int64
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func NewWriter(dir, room string, maxSize int64) (*Writer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Writer{Dir: dir, Room: room, MaxSize: maxSize}, nil
+}
+
+// Append accepts an Entry, stamps it with the room and the current time when it has none and writes it.
+func (w *Writer) Append(e Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Room = w.Room
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.shouldRotate(e.Time, int64(len(data))) {
+		if err := w.rotate(e.Time); err != nil {
+			return err
+		}
+	}
+
+	n, err := w.file.Write(data)
+	w.size += int64(n)
+	return err
+}
+
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+func (w *Writer) shouldRotate(now time.Time, next int64) bool {
+	if w.file == nil {
+		return true
+	}
+	if w.MaxSize > 0 && w.size > 0 && w.size+next > w.MaxSize {
+		return true
+	}
+	y1, m1, d1 := w.opened.Date()
+	y2, m2, d2 := now.Date()
+	return y1 != y2 || m1 != m2 || d1 != d2
+}
+
+func (w *Writer) rotate(now time.Time) error {
+	if w.file != nil {
+		if err := w.file.Close(); err != nil {
+			return err
+		}
+		w.file = nil
+	}
+
+	name := fmt.Sprintf("%s-%s.jsonl", w.Room, now.UTC().Format(fileTimeLayout))
+	path := filepath.Join(w.Dir, name)
+	// Two rotations within the same microsecond would reuse the name, keep them apart with a counter.
+	for i := 1; fileExists(path); i++ {
+		path = filepath.Join(w.Dir, fmt.Sprintf("%s-%s.%d.jsonl", w.Room, now.UTC().Format(fileTimeLayout), i))
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	w.file = file
+	w.size = 0
+	w.opened = now
+	return nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Query filters transcript entries, zero fields match everything.
+// Contains is matched case insensitively against the text of messages.
+type Query struct {
+	User     string
+	Since    time.Time
+	Until    time.Time
+	Contains string
+	Limit    int
+}
+
+func (q Query) Match(e Entry) bool {
+	if q.User != "" && e.User != q.User {
+		return false
+	}
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && e.Time.After(q.Until) {
+		return false
+	}
+	if q.Contains != "" && !strings.Contains(strings.ToLower(e.Text), strings.ToLower(q.Contains)) {
+		return false
+	}
+	return true
+}
+
+// Search reads the transcripts of room in dir, oldest first, and returns the entries matching q.
+// When q.Limit is set only the newest q.Limit entries are returned.
+// Lines that can't be parsed, e.g a line cut short by a crash, are skipped.
+func Search(dir, room string, q Query) ([]Entry, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	files := make([]string, 0)
+	for _, dirEntry := range dirEntries {
+		if _, _, ok := parseFileName(room, dirEntry.Name()); ok && dirEntry.Type().IsRegular() {
+			files = append(files, filepath.Join(dir, dirEntry.Name()))
+		}
+	}
+	sortFiles(room, files)
+
+	entries := make([]Entry, 0)
+	for _, path := range files {
+		fileEntries, err := searchFile(path, room, q)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, fileEntries...)
+	}
+
+	if q.Limit > 0 && len(entries) > q.Limit {
+		entries = entries[len(entries)-q.Limit:]
+	}
+	return entries, nil
+}
+
+// sortFiles sorts the transcript files of room by their creation time and then their counter, oldest first.
+// Sorting the names doesn't do, "<time>.1.jsonl" sorts before "<time>.jsonl" and "<time>.10.jsonl" before "<time>.2.jsonl".
+func sortFiles(room string, paths []string) {
+	slices.SortStableFunc(paths, func(a, b string) int {
+		createdA, counterA, _ := parseFileName(room, a)
+		createdB, counterB, _ := parseFileName(room, b)
+		if c := strings.Compare(createdA, createdB); c != 0 {
+			return c
+		}
+		return counterA - counterB
+	})
+}
+
+// parseFileName returns the creation time of a transcript file of room, in the sortable fileTimeLayout, and its counter.
+// It reports whether path is named like a file of room, a file of the room "dev-ops" isn't one of the room "dev".
+func parseFileName(room, path string) (string, int, bool) {
+	name, ok := strings.CutPrefix(filepath.Base(path), room+"-")
+	if !ok {
+		return "", 0, false
+	}
+	if name, ok = strings.CutSuffix(name, ".jsonl"); !ok || len(name) < len(fileTimeLayout) {
+		return "", 0, false
+	}
+	created, suffix := name[:len(fileTimeLayout)], name[len(fileTimeLayout):]
+	if _, err := time.Parse(fileTimeLayout, created); err != nil {
+		return "", 0, false
+	}
+	if suffix == "" {
+		return created, 0, true
+	}
+	digits, ok := strings.CutPrefix(suffix, ".")
+	if !ok || digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return "", 0, false
+	}
+	counter, err := strconv.Atoi(digits)
+	if err != nil {
+		return "", 0, false
+	}
+	return created, counter, true
+}
+
+func searchFile(path, room string, q Query) ([]Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make([]Entry, 0)
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) != 0 {
+			var e Entry
+			if json.Unmarshal(line, &e) == nil && e.Room == room && q.Match(e) {
+				entries = append(entries, e)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,114 @@
+package transcript
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriterRotatesAndSearches(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(dir, "lobby", 150)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2024, 5, 1, 23, 59, 0, 0, time.Local)
+	entries := []Entry{
+		{Time: start, Kind: JOIN, User: "alice"},
+		{Time: start.Add(time.Second), Kind: MESSAGE, User: "alice", Text: "Hello bob"},
+		{Time: start.Add(2 * time.Minute), Kind: MESSAGE, User: "bob", Text: "hi alice"},
+		{Time: start.Add(3 * time.Minute), Kind: LEAVE, User: "alice"},
+	}
+	for _, e := range entries {
+		if err := w.Append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "lobby-*.jsonl"))
+	if len(files) < 2 {
+		t.Errorf("expected the writer to rotate by size and day, got %d files", len(files))
+	}
+
+	tests := []struct {
+		name string
+		q    Query
+		want int
+	}{
+		{"all", Query{}, 4},
+		{"user", Query{User: "alice"}, 3},
+		{"substring", Query{Contains: "HELLO"}, 1},
+		{"since", Query{Since: start.Add(time.Minute)}, 2},
+		{"until", Query{Until: start.Add(time.Second)}, 2},
+		{"limit", Query{Limit: 1}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Search(dir, "lobby", tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != tt.want {
+				t.Errorf("got %d entries, want %d: %v", len(got), tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSearchOrdersRotationsWithinAMicrosecond(t *testing.T) {
+	dir := t.TempDir()
+	// Every entry gets a file of its own, all of them created at the same time.
+	w, err := NewWriter(dir, "lobby", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 12; i++ {
+		if err := w.Append(Entry{Time: now, Kind: MESSAGE, User: "alice", Text: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	got, err := Search(dir, "lobby", Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, e := range got {
+		if e.Text != fmt.Sprint(i) {
+			t.Fatalf("entry %d is %q, want the entries in the order they were written", i, e.Text)
+		}
+	}
+	if len(got) != 12 {
+		t.Errorf("got %d entries, want 12", len(got))
+	}
+}
+
+func TestParseFileNameMatchesOnlyTheRoom(t *testing.T) {
+	tests := []struct {
+		name    string
+		created string
+		counter int
+		ok      bool
+	}{
+		{"dev-20240501T120000.000000.jsonl", "20240501T120000.000000", 0, true},
+		{"dev-20240501T120000.000000.12.jsonl", "20240501T120000.000000", 12, true},
+		{"dev-ops-20240501T120000.000000.jsonl", "", 0, false},
+		{"dev-20240501T120000.000000.x.jsonl", "", 0, false},
+		{"dev-20240501T120000.000000.-1.jsonl", "", 0, false},
+		{"dev-20240501T120000.000000.json", "", 0, false},
+		{"dev-notes.jsonl", "", 0, false},
+		{"devops-20240501T120000.000000.jsonl", "", 0, false},
+	}
+	for _, tt := range tests {
+		created, counter, ok := parseFileName("dev", filepath.Join("transcripts", tt.name))
+		if created != tt.created || counter != tt.counter || ok != tt.ok {
+			t.Errorf("parseFileName(%q) = %q, %d, %v, want %q, %d, %v", tt.name, created, counter, ok, tt.created, tt.counter, tt.ok)
+		}
+	}
+}
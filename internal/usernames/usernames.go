@@ -0,0 +1,167 @@
+// Package usernames decides which budgetchat usernames are valid, it is shared between the chat server
+// and the chatadmin cmd so every registered account can log in.
+package usernames
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	ErrEmpty           = errors.New("Invalid Username - Must not be empty")
+	ErrInvalidEncoding = errors.New("Invalid Username - Must be valid UTF-8")
+	ErrMixedScripts    = errors.New("Invalid Username - Must not mix letters from different scripts")
+)
+
+// Policy decides which usernames are accepted at the welcome prompt.
+// The zero value only accepts ASCII letters and numbers with no length limit.
+type Policy struct {
+	MinLength int
+	MaxLength int
+	// AllowUnicode accepts any Unicode letter or number, names are normalised to NFC
+	// and must not mix scripts, e.g latin and cyrillic letters.
+	AllowUnicode bool
+	Reserved     []string
+}
+
+func DefaultPolicy() *Policy {
+	return &Policy{
+		MinLength: 1,
+		MaxLength: 32,
+	}
+}
+
+// Verify accepts the raw line received at the welcome prompt and returns the username to use.
+// The returned error is a message meant to be sent to the client as is.
+// taken is a list of names that can't be impersonated, e.g registered accounts, names
+// that are equal to one of them are accepted but names that only look the same are not.
+func (p *Policy) Verify(line []byte, taken []string) (string, error) {
+	if !utf8.Valid(line) {
+		return "", ErrInvalidEncoding
+	}
+
+	username := string(line)
+	if p.AllowUnicode {
+		username = norm.NFC.String(username)
+	}
+
+	length := utf8.RuneCountInString(username)
+	if length == 0 {
+		return "", ErrEmpty
+	}
+	if length < p.MinLength {
+		return "", fmt.Errorf("Invalid Username - Must be at least %d characters long", p.MinLength)
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return "", fmt.Errorf("Invalid Username - Must be at most %d characters long", p.MaxLength)
+	}
+
+	for _, char := range username {
+		if !p.validChar(char) {
+			return "", fmt.Errorf("Invalid Username - %q is not allowed, use only letters and numbers", char)
+		}
+	}
+
+	if p.AllowUnicode && mixesScripts(username) {
+		return "", ErrMixedScripts
+	}
+
+	skeleton := usernameSkeleton(username)
+	for _, reserved := range p.Reserved {
+		if strings.EqualFold(username, reserved) || skeleton == usernameSkeleton(reserved) {
+			return "", fmt.Errorf("Invalid Username - %s is reserved", username)
+		}
+	}
+
+	for _, name := range taken {
+		if username != name && skeleton == usernameSkeleton(name) {
+			return "", fmt.Errorf("Invalid Username - %s looks too similar to %s", username, name)
+		}
+	}
+
+	return username, nil
+}
+
+func (p *Policy) validChar(char rune) bool {
+	if char >= 'A' && char <= 'Z' || char >= 'a' && char <= 'z' || char >= '0' && char <= '9' {
+		return true
+	}
+	return p.AllowUnicode && (unicode.IsLetter(char) || unicode.IsDigit(char) || unicode.Is(unicode.Mn, char))
+}
+
+// confusables maps characters to the ascii character they are commonly mistaken for.
+// It covers the latin look-alikes from the cyrillic and greek alphabets as well as digits that look like letters.
+var confusables = map[rune]rune{
+	'0': 'o', '1': 'l', 'i': 'l', '5': 's', '8': 'b',
+	// cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o',
+	'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'ѕ': 's', 'і': 'l', 'ј': 'j',
+	'ԁ': 'd', 'ɡ': 'g', 'һ': 'h', 'ӏ': 'l', 'ԛ': 'q', 'ԝ': 'w',
+	// greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'l', 'κ': 'k', 'ν': 'v', 'ο': 'o',
+	'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x', 'γ': 'y',
+}
+
+// usernameSkeleton returns a case folded form of username where every confusable character
+// is replaced by its ascii look-alike, two names with the same skeleton are visually confusable.
+func usernameSkeleton(username string) string {
+	var skeleton strings.Builder
+	for _, char := range norm.NFKD.String(username) {
+		if unicode.Is(unicode.Mn, char) {
+			continue
+		}
+		char = unicode.ToLower(char)
+		if ascii, ok := confusables[char]; ok {
+			char = ascii
+		}
+		skeleton.WriteRune(char)
+	}
+	return skeleton.String()
+}
+
+// scriptGroups are scripts that are commonly written together and don't count as mixing.
+var scriptGroups = map[string]string{
+	"Han":      "Japanese",
+	"Hiragana": "Japanese",
+	"Katakana": "Japanese",
+}
+
+// mixesScripts reports whether the letters of username belong to more than one script.
+// Digits and combining marks are shared between all scripts and are ignored.
+func mixesScripts(username string) bool {
+	found := ""
+	for _, char := range username {
+		if !unicode.IsLetter(char) {
+			continue
+		}
+
+		script := scriptOf(char)
+		if group, ok := scriptGroups[script]; ok {
+			script = group
+		}
+
+		if found == "" {
+			found = script
+		} else if found != script {
+			return true
+		}
+	}
+	return false
+}
+
+func scriptOf(char rune) string {
+	if char < utf8.RuneSelf {
+		return "Latin"
+	}
+	for name, table := range unicode.Scripts {
+		if unicode.Is(table, char) {
+			return name
+		}
+	}
+	return ""
+}
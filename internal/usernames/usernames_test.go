@@ -0,0 +1,52 @@
+package usernames
+
+import "testing"
+
+func TestPolicy(t *testing.T) {
+	ascii := DefaultPolicy()
+	ascii.MaxLength = 8
+	ascii.Reserved = []string{"admin"}
+
+	unicodePolicy := DefaultPolicy()
+	unicodePolicy.AllowUnicode = true
+
+	tests := []struct {
+		name     string
+		policy   *Policy
+		input    string
+		taken    []string
+		want     string
+		wantFail bool
+	}{
+		{"plain", ascii, "bob42", nil, "bob42", false},
+		{"empty", ascii, "", nil, "", true},
+		{"too long", ascii, "abcdefghi", nil, "", true},
+		{"space", ascii, "bo b", nil, "", true},
+		{"non ascii", ascii, "josé", nil, "", true},
+		{"reserved", ascii, "Admin", nil, "", true},
+		{"reserved look-alike", ascii, "adm1n", nil, "", true},
+		{"registered", ascii, "alice", []string{"alice"}, "alice", false},
+		{"registered look-alike", ascii, "AIice", []string{"alice"}, "", true},
+		{"unicode", unicodePolicy, "josé", nil, "josé", false},
+		{"unicode nfc", unicodePolicy, "jose\u0301", nil, "jos\u00e9", false},
+		{"unicode mixed scripts", unicodePolicy, "pаypal", nil, "", true},
+		{"unicode cyrillic look-alike", unicodePolicy, "аlice", []string{"alice"}, "", true},
+		{"unicode japanese", unicodePolicy, "山田たろう", nil, "山田たろう", false},
+		{"invalid utf8", unicodePolicy, "\xff", nil, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.policy.Verify([]byte(tt.input), tt.taken)
+			if tt.wantFail {
+				if err == nil {
+					t.Errorf("Verify(%q) = %q, want an error", tt.input, got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("Verify(%q) = %q, %v, want %q", tt.input, got, err, tt.want)
+			}
+		})
+	}
+}
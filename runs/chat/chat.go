@@ -3,76 +3,417 @@ package main
 import (
 	"bufio"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/dorimon-1/protohackers/internal/accounts"
+	"github.com/dorimon-1/protohackers/internal/transcript"
+	"github.com/dorimon-1/protohackers/internal/usernames"
 )
 
 const (
-	WELCOME_MESSAGE = "Welcome to budgetchat! What shall I call you?"
-	ERROR_MESSAGE   = "Invalid Username - Must consist only alphabetical chars and numbers"
-	BLUE_COLOR      = "\033[34m"
-	RESET_COLOR     = "\033[0m"
+	WELCOME_MESSAGE  = "Welcome to budgetchat! What shall I call you?"
+	PASSWORD_PROMPT  = "%s is a registered name, what is the password?"
+	AUTH_ERROR       = "Wrong password"
+	NAME_TAKEN_ERROR = "Invalid Username - %s is already taken"
+	SEARCH_COMMAND   = "/search"
+	SEARCH_LIMIT     = 10
+	SEARCH_SLOTS     = 4
+	SEARCH_WAIT      = "* Searching too often, try again in a moment"
+	SEARCH_BUSY      = "* Too many searches, try again in a moment"
+	BLUE_COLOR       = "\033[34m"
+	RESET_COLOR      = "\033[0m"
 )
 
 type Session struct {
-	Id          int
-	Username    string
-	Conn        net.Conn
+	Id       int
+	Username string
+	Conn     net.Conn
+	Server   *Server
+	// Joined is set while the session is in the room, it is written by the MessageListener under the server lock.
+	Joined      bool
 	MsgChan     chan Message
 	ConnectChan chan int
 	QuitChan    chan int
+	// lastSearch is when the session last searched the transcript, it is only accessed by its connection.
+	lastSearch time.Time
 }
 
+// usernamePolicy is the policy used by HandleConnection, it is configured by flags in main.
+var usernamePolicy = usernames.DefaultPolicy()
+
+// accountStore holds the registered usernames, it is nil when running without an accounts file.
+// Unregistered usernames never require a password.
+var accountStore *accounts.Store
+
+// searchEnabled allows clients to search the transcript with the SEARCH_COMMAND, once every searchInterval and
+// no more than SEARCH_SLOTS at a time as every search reads the whole transcript.
+var (
+	searchEnabled  bool
+	searchInterval time.Duration
+	searchSlots    = make(chan struct{}, SEARCH_SLOTS)
+)
+
 func main() {
-	ln, err := net.Listen("tcp", ":3000")
+	accountsPath := flag.String("accounts", "", "path to the accounts database, registered usernames require a password")
+	flag.IntVar(&usernamePolicy.MinLength, "name-min", usernamePolicy.MinLength, "minimum username length in characters")
+	flag.IntVar(&usernamePolicy.MaxLength, "name-max", usernamePolicy.MaxLength, "maximum username length in characters, 0 for no limit")
+	flag.BoolVar(&usernamePolicy.AllowUnicode, "unicode-names", false, "accept unicode letters and numbers in usernames")
+	reserved := flag.String("reserved", "", "comma separated list of usernames no client may use")
+	transcriptDir := flag.String("transcripts", "", "directory to record the room transcript in")
+	room := flag.String("room", "budgetchat", "room name used for the transcript files")
+	transcriptSize := flag.Int64("transcript-size", 10<<20, "size in bytes after which a new transcript file is started")
+	flag.BoolVar(&searchEnabled, "search", false, "allow clients to search the transcript with "+SEARCH_COMMAND)
+	flag.DurationVar(&searchInterval, "search-interval", time.Second, "how long a client has to wait between searches")
+	listenAddr := flag.String("listen", ":3000", "address to accept chat clients on")
+	node := flag.String("node", "", "name of this node in the cluster, defaults to the hostname")
+	clusterAddr := flag.String("cluster-listen", "", "address to accept peer nodes on, enables cluster mode")
+	peers := flag.String("peers", "", "comma separated list of peer node addresses to connect to")
+	flag.Parse()
+
+	if *reserved != "" {
+		usernamePolicy.Reserved = strings.Split(*reserved, ",")
+	}
+
+	if *accountsPath != "" {
+		store, err := accounts.Open(*accountsPath)
+		if err != nil {
+			log.Fatalln("Failed to open accounts database: ", err)
+		}
+		accountStore = store
+	}
+
+	if *node == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatalln("Failed to get hostname, use -node: ", err)
+		}
+		*node = hostname
+	}
+	server := NewServer(*node)
+
+	if *transcriptDir != "" {
+		writer, err := transcript.NewWriter(*transcriptDir, *room, *transcriptSize)
+		if err != nil {
+			log.Fatalln("Failed to open transcript: ", err)
+		}
+		server.Transcript = writer
+	} else if searchEnabled {
+		log.Fatalln("-search requires -transcripts")
+	}
+
+	if *clusterAddr != "" || *peers != "" {
+		cluster := NewCluster(server)
+		if *clusterAddr != "" {
+			ln, err := net.Listen("tcp", *clusterAddr)
+			if err != nil {
+				log.Fatalln("Failed to listen for peers: ", err)
+			}
+			go cluster.Serve(ln)
+		}
+		if *peers != "" {
+			for _, addr := range strings.Split(*peers, ",") {
+				go cluster.Connect(addr)
+			}
+		}
+	}
+
+	ln, err := net.Listen("tcp", *listenAddr)
 	if err != nil {
 		panic(err)
 	}
-	msgChan := make(chan Message)
-	sessions := make([]*Session, 0)
+	log.Fatalln(server.Serve(ln))
+}
+
+// Server holds the state of a single chat node.
+// Sessions are owned by the MessageListener goroutine, names and remote are shared with
+// the connections and the cluster links and are guarded by mu.
+type Server struct {
+	Node        string
+	Cluster     *Cluster
+	MsgChan     chan Message
+	ConnectChan chan int
+	QuitChan    chan int
+	RemoteChan  chan PeerMessage
+	// Transcript records the traffic of the room, it is nil when transcripts are disabled.
+	Transcript *transcript.Writer
+
+	mu       sync.Mutex
+	sessions []*Session
+	// names are the usernames taken by local sessions, names that are still being claimed in the cluster are false.
+	names map[string]bool
+	// remote maps the usernames of members connected to other nodes to their node.
+	remote map[string]string
+}
+
+func NewServer(node string) *Server {
+	return &Server{
+		Node:        node,
+		MsgChan:     make(chan Message),
+		ConnectChan: make(chan int),
+		QuitChan:    make(chan int),
+		RemoteChan:  make(chan PeerMessage),
+		sessions:    make([]*Session, 0),
+		names:       make(map[string]bool),
+		remote:      make(map[string]string),
+	}
+}
+
+// Serve accepts chat clients on ln until it fails.
+func (srv *Server) Serve(ln net.Listener) error {
+	go srv.MessageListener()
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
 			log.Println(err)
 			continue
 		}
 
-		connectChan := make(chan int)
-		quitChan := make(chan int)
-
-		session := NewSession(conn, len(sessions), msgChan, connectChan, quitChan)
-		sessions = append(sessions, session)
-
-		go MessageListener(&sessions, msgChan, connectChan, quitChan)
-		go session.HandleConnection(msgChan)
+		srv.mu.Lock()
+		session := NewSession(conn, len(srv.sessions), srv)
+		srv.sessions = append(srv.sessions, session)
+		srv.mu.Unlock()
 
+		go session.HandleConnection(srv.MsgChan)
 	}
 }
 
-func MessageListener(sessions *[]*Session, msgChan chan Message, connectChan chan int, quitChan chan int) {
+func (srv *Server) MessageListener() {
 	for {
 		select {
-		case msg := <-msgChan:
+		case msg := <-srv.MsgChan:
 			log.Println("Received MSG from ", msg.Sender.Username)
-			HandleMessage(*sessions, &msg)
-		case connectId := <-connectChan:
-			log.Println("Received Connect MSG", (*sessions)[connectId].Username)
-			SendConnectMessage((*sessions)[connectId], *sessions)
-		case quitId := <-quitChan:
-			log.Println("Received Quit MSG", (*sessions)[quitId].Username)
-			SendQuitMessage((*sessions)[quitId], *sessions)
-			(*sessions)[quitId] = nil
+			HandleMessage(srv.Sessions(), &msg)
+			srv.publish(PeerMessage{Type: PEER_MESSAGE, User: msg.Sender.Username, Text: msg.Text})
+			srv.recordTranscript(transcript.MESSAGE, msg.Sender.Username, msg.Text)
+		case connectId := <-srv.ConnectChan:
+			session := srv.Session(connectId)
+			log.Println("Received Connect MSG", session.Username)
+			SendConnectMessage(session, srv.Sessions(), srv.RemoteMembers())
+			srv.setJoined(session, true)
+			srv.publish(PeerMessage{Type: PEER_JOIN, User: session.Username})
+			srv.recordTranscript(transcript.JOIN, session.Username, "")
+		case quitId := <-srv.QuitChan:
+			session := srv.Session(quitId)
+			log.Println("Received Quit MSG", session.Username)
+			srv.setJoined(session, false)
+			SendQuitMessage(session, srv.Sessions())
+			srv.publish(PeerMessage{Type: PEER_LEAVE, User: session.Username})
+			srv.recordTranscript(transcript.LEAVE, session.Username, "")
+			srv.closeSession(session)
+		case msg := <-srv.RemoteChan:
+			srv.HandleRemoteMessage(msg)
+		}
+	}
+}
+
+// HandleRemoteMessage relays an event received from another node of the cluster to the local sessions.
+func (srv *Server) HandleRemoteMessage(msg PeerMessage) {
+	sessions := srv.Sessions()
+
+	switch msg.Type {
+	case PEER_MESSAGE:
+		BroadcastMessage(nil, sessions, fmt.Sprintf("[%s] %s", msg.User, msg.Text))
+		srv.recordTranscript(transcript.MESSAGE, msg.User, msg.Text)
+	case PEER_JOIN:
+		if !srv.addRemote(msg.User, msg.Node) {
+			return
 		}
+		BroadcastMessage(nil, sessions, fmt.Sprintf("* %s has entered the room", msg.User))
+		srv.recordTranscript(transcript.JOIN, msg.User, "")
+	case PEER_LEAVE:
+		if !srv.removeRemote(msg.User, msg.Node) {
+			return
+		}
+		BroadcastMessage(nil, sessions, fmt.Sprintf("* %s has left the room", msg.User))
+		srv.recordTranscript(transcript.LEAVE, msg.User, "")
+	case PEER_MEMBERS:
+		// A new link starts with every member of the node, whoever isn't among them left while the link was down or replaced.
+		for _, username := range srv.remoteMembersOf(msg.Node) {
+			if !slices.Contains(msg.Users, username) {
+				srv.HandleRemoteMessage(PeerMessage{Type: PEER_LEAVE, Node: msg.Node, User: username})
+			}
+		}
+		for _, username := range msg.Users {
+			srv.HandleRemoteMessage(PeerMessage{Type: PEER_JOIN, Node: msg.Node, User: username})
+		}
+	case PEER_DOWN:
+		for _, username := range srv.remoteMembersOf(msg.Node) {
+			srv.HandleRemoteMessage(PeerMessage{Type: PEER_LEAVE, Node: msg.Node, User: username})
+		}
+	}
+}
+
+func (srv *Server) publish(msg PeerMessage) {
+	if srv.Cluster != nil {
+		srv.Cluster.Publish(msg)
 	}
 }
 
+// Session returns the session with the given id.
+func (srv *Server) Session(id int) *Session {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.sessions[id]
+}
+
+// Sessions returns a snapshot of the sessions, closed sessions are nil.
+func (srv *Server) Sessions() []*Session {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return slices.Clone(srv.sessions)
+}
+
+// ClaimUsername reserves username for a local session.
+// In cluster mode every other node has to agree that the name is free.
+func (srv *Server) ClaimUsername(username string) bool {
+	if !srv.reserveUsername(username) {
+		return false
+	}
+
+	if srv.Cluster != nil && !srv.Cluster.Claim(username) {
+		srv.ReleaseUsername(username)
+		return false
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.names[username] = true
+	return true
+}
+
+func (srv *Server) reserveUsername(username string) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if !srv.usernameFree(username) {
+		return false
+	}
+	srv.names[username] = false
+	return true
+}
+
+func (srv *Server) usernameFree(username string) bool {
+	_, isLocal := srv.names[username]
+	_, isRemote := srv.remote[username]
+	return !isLocal && !isRemote
+}
+
+func (srv *Server) ReleaseUsername(username string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	delete(srv.names, username)
+}
+
+// LocalMembers returns the usernames of the sessions that joined the room on this node.
+func (srv *Server) LocalMembers() []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	members := make([]string, 0)
+	for _, session := range srv.sessions {
+		if session != nil && session.Joined {
+			members = append(members, session.Username)
+		}
+	}
+	return members
+}
+
+// setJoined is guarded by the server lock as Joined is read by LocalMembers.
+// It is set before the join or the leave is published, so the members sent to a new link agree with the events that follow.
+func (srv *Server) setJoined(s *Session, joined bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	s.Joined = joined
+}
+
+// RemoteMembers returns the usernames of the members connected to other nodes.
+func (srv *Server) RemoteMembers() []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	members := make([]string, 0, len(srv.remote))
+	for username := range srv.remote {
+		members = append(members, username)
+	}
+	sort.Strings(members)
+	return members
+}
+
+func (srv *Server) remoteMembersOf(node string) []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	members := make([]string, 0)
+	for username, owner := range srv.remote {
+		if owner == node {
+			members = append(members, username)
+		}
+	}
+	return members
+}
+
+// addRemote reports whether username is a new remote member.
+func (srv *Server) addRemote(username, node string) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if _, ok := srv.remote[username]; ok {
+		return false
+	}
+	srv.remote[username] = node
+	return true
+}
+
+func (srv *Server) removeRemote(username, node string) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.remote[username] != node {
+		return false
+	}
+	delete(srv.remote, username)
+	return true
+}
+
+func (srv *Server) closeSession(s *Session) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.sessions[s.Id] = nil
+	if s.Username != "" {
+		delete(srv.names, s.Username)
+	}
+}
+
+func (srv *Server) recordTranscript(kind transcript.Kind, username, text string) {
+	if srv.Transcript == nil {
+		return
+	}
+
+	entry := transcript.Entry{Kind: kind, User: username, Text: text}
+	if err := srv.Transcript.Append(entry); err != nil {
+		log.Println("Failed to record transcript: ", err)
+	}
+}
+
+// BroadcastMessage sends msg to every session in the room except s, s is nil for messages from other nodes.
 func BroadcastMessage(s *Session, sessions []*Session, msg string) {
 	for i := 0; i < len(sessions); i++ {
 		if sessions[i] != nil {
-			if i != s.Id && sessions[i].Username != "" {
+			if (s == nil || i != s.Id) && sessions[i].Joined {
 				SendLine(sessions[i].Conn, msg)
 			}
 		}
@@ -90,15 +431,19 @@ func SendQuitMessage(s *Session, sessions []*Session) {
 	BroadcastMessage(s, sessions, fmt.Sprintf("* %s has left the room", s.Username))
 }
 
-func SendConnectMessage(s *Session, sessions []*Session) {
+// SendConnectMessage accepts the joining session, the local sessions and the members connected to other nodes.
+func SendConnectMessage(s *Session, sessions []*Session, remoteMembers []string) {
 	usernamesString := ""
 	for i := 0; i < len(sessions); i++ {
 		if sessions[i] != nil {
-			if i != s.Id && sessions[i].Username != "" {
+			if i != s.Id && sessions[i].Joined {
 				usernamesString = fmt.Sprintf("%s%s, ", usernamesString, sessions[i].Username)
 			}
 		}
 	}
+	for _, username := range remoteMembers {
+		usernamesString = fmt.Sprintf("%s%s, ", usernamesString, username)
+	}
 	connectMessage := fmt.Sprintf("* The room contains: %s", strings.TrimSuffix(usernamesString, ", "))
 	SendLine(s.Conn, connectMessage)
 
@@ -109,29 +454,33 @@ func HandleMessage(sessions []*Session, msg *Message) {
 	BroadcastMessage(msg.Sender, sessions, string(msg.Msg))
 }
 
-func NewSession(conn net.Conn, id int, msgChan chan Message, connectChan chan int, quitChan chan int) *Session {
+func NewSession(conn net.Conn, id int, server *Server) *Session {
 	return &Session{
 		Conn:        conn,
 		Id:          id,
-		MsgChan:     msgChan,
-		ConnectChan: connectChan,
-		QuitChan:    quitChan,
+		Server:      server,
+		MsgChan:     server.MsgChan,
+		ConnectChan: server.ConnectChan,
+		QuitChan:    server.QuitChan,
 	}
 }
 
 type Message struct {
 	Msg    []byte
+	Text   string
 	Sender *Session
 }
 
-func NewMessage(sender *Session, msg []byte) *Message {
-	return &Message{Sender: sender, Msg: msg}
+func NewMessage(sender *Session, msg []byte, text string) *Message {
+	return &Message{Sender: sender, Msg: msg, Text: text}
 }
 func (s *Session) HandleConnection(msgChan chan Message) {
 	defer func() {
 		log.Println("Closing connection from: ", s.Conn.RemoteAddr().String())
 		if s.Username != "" {
 			s.QuitChan <- s.Id
+		} else {
+			s.Server.closeSession(s)
 		}
 		s.Conn.Close()
 	}()
@@ -145,13 +494,28 @@ func (s *Session) HandleConnection(msgChan chan Message) {
 		return
 	}
 
-	username, err := verifyUsername(line)
+	var registered []string
+	if accountStore != nil {
+		registered = accountStore.Usernames()
+	}
+
+	username, err := usernamePolicy.Verify(line, registered)
 	if err != nil {
-		log.Println("Bad Username")
-		SendLine(s.Conn, ERROR_MESSAGE)
+		log.Println("Bad Username: ", err)
+		SendLine(s.Conn, err.Error())
+		return
+	}
+
+	if !s.authenticate(reader, username) {
 		return
 	}
-	s.Username = username
+
+	if !s.Server.ClaimUsername(username) {
+		log.Printf("%s tried to use the taken name %s", s.Conn.RemoteAddr().String(), username)
+		SendLine(s.Conn, fmt.Sprintf(NAME_TAKEN_ERROR, username))
+		return
+	}
+	s.setUsername(username)
 
 	log.Printf("%s has set his name to %s", s.Conn.RemoteAddr().String(), username)
 
@@ -162,24 +526,89 @@ func (s *Session) HandleConnection(msgChan chan Message) {
 		if err != nil {
 			return
 		}
+		if searchEnabled && isSearchCommand(string(message)) {
+			s.Search(strings.TrimSpace(strings.TrimPrefix(string(message), SEARCH_COMMAND)))
+			continue
+		}
 		s.SendChatMessage(string(message))
 
 	}
 }
 
+// setUsername is guarded by the server lock as the username is read by LocalMembers.
+func (s *Session) setUsername(username string) {
+	s.Server.mu.Lock()
+	defer s.Server.mu.Unlock()
+	s.Username = username
+}
+
 func (s *Session) SendChatMessage(msg string) {
 	msgStr := fmt.Sprintf("[%s] %s", s.Username, msg)
-	message := NewMessage(s, []byte(msgStr))
+	message := NewMessage(s, []byte(msgStr), msg)
 	log.Println(msgStr)
 	s.MsgChan <- *message
 }
 
-func verifyUsername(username []byte) (string, error) {
-	for _, char := range username {
-		if char >= 65 && char <= 90 || char >= 97 && char <= 122 || char >= 48 && char <= 57 {
-			continue
-		}
-		return "", errors.New("Invalid Charachter")
+// authenticate asks for a password when username is a registered account.
+// It reports whether the client may continue with the given username.
+func (s *Session) authenticate(reader *bufio.Reader, username string) bool {
+	if accountStore == nil || !accountStore.Registered(username) {
+		return true
+	}
+
+	SendLine(s.Conn, fmt.Sprintf(PASSWORD_PROMPT, username))
+	password, _, err := reader.ReadLine()
+	if err != nil {
+		log.Println("Couldn't read password: ", err)
+		return false
+	}
+
+	if !accountStore.Authenticate(username, string(password)) {
+		log.Printf("%s failed to authenticate as %s", s.Conn.RemoteAddr().String(), username)
+		SendLine(s.Conn, AUTH_ERROR)
+		return false
+	}
+	return true
+}
+
+func isSearchCommand(msg string) bool {
+	return msg == SEARCH_COMMAND || strings.HasPrefix(msg, SEARCH_COMMAND+" ")
+}
+
+// Search answers a SEARCH_COMMAND, it sends the newest transcript entries matching query only to s.
+// query is a substring to look for, optionally preceded by "from:<username>".
+func (s *Session) Search(query string) {
+	now := time.Now()
+	if now.Sub(s.lastSearch) < searchInterval {
+		SendLine(s.Conn, SEARCH_WAIT)
+		return
+	}
+	s.lastSearch = now
+	select {
+	case searchSlots <- struct{}{}:
+		defer func() { <-searchSlots }()
+	default:
+		SendLine(s.Conn, SEARCH_BUSY)
+		return
+	}
+
+	q := transcript.Query{Limit: SEARCH_LIMIT}
+	if strings.HasPrefix(query, "from:") {
+		from, rest, _ := strings.Cut(strings.TrimPrefix(query, "from:"), " ")
+		q.User = from
+		query = strings.TrimSpace(rest)
+	}
+	q.Contains = query
+
+	entries, err := transcript.Search(s.Server.Transcript.Dir, s.Server.Transcript.Room, q)
+	if err != nil {
+		log.Println("Failed to search transcript: ", err)
+		SendLine(s.Conn, "* Search failed")
+		return
+	}
+
+	SendLine(s.Conn, fmt.Sprintf("* %d results for %q", len(entries), query))
+	for _, entry := range entries {
+		SendLine(s.Conn, "* "+entry.String())
 	}
-	return string(username), nil
 }
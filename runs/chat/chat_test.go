@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dorimon-1/protohackers/internal/accounts"
+	"github.com/dorimon-1/protohackers/internal/transcript"
+)
+
+// startRecordedServer starts a server that records its transcript to a temporary directory, with search enabled.
+func startRecordedServer(t *testing.T, interval time.Duration) (string, *transcript.Writer) {
+	t.Helper()
+	writer, err := transcript.NewWriter(t.TempDir(), "test", 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	searchEnabled, searchInterval = true, interval
+	t.Cleanup(func() { searchEnabled, searchInterval = false, 0 })
+
+	server := NewServer("test")
+	server.Transcript = writer
+	ln := listen(t)
+	go server.Serve(ln)
+	return ln.Addr().String(), writer
+}
+
+// waitTranscript waits until the transcript holds want, in order.
+func waitTranscript(t *testing.T, writer *transcript.Writer, want []string) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		entries, err := transcript.Search(writer.Dir, writer.Room, transcript.Query{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, len(entries))
+		for i, e := range entries {
+			got[i] = fmt.Sprintf("%s %s %s", e.Kind, e.User, e.Text)
+		}
+		if strings.Join(got, "\n") == strings.Join(want, "\n") {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("transcript is %q, want %q", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMessageListenerRecordsTranscript(t *testing.T) {
+	addr, writer := startRecordedServer(t, 0)
+
+	alice := dialChat(t, addr, "alice")
+	alice.expect("* The room contains: ")
+	bob := dialChat(t, addr, "bob")
+	bob.expect("* The room contains: alice")
+	alice.expect("* bob has entered the room")
+	alice.send("hello bob")
+	bob.expect("[alice] hello bob")
+	bob.conn.Close()
+	alice.expect("* bob has left the room")
+	alice.conn.Close()
+
+	waitTranscript(t, writer, []string{
+		"join alice ",
+		"join bob ",
+		"message alice hello bob",
+		"leave bob ",
+		"leave alice ",
+	})
+}
+
+func TestSearchAnswersOnlyTheSearcher(t *testing.T) {
+	addr, writer := startRecordedServer(t, time.Hour)
+
+	alice := dialChat(t, addr, "alice")
+	alice.expect("* The room contains: ")
+	bob := dialChat(t, addr, "bob")
+	bob.expect("* The room contains: alice")
+	alice.expect("* bob has entered the room")
+	alice.send("hello bob")
+	bob.expect("[alice] hello bob")
+	bob.send("hi alice")
+	alice.expect("[bob] hi alice")
+	waitTranscript(t, writer, []string{"join alice ", "join bob ", "message alice hello bob", "message bob hi alice"})
+
+	bob.send("/search from:alice HELLO")
+	bob.expect(`* 1 results for "HELLO"`)
+	if got := bob.readLine(); !strings.HasSuffix(got, " [alice] hello bob") {
+		t.Errorf("search result = %q", got)
+	}
+	bob.send("/search hi")
+	bob.expect(SEARCH_WAIT)
+
+	// Nothing of the searches reached alice, the next line she reads is the next chat message.
+	bob.send("bye")
+	alice.expect("[bob] bye")
+}
+
+func TestHandleConnectionAuthenticates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	store, err := accounts.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	accountStore = store
+	t.Cleanup(func() { accountStore = nil })
+
+	ln := listen(t)
+	go NewServer("test").Serve(ln)
+	addr := ln.Addr().String()
+
+	wrong := dialChat(t, addr, "alice")
+	wrong.expect(fmt.Sprintf(PASSWORD_PROMPT, "alice"))
+	wrong.send("guess")
+	wrong.expect(AUTH_ERROR)
+	wrong.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := wrong.reader.ReadByte(); err != io.EOF {
+		t.Errorf("read after a wrong password = %v, want EOF", err)
+	}
+
+	alice := dialChat(t, addr, "alice")
+	alice.expect(fmt.Sprintf(PASSWORD_PROMPT, "alice"))
+	alice.send("secret")
+	alice.expect("* The room contains: ")
+
+	// An unknown account needs no password, but a name that only looks like a registered one is refused.
+	bob := dialChat(t, addr, "bob")
+	bob.expect("* The room contains: alice")
+	alice.expect("* bob has entered the room")
+	impostor := dialChat(t, addr, "AIice")
+	impostor.expect("Invalid Username - AIice looks too similar to alice")
+
+	// carol is registered by another process, e.g chatadmin, while the server is running.
+	admin, err := accounts.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.Add("carol", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	carol := dialChat(t, addr, "carol")
+	carol.expect(fmt.Sprintf(PASSWORD_PROMPT, "carol"))
+	carol.send("hunter2")
+	carol.expect("* The room contains: alice, bob")
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	PEER_HELLO       = "hello"
+	PEER_MEMBERS     = "members"
+	PEER_JOIN        = "join"
+	PEER_LEAVE       = "leave"
+	PEER_MESSAGE     = "message"
+	PEER_CLAIM       = "claim"
+	PEER_CLAIM_REPLY = "claim-reply"
+	// PEER_DOWN is never sent over a link, it is queued to the server when the link to a node is lost.
+	PEER_DOWN = "down"
+
+	CLAIM_TIMEOUT     = 2 * time.Second
+	RECONNECT_DELAY   = time.Second
+	PEER_SEND_BACKLOG = 1024
+)
+
+// PeerMessage is a single line of JSON exchanged between the nodes of a cluster.
+type PeerMessage struct {
+	Type  string   `json:"type"`
+	Node  string   `json:"node"`
+	User  string   `json:"user,omitempty"`
+	Text  string   `json:"text,omitempty"`
+	Users []string `json:"users,omitempty"`
+	Id    uint64   `json:"id,omitempty"`
+	Ok    bool     `json:"ok,omitempty"`
+}
+
+// Cluster federates a Server with other nodes, every pair of nodes shares a single TCP link.
+// Events of local sessions are published to every linked node, which relays them to its own sessions.
+// Nothing is forwarded, so every node has to be linked to every other node.
+type Cluster struct {
+	Server *Server
+
+	mu     sync.Mutex
+	links  map[string]*peerLink
+	claims map[uint64]chan bool
+	nextId uint64
+}
+
+type peerLink struct {
+	Node string
+	// Dialer is the name of the node that opened the connection, it decides which link survives
+	// when two nodes connect to each other at the same time.
+	Dialer string
+	Conn   net.Conn
+	Out    chan PeerMessage
+	// Done is closed once the link stopped relaying the events of its node.
+	Done chan struct{}
+}
+
+func NewCluster(server *Server) *Cluster {
+	c := &Cluster{
+		Server: server,
+		links:  make(map[string]*peerLink),
+		claims: make(map[uint64]chan bool),
+	}
+	server.Cluster = c
+	return c
+}
+
+// Serve accepts links from other nodes on ln.
+func (c *Cluster) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Println("Error accepting peer: ", err)
+			continue
+		}
+
+		go c.handleLink(conn, false)
+	}
+}
+
+// Connect keeps a link to the node at addr, reconnecting whenever it is lost.
+func (c *Cluster) Connect(addr string) {
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			log.Printf("Failed to connect to peer %s: %s", addr, err)
+		} else {
+			c.handleLink(conn, true)
+		}
+		time.Sleep(RECONNECT_DELAY)
+	}
+}
+
+// Peers returns the names of the nodes this node is currently linked to.
+func (c *Cluster) Peers() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	peers := make([]string, 0, len(c.links))
+	for node := range c.links {
+		peers = append(peers, node)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// Publish sends an event of a local session to every linked node.
+func (c *Cluster) Publish(msg PeerMessage) {
+	msg.Node = c.Server.Node
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, link := range c.links {
+		link.send(msg)
+	}
+}
+
+// Claim asks every linked node whether username is free and reports whether all of them agreed.
+// A node that doesn't answer within CLAIM_TIMEOUT counts as a refusal.
+func (c *Cluster) Claim(username string) bool {
+	c.mu.Lock()
+	c.nextId++
+	id := c.nextId
+	replies := make(chan bool, len(c.links))
+	c.claims[id] = replies
+	pending := len(c.links)
+	for _, link := range c.links {
+		link.send(PeerMessage{Type: PEER_CLAIM, Node: c.Server.Node, User: username, Id: id})
+	}
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.claims, id)
+		c.mu.Unlock()
+	}()
+
+	timeout := time.After(CLAIM_TIMEOUT)
+	for ; pending > 0; pending-- {
+		select {
+		case ok := <-replies:
+			if !ok {
+				return false
+			}
+		case <-timeout:
+			log.Printf("Claim of %s timed out", username)
+			return false
+		}
+	}
+	return true
+}
+
+// answerClaim decides whether a remote node may use username.
+// When both nodes are claiming the same name at once the node with the smaller name wins.
+func (c *Cluster) answerClaim(msg PeerMessage) bool {
+	srv := c.Server
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if _, isRemote := srv.remote[msg.User]; isRemote {
+		return false
+	}
+	if claimed, isLocal := srv.names[msg.User]; isLocal {
+		return !claimed && msg.Node < srv.Node
+	}
+	return true
+}
+
+func (c *Cluster) resolveClaim(msg PeerMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if replies, ok := c.claims[msg.Id]; ok {
+		replies <- msg.Ok
+	}
+}
+
+func (c *Cluster) handleLink(conn net.Conn, dialed bool) {
+	defer conn.Close()
+
+	encoder := json.NewEncoder(conn)
+	if err := encoder.Encode(PeerMessage{Type: PEER_HELLO, Node: c.Server.Node}); err != nil {
+		log.Println("Failed to greet peer: ", err)
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+	var hello PeerMessage
+	if err := readPeerMessage(reader, &hello); err != nil || hello.Type != PEER_HELLO {
+		log.Printf("Bad greeting from peer %s: %v", conn.RemoteAddr().String(), err)
+		return
+	}
+	if hello.Node == c.Server.Node {
+		log.Println("Refusing link to a node with our own name ", hello.Node)
+		return
+	}
+
+	link := &peerLink{
+		Node:   hello.Node,
+		Dialer: hello.Node,
+		Conn:   conn,
+		Out:    make(chan PeerMessage, PEER_SEND_BACKLOG),
+		Done:   make(chan struct{}),
+	}
+	if dialed {
+		link.Dialer = c.Server.Node
+	}
+	replaced, ok := c.register(link)
+	if !ok {
+		return
+	}
+	defer c.unregister(link)
+	// The events still relayed by the replaced link have to reach the server before the members of this one.
+	if replaced != nil {
+		<-replaced.Done
+	}
+
+	go link.writeLoop(encoder)
+	link.send(PeerMessage{Type: PEER_MEMBERS, Node: c.Server.Node, Users: c.Server.LocalMembers()})
+	log.Printf("Linked with node %s (%s)", link.Node, conn.RemoteAddr().String())
+
+	for {
+		var msg PeerMessage
+		if err := readPeerMessage(reader, &msg); err != nil {
+			log.Printf("Lost link with node %s: %s", link.Node, err)
+			return
+		}
+		msg.Node = link.Node
+
+		switch msg.Type {
+		case PEER_MEMBERS, PEER_JOIN, PEER_LEAVE, PEER_MESSAGE:
+			c.Server.RemoteChan <- msg
+		case PEER_CLAIM:
+			link.send(PeerMessage{Type: PEER_CLAIM_REPLY, Node: c.Server.Node, Id: msg.Id, Ok: c.answerClaim(msg)})
+		case PEER_CLAIM_REPLY:
+			c.resolveClaim(msg)
+		default:
+			log.Printf("Unknown message type %q from node %s", msg.Type, link.Node)
+		}
+	}
+}
+
+// register reports whether link should be used and returns the link it replaced, only one link is kept per node.
+// When two links exist the one dialed by the node with the smaller name is kept, both nodes pick the same one.
+func (c *Cluster) register(link *peerLink) (*peerLink, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	existing, ok := c.links[link.Node]
+	if ok {
+		winner := min(link.Node, c.Server.Node)
+		if existing.Dialer == winner || link.Dialer != winner {
+			return nil, false
+		}
+		existing.Conn.Close()
+	}
+
+	c.links[link.Node] = link
+	return existing, true
+}
+
+func (c *Cluster) unregister(link *peerLink) {
+	c.mu.Lock()
+	current := c.links[link.Node] == link
+	if current {
+		delete(c.links, link.Node)
+	}
+	c.mu.Unlock()
+
+	close(link.Out)
+	if current {
+		c.Server.RemoteChan <- PeerMessage{Type: PEER_DOWN, Node: link.Node}
+	}
+	close(link.Done)
+}
+
+// send queues msg without blocking, a peer that can't keep up with PEER_SEND_BACKLOG messages is disconnected.
+// Other than the link's own goroutine, callers must hold the cluster lock so it doesn't race with unregister closing Out.
+func (l *peerLink) send(msg PeerMessage) {
+	select {
+	case l.Out <- msg:
+	default:
+		log.Printf("Node %s is too slow, dropping the link", l.Node)
+		l.Conn.Close()
+	}
+}
+
+func (l *peerLink) writeLoop(encoder *json.Encoder) {
+	for msg := range l.Out {
+		if err := encoder.Encode(msg); err != nil {
+			l.Conn.Close()
+			return
+		}
+	}
+}
+
+func readPeerMessage(reader *bufio.Reader, msg *PeerMessage) error {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(line, msg)
+}
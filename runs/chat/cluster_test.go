@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testNode struct {
+	server *Server
+	addr   string
+}
+
+// waitMembers waits until the node knows about n members connected to other nodes.
+func (node testNode) waitMembers(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for len(node.server.RemoteMembers()) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s knows about %v only", node.server.Node, node.server.RemoteMembers())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startCluster starts n fully linked nodes on loopback ports.
+func startCluster(t *testing.T, n int) []testNode {
+	t.Helper()
+
+	clusters := make([]*Cluster, n)
+	nodes := make([]testNode, n)
+	peerAddrs := make([]string, n)
+	for i := range clusters {
+		server := NewServer(fmt.Sprintf("node%d", i))
+		clusters[i] = NewCluster(server)
+
+		chatLn := listen(t)
+		peerLn := listen(t)
+		go server.Serve(chatLn)
+		go clusters[i].Serve(peerLn)
+
+		nodes[i] = testNode{server: server, addr: chatLn.Addr().String()}
+		peerAddrs[i] = peerLn.Addr().String()
+		for j := 0; j < i; j++ {
+			go clusters[i].Connect(peerAddrs[j])
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, cluster := range clusters {
+		for len(cluster.Peers()) != n-1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s is linked to %v only", cluster.Server.Node, cluster.Peers())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return nodes
+}
+
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln
+}
+
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialChat(t *testing.T, addr string, username string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+	c.expect(WELCOME_MESSAGE)
+	c.send(username)
+	return c
+}
+
+func (c *testClient) send(line string) {
+	c.t.Helper()
+	if _, err := fmt.Fprintf(c.conn, "%s\n", line); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) readLine() string {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("reading line: %s", err)
+	}
+	return strings.TrimSuffix(line, "\n")
+}
+
+func (c *testClient) expect(want string) {
+	c.t.Helper()
+	if got := c.readLine(); got != want {
+		c.t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestClusterSharesRoom(t *testing.T) {
+	nodes := startCluster(t, 3)
+
+	alice := dialChat(t, nodes[0].addr, "alice")
+	alice.expect("* The room contains: ")
+	nodes[1].waitMembers(t, 1)
+
+	bob := dialChat(t, nodes[1].addr, "bob")
+	bob.expect("* The room contains: alice")
+	alice.expect("* bob has entered the room")
+	nodes[2].waitMembers(t, 2)
+
+	carol := dialChat(t, nodes[2].addr, "carol")
+	carol.expect("* The room contains: alice, bob")
+	alice.expect("* carol has entered the room")
+	bob.expect("* carol has entered the room")
+
+	bob.send("hello from node1")
+	alice.expect("[bob] hello from node1")
+	carol.expect("[bob] hello from node1")
+
+	bob.conn.Close()
+	alice.expect("* bob has left the room")
+	carol.expect("* bob has left the room")
+}
+
+func TestClusterUniqueUsernames(t *testing.T) {
+	nodes := startCluster(t, 2)
+
+	alice := dialChat(t, nodes[0].addr, "alice")
+	alice.expect("* The room contains: ")
+
+	impostor := dialChat(t, nodes[1].addr, "alice")
+	impostor.expect(fmt.Sprintf(NAME_TAKEN_ERROR, "alice"))
+
+	local := dialChat(t, nodes[0].addr, "alice")
+	local.expect(fmt.Sprintf(NAME_TAKEN_ERROR, "alice"))
+
+	alice.conn.Close()
+
+	// Once alice left the name is free again on every node.
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		again := dialChat(t, nodes[1].addr, "alice")
+		line := again.readLine()
+		if strings.HasPrefix(line, "* The room contains") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("alice is still taken: %q", line)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// linkFakePeer links c with a node named node over a pipe, the node says users are its members.
+// It returns the members c sent to the node.
+func linkFakePeer(t *testing.T, c *Cluster, dialed bool, node string, users []string) []string {
+	t.Helper()
+	conn, peer := net.Pipe()
+	t.Cleanup(func() { peer.Close() })
+	go c.handleLink(conn, dialed)
+
+	reader := bufio.NewReader(peer)
+	encoder := json.NewEncoder(peer)
+	var msg PeerMessage
+	if err := readPeerMessage(reader, &msg); err != nil || msg.Type != PEER_HELLO {
+		t.Fatalf("greeting = %+v, %v", msg, err)
+	}
+	if err := encoder.Encode(PeerMessage{Type: PEER_HELLO, Node: node}); err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.Encode(PeerMessage{Type: PEER_MEMBERS, Node: node, Users: users}); err != nil {
+		t.Fatal(err)
+	}
+	if err := readPeerMessage(reader, &msg); err != nil || msg.Type != PEER_MEMBERS {
+		t.Fatalf("members = %+v, %v", msg, err)
+	}
+	go io.Copy(io.Discard, reader)
+	return msg.Users
+}
+
+func TestClusterReplacedLinkResetsMembers(t *testing.T) {
+	server := NewServer("node0")
+	cluster := NewCluster(server)
+	ln := listen(t)
+	go server.Serve(ln)
+
+	alice := dialChat(t, ln.Addr().String(), "alice")
+	alice.expect("* The room contains: ")
+
+	if members := linkFakePeer(t, cluster, false, "node1", []string{"bob", "carol"}); !slices.Equal(members, []string{"alice"}) {
+		t.Errorf("members sent to node1 = %v, want [alice]", members)
+	}
+	alice.expect("* bob has entered the room")
+	alice.expect("* carol has entered the room")
+
+	// node0 dialing node1 replaces the link node1 dialed, bob left while they were relinking.
+	linkFakePeer(t, cluster, true, "node1", []string{"carol", "dave"})
+	alice.expect("* bob has left the room")
+	alice.expect("* dave has entered the room")
+	if members := server.RemoteMembers(); !slices.Equal(members, []string{"carol", "dave"}) {
+		t.Errorf("remote members = %v, want [carol dave]", members)
+	}
+	if peers := cluster.Peers(); !slices.Equal(peers, []string{"node1"}) {
+		t.Errorf("peers = %v, want [node1]", peers)
+	}
+}
+
+func TestLocalMembersAreJoined(t *testing.T) {
+	server := NewServer("node0")
+	server.sessions = []*Session{
+		{Id: 0, Username: "alice", Joined: true},
+		nil,
+		{Id: 2, Username: "bob"},
+		{Id: 3},
+		{Id: 4, Username: "carol", Joined: true},
+	}
+	if members := server.LocalMembers(); !slices.Equal(members, []string{"alice", "carol"}) {
+		t.Errorf("LocalMembers() = %v, want [alice carol]", members)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// AsyncWriter hands writes over to a goroutine, so logging a request never waits for the terminal or disk.
+// When the backlog is full writes are dropped, the number of dropped writes is reported once there is room again.
+type AsyncWriter struct {
+	out     io.Writer
+	lines   chan []byte
+	dropped atomic.Uint64
+}
+
+func NewAsyncWriter(out io.Writer, backlog int) *AsyncWriter {
+	w := &AsyncWriter{out: out, lines: make(chan []byte, backlog)}
+	go w.run()
+	return w
+}
+
+// Write never blocks, p is copied since the caller may reuse it.
+func (w *AsyncWriter) Write(p []byte) (int, error) {
+	select {
+	case w.lines <- append([]byte(nil), p...):
+	default:
+		w.dropped.Add(1)
+	}
+	return len(p), nil
+}
+
+func (w *AsyncWriter) run() {
+	for line := range w.lines {
+		if dropped := w.dropped.Swap(0); dropped > 0 {
+			fmt.Fprintf(w.out, "... dropped %d log lines\n", dropped)
+		}
+		w.out.Write(line)
+	}
+}
@@ -1,29 +1,55 @@
 package main
 
 import (
-	"fmt"
+	"flag"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"runtime"
 	"strings"
-)
-
-type Request int
+	"time"
 
-const (
-	INSERT Request = iota
-	RETRIEVE
+	"github.com/dorimon-1/protohackers/internal/kvstore"
 )
 
-func ReadFromBuffer(buf []byte) string {
-	for i := 0; i < len(buf); i++ {
-		if buf[i] == 0x00 {
-			return string(buf[:i])
+func main() {
+	dataDir := flag.String("data", "", "directory to persist the database in, empty keeps it in memory only")
+	snapshotInterval := flag.Duration("snapshot-interval", time.Minute, "how often the write-ahead log is compacted into a snapshot")
+	sync := flag.Bool("fsync", false, "flush every insert to stable storage before handling the next request")
+	node := flag.String("node", "", "name of this node, breaks ties between concurrent writes, defaults to the hostname")
+	replicationAddr := flag.String("replication-listen", "", "address to accept writes replicated from other nodes on")
+	replicas := flag.String("replicas", "", "comma separated list of the replication addresses of the other nodes")
+	httpAddr := flag.String("http", "", "address to serve the REST API on, empty disables it")
+	linesAddr := flag.String("tcp", "", "address to serve the line protocol on, empty disables it")
+	workers := flag.Int("workers", runtime.NumCPU(), "number of goroutines processing UDP requests")
+	watch := flag.Bool("watch", false, "let clients subscribe to key updates by inserting watch=<key> or watch=<prefix>*")
+	watchTTL := flag.Duration("watch-ttl", 5*time.Minute, "how long a subscription lasts unless it is renewed")
+	watchMax := flag.Int("watch-max", 16, "maximum number of subscriptions per client address, 0 for no limit")
+	watchClients := flag.Int("watch-clients", 10000, "maximum number of client addresses with subscriptions, 0 for no limit")
+	watchTotal := flag.Int("watch-total", 100000, "maximum number of subscriptions of all clients, 0 for no limit")
+	logBacklog := flag.Int("log-backlog", 4096, "log lines buffered for the logging goroutine, lines beyond it are dropped")
+	policy := kvstore.NewPolicy()
+	flag.DurationVar(&policy.Default.TTL, "ttl", 0, "time to live of keys outside of a configured namespace, 0 keeps them forever")
+	flag.Int64Var(&policy.MaxBytes, "max-bytes", 0, "maximum size of all keys and values, the least recently used keys are evicted beyond it, 0 for no limit")
+	flag.Func("namespace", "limits of a namespace as <namespace>:ttl=5m,max-keys=100,max-bytes=4096, may be repeated", func(value string) error {
+		namespace, limits, err := kvstore.ParseNamespaceLimits(value)
+		if err != nil {
+			return err
+		}
+		policy.Namespaces[namespace] = limits
+		return nil
+	})
+	flag.Parse()
+
+	if *node == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatalln("Failed to get hostname, use -node: ", err)
 		}
+		*node = hostname
 	}
-	return string(buf)
-}
 
-func main() {
 	conn, err := net.ListenUDP("udp", &net.UDPAddr{
 		Port: 3000,
 	})
@@ -31,61 +57,56 @@ func main() {
 		log.Fatalln(err)
 	}
 
-	db := make(map[string]string)
-	db["version"] = "Ken's Key-Value Store 1.0"
+	db := kvstore.New(*node)
+	db.SnapshotInterval = *snapshotInterval
+	db.Policy = policy
+	server := NewServer(db)
+	server.Workers = *workers
+	// Requests are logged without waiting for stderr, startup failures are still logged synchronously.
+	requestLog := log.New(NewAsyncWriter(os.Stderr, *logBacklog), "", log.LstdFlags)
+	server.Log = requestLog
+	db.Logger = requestLog
+	if *watch {
+		server.Watchers = NewWatchers(*watchTTL, *watchMax)
+		server.Watchers.MaxClients = *watchClients
+		server.Watchers.MaxTotal = *watchTotal
+		go server.Watchers.RunJanitor(time.Minute)
+	}
+	if *dataDir != "" {
+		if err := db.Open(*dataDir, *sync); err != nil {
+			log.Fatalln("Failed to recover database: ", err)
+		}
+	}
+	db.EnforcePolicy()
+	go db.RunJanitor(time.Second)
 
-	for {
-		buf := make([]byte, 1000)
-		_, addr, err := conn.ReadFromUDP(buf)
+	if *replicationAddr != "" {
+		ln, err := net.Listen("tcp", *replicationAddr)
 		if err != nil {
-			log.Println(err)
-			continue
+			log.Fatalln("Failed to listen for replicas: ", err)
 		}
-		msg := ReadFromBuffer(buf)
-
-		requestType := GetRequestType(msg)
-		log.Printf("Message from %s: %v\n", addr.String(), msg)
-
-		switch requestType {
-		case INSERT:
-			key, value := GetKeyValueFromMessage(msg)
-			if key == "version" {
-				continue
-			}
-
-			db[key] = value
-			log.Printf("DATABASE UPDATE: %s=%s", key, value)
-
-		case RETRIEVE:
-			if value, ok := db[msg]; ok {
-				log.Printf("RETRIVE: %s=%s", msg, value)
-				_, err := conn.WriteToUDP([]byte(fmt.Sprintf("%s=%s", msg, value)), addr)
-				if err != nil {
-					log.Println(err)
-				}
-
-			} else {
-				log.Println("Failed to find value", msg)
-			}
+		go server.ServeReplication(ln)
+	}
+	if *replicas != "" {
+		for _, addr := range strings.Split(*replicas, ",") {
+			replica := NewReplica(addr, server)
+			server.Replicas = append(server.Replicas, replica)
+			go replica.Run()
 		}
 	}
-}
 
-func GetKeyValueFromMessage(msg string) (string, string) {
-	key := ""
-	for i := 0; i < len(msg); i++ {
-		if msg[i] == '=' {
-			value := msg[i+1:]
-			return key, value
+	if *httpAddr != "" {
+		go func() {
+			log.Fatalln(http.ListenAndServe(*httpAddr, NewHTTPHandler(db)))
+		}()
+	}
+	if *linesAddr != "" {
+		ln, err := net.Listen("tcp", *linesAddr)
+		if err != nil {
+			log.Fatalln("Failed to listen for the line protocol: ", err)
 		}
-		key += string(msg[i])
+		go ServeLines(ln, db)
 	}
-	return key, ""
-}
 
-func GetRequestType(msg string) Request {
-	if strings.ContainsRune(msg, '=') {
-		return INSERT
-	}
-	return RETRIEVE
+	log.Fatalln(server.Serve(conn))
 }
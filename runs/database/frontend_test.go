@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dorimon-1/protohackers/internal/kvstore"
+)
+
+func TestHTTPFrontend(t *testing.T) {
+	nodes := newNodes(t, 1)
+	serveNodes(nodes)
+	api := httptest.NewServer(NewHTTPHandler(nodes[0].server.DB))
+	defer api.Close()
+
+	do := func(method, path, body string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, api.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	tests := []struct {
+		method, path, body string
+		status             int
+		response           string
+	}{
+		{"GET", "/keys/users/alice", "", http.StatusNotFound, "404 page not found\n"},
+		{"PUT", "/keys/users/alice", "a=b c", http.StatusNoContent, ""},
+		{"GET", "/keys/users/alice", "", http.StatusOK, "a=b c"},
+		{"PUT", "/keys/users%2Fbob", "", http.StatusNoContent, ""},
+		{"GET", "/keys?prefix=users/", "", http.StatusOK, "users/alice\nusers/bob\n"},
+		{"GET", "/keys/version", "", http.StatusOK, VERSION},
+		{"PUT", "/keys/version", "2.0", http.StatusForbidden, "key is read-only\n"},
+		{"DELETE", "/keys/users/bob", "", http.StatusNoContent, ""},
+		{"GET", "/keys/users/bob", "", http.StatusNotFound, "404 page not found\n"},
+	}
+	for _, test := range tests {
+		status, response := do(test.method, test.path, test.body)
+		if status != test.status || response != test.response {
+			t.Errorf("%s %s = %d %q, want %d %q", test.method, test.path, status, response, test.status, test.response)
+		}
+	}
+
+	// The UDP front-end serves the same store.
+	if got := request(t, nodes[0], "users/alice"); got != "users/alice=a=b c" {
+		t.Errorf("UDP retrieve = %q", got)
+	}
+}
+
+func TestLineFrontend(t *testing.T) {
+	nodes := newNodes(t, 1)
+	serveNodes(nodes)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go ServeLines(ln, nodes[0].server.DB)
+	// Inserts over UDP can hold anything but a key with =, the line protocol escapes what would break its framing.
+	if err := nodes[0].server.DB.Set("multi\nline", "a\nb\\c\r"); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{"GET foo", []string{"NOT_FOUND"}},
+		{"SET foo bar baz", []string{"OK"}},
+		{"get foo", []string{"VALUE bar baz"}},
+		{"SET stats 1", []string{"ERR " + kvstore.ErrReadOnly.Error()}},
+		{"SET novalue", []string{"ERR usage: SET <key> <value>"}},
+		{"SET foo2 x", []string{"OK"}},
+		{"KEYS foo", []string{"KEY foo", "KEY foo2", "END"}},
+		{"DEL foo", []string{"OK"}},
+		{"GET foo", []string{"NOT_FOUND"}},
+		{"PING", []string{`ERR unknown command "PING"`}},
+		{"KEYS multi", []string{`KEY multi\nline`, "END"}},
+		{`GET multi\nline`, []string{`VALUE a\nb\\c\r`}},
+		{`SET escaped x\ny\\`, []string{"OK"}},
+		{`GET escaped`, []string{`VALUE x\ny\\`}},
+		{`SET bad a\tb`, []string{`ERR unknown escape \t`}},
+		{`GET bad\`, []string{"ERR trailing backslash"}},
+	}
+	for _, test := range tests {
+		fmt.Fprintf(conn, "%s\r\n", test.command)
+		for _, want := range test.want {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSuffix(line, "\n"); got != want {
+				t.Errorf("%s: got %q, want %q", test.command, got, want)
+			}
+		}
+	}
+
+	if got := request(t, nodes[0], "foo2"); got != "foo2=x" {
+		t.Errorf("UDP retrieve = %q", got)
+	}
+	if got := request(t, nodes[0], "escaped"); got != "escaped=x\ny\\" {
+		t.Errorf("UDP retrieve = %q", got)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/dorimon-1/protohackers/internal/kvstore"
+)
+
+// NewHTTPHandler serves store as a REST API:
+//
+//	GET    /keys/{key}         the value as text/plain, 404 when it isn't set
+//	PUT    /keys/{key}         sets the key to the request body
+//	DELETE /keys/{key}         deletes the key
+//	GET    /keys?prefix=users/ the keys starting with prefix, one per line
+//
+// Keys may contain slashes, other special characters have to be escaped in the path.
+// Writing a read-only key is answered with 403 Forbidden.
+func NewHTTPHandler(store kvstore.Store) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /keys/{key...}", func(w http.ResponseWriter, r *http.Request) {
+		value, ok := store.Get(r.PathValue("key"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, value)
+	})
+
+	mux.HandleFunc("PUT /keys/{key...}", func(w http.ResponseWriter, r *http.Request) {
+		value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, kvstore.MAX_ENTRY_SIZE))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		writeResult(w, store.Set(r.PathValue("key"), string(value)))
+	})
+
+	mux.HandleFunc("DELETE /keys/{key...}", func(w http.ResponseWriter, r *http.Request) {
+		writeResult(w, store.Delete(r.PathValue("key")))
+	})
+
+	mux.HandleFunc("GET /keys", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, key := range store.Keys(r.URL.Query().Get("prefix")) {
+			io.WriteString(w, key+"\n")
+		}
+	})
+
+	return mux
+}
+
+// writeResult answers a write with 204 No Content, or with the status matching err.
+func writeResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, kvstore.ErrReadOnly):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, kvstore.ErrTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	default:
+		log.Println("Failed to write: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
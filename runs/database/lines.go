@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/dorimon-1/protohackers/internal/kvstore"
+)
+
+// ServeLines serves store over a newline delimited TCP protocol, one command per line:
+//
+//	GET <key>          answered with "VALUE <value>" or "NOT_FOUND"
+//	SET <key> <value>  answered with "OK", the value is the rest of the line
+//	DEL <key>          answered with "OK"
+//	KEYS [prefix]      answered with a "KEY <key>" line per key followed by "END"
+//
+// Keys can't contain spaces, failures are answered with "ERR <reason>". Keys and values are escaped in both
+// directions so a newline set over UDP can't break the framing: a backslash is written as \\, a newline as \n
+// and a carriage return as \r, any other escape is an error.
+func ServeLines(ln net.Listener, store kvstore.Store) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Println("Error accepting connection: ", err)
+			continue
+		}
+		go handleLines(conn, store)
+	}
+}
+
+func handleLines(conn net.Conn, store kvstore.Store) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), kvstore.MAX_ENTRY_SIZE+64)
+	writer := bufio.NewWriter(conn)
+	for scanner.Scan() {
+		handleLine(writer, store, strings.TrimSuffix(scanner.Text(), "\r"))
+		if err := writer.Flush(); err != nil {
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(conn, "ERR %s\n", err)
+	}
+}
+
+func handleLine(w io.Writer, store kvstore.Store, line string) {
+	command, args, _ := strings.Cut(line, " ")
+	switch strings.ToUpper(command) {
+	case "GET":
+		key, err := unescapeLine(args)
+		if err != nil {
+			writeLineResult(w, err)
+			return
+		}
+		if value, ok := store.Get(key); ok {
+			fmt.Fprintf(w, "VALUE %s\n", lineEscaper.Replace(value))
+		} else {
+			fmt.Fprintln(w, "NOT_FOUND")
+		}
+
+	case "SET":
+		key, value, ok := strings.Cut(args, " ")
+		if !ok {
+			fmt.Fprintln(w, "ERR usage: SET <key> <value>")
+			return
+		}
+		var err error
+		if key, err = unescapeLine(key); err != nil {
+			writeLineResult(w, err)
+			return
+		}
+		if value, err = unescapeLine(value); err != nil {
+			writeLineResult(w, err)
+			return
+		}
+		writeLineResult(w, store.Set(key, value))
+
+	case "DEL":
+		key, err := unescapeLine(args)
+		if err != nil {
+			writeLineResult(w, err)
+			return
+		}
+		writeLineResult(w, store.Delete(key))
+
+	case "KEYS":
+		prefix, err := unescapeLine(args)
+		if err != nil {
+			writeLineResult(w, err)
+			return
+		}
+		for _, key := range store.Keys(prefix) {
+			fmt.Fprintf(w, "KEY %s\n", lineEscaper.Replace(key))
+		}
+		fmt.Fprintln(w, "END")
+
+	default:
+		fmt.Fprintf(w, "ERR unknown command %q\n", command)
+	}
+}
+
+func writeLineResult(w io.Writer, err error) {
+	if err != nil {
+		fmt.Fprintf(w, "ERR %s\n", err)
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
+
+// lineEscaper escapes keys and values so they fit on one line, unescapeLine reverses it.
+var lineEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`)
+
+// unescapeLine returns s with the escapes of lineEscaper replaced, it fails on any other escape.
+func unescapeLine(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", errors.New("trailing backslash")
+		}
+		switch s[i] {
+		case '\\':
+			b.WriteByte('\\')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		default:
+			return "", fmt.Errorf("unknown escape \\%c", s[i])
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+)
+
+// MAX_DATAGRAM_SIZE is the spec's limit, requests and responses have to be shorter than it.
+const MAX_DATAGRAM_SIZE = 1000
+
+type Request int
+
+const (
+	INSERT Request = iota
+	RETRIEVE
+)
+
+var ErrOversized = errors.New("datagram is not shorter than 1000 bytes")
+
+// Message is a parsed request, Value is only set for inserts.
+type Message struct {
+	Type  Request
+	Key   string
+	Value string
+}
+
+// ParseRequest accepts a whole datagram, exactly as many bytes as were received.
+// A datagram containing '=' is an insert of everything before the first '=' as the key and everything after it as the value,
+// any other datagram retrieves itself. Every byte is significant, including NUL bytes and newlines.
+func ParseRequest(datagram []byte) (Message, error) {
+	if len(datagram) >= MAX_DATAGRAM_SIZE {
+		return Message{}, ErrOversized
+	}
+
+	key, value, ok := bytes.Cut(datagram, []byte{'='})
+	if !ok {
+		return Message{Type: RETRIEVE, Key: string(datagram)}, nil
+	}
+	return Message{Type: INSERT, Key: string(key), Value: string(value)}, nil
+}
+
+// FormatResponse returns the "key=value" answer to a retrieve, or ErrOversized when it wouldn't fit in a datagram.
+func FormatResponse(key, value string) ([]byte, error) {
+	if len(key)+1+len(value) >= MAX_DATAGRAM_SIZE {
+		return nil, ErrOversized
+	}
+	response := make([]byte, 0, len(key)+1+len(value))
+	response = append(response, key...)
+	response = append(response, '=')
+	return append(response, value...), nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		datagram string
+		want     Message
+		err      error
+	}{
+		{"retrieve", "foo", Message{Type: RETRIEVE, Key: "foo"}, nil},
+		{"empty retrieve", "", Message{Type: RETRIEVE, Key: ""}, nil},
+		{"insert", "foo=bar", Message{Type: INSERT, Key: "foo", Value: "bar"}, nil},
+		{"value with equals", "foo=bar=baz", Message{Type: INSERT, Key: "foo", Value: "bar=baz"}, nil},
+		{"empty key", "=foo", Message{Type: INSERT, Key: "", Value: "foo"}, nil},
+		{"empty value", "foo=", Message{Type: INSERT, Key: "foo", Value: ""}, nil},
+		{"only equals", "===", Message{Type: INSERT, Key: "", Value: "=="}, nil},
+		{"nul bytes", "a\x00b=c\x00d", Message{Type: INSERT, Key: "a\x00b", Value: "c\x00d"}, nil},
+		{"trailing nul", "key\x00", Message{Type: RETRIEVE, Key: "key\x00"}, nil},
+		{"newlines", "k\n=v\n", Message{Type: INSERT, Key: "k\n", Value: "v\n"}, nil},
+		{"largest", strings.Repeat("k", 999), Message{Type: RETRIEVE, Key: strings.Repeat("k", 999)}, nil},
+		{"oversized", strings.Repeat("k", 1000), Message{}, ErrOversized},
+		{"oversized insert", "k=" + strings.Repeat("v", 998), Message{}, ErrOversized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseRequest([]byte(test.datagram))
+			if !errors.Is(err, test.err) {
+				t.Fatalf("err = %v, want %v", err, test.err)
+			}
+			if got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFormatResponse(t *testing.T) {
+	tests := []struct {
+		key, value string
+		want       string
+		err        error
+	}{
+		{"foo", "bar", "foo=bar", nil},
+		{"", "", "=", nil},
+		{"a\x00", "=b", "a\x00==b", nil},
+		{"k", strings.Repeat("v", 997), "k=" + strings.Repeat("v", 997), nil},
+		{"k", strings.Repeat("v", 998), "", ErrOversized},
+	}
+	for _, test := range tests {
+		got, err := FormatResponse(test.key, test.value)
+		if !errors.Is(err, test.err) || string(got) != test.want {
+			t.Errorf("FormatResponse(%q, %q) = %q, %v, want %q, %v", test.key, test.value, got, err, test.want, test.err)
+		}
+	}
+}
+
+// FuzzParseRequest checks that parsing loses no bytes: an insert is the key, '=' and the value,
+// and a retrieve answered with its value parses back into the same key.
+func FuzzParseRequest(f *testing.F) {
+	for _, seed := range []string{"", "foo", "foo=bar", "=", "a=b=c", "\x00=\x00", strings.Repeat("x", 999)} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, datagram []byte) {
+		msg, err := ParseRequest(datagram)
+		if len(datagram) >= MAX_DATAGRAM_SIZE {
+			if !errors.Is(err, ErrOversized) {
+				t.Fatalf("%d byte datagram was accepted", len(datagram))
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch msg.Type {
+		case INSERT:
+			if strings.Contains(msg.Key, "=") {
+				t.Fatalf("key %q contains '='", msg.Key)
+			}
+			if rebuilt := msg.Key + "=" + msg.Value; rebuilt != string(datagram) {
+				t.Fatalf("insert %q rebuilt as %q", datagram, rebuilt)
+			}
+			response, err := FormatResponse(msg.Key, msg.Value)
+			if err != nil || !bytes.Equal(response, datagram) {
+				t.Fatalf("response to %q is %q, %v", datagram, response, err)
+			}
+		case RETRIEVE:
+			if bytes.IndexByte(datagram, '=') >= 0 || msg.Key != string(datagram) {
+				t.Fatalf("retrieve parsed from %q has key %q", datagram, msg.Key)
+			}
+		}
+	})
+}
+
+func TestServeExactDatagrams(t *testing.T) {
+	nodes := newNodes(t, 1)
+	serveNodes(nodes)
+
+	request(t, nodes[0], "nul\x00key=value\x00with nul")
+	eventually(t, nodes[0], "nul\x00key", "value\x00with nul")
+	// A shorter datagram after a longer one must not see the leftovers of the buffer.
+	request(t, nodes[0], "a=1")
+	eventually(t, nodes[0], "a", "1")
+
+	// Values written through the other front-ends can be too large to answer in a datagram.
+	nodes[0].server.DB.Set("big", strings.Repeat("v", 996))
+	if got := request(t, nodes[0], "big"); got != "" {
+		t.Errorf("got a %d byte response to big, want none", len(got))
+	}
+	request(t, nodes[0], "toolong="+strings.Repeat("v", 1000))
+	if got := request(t, nodes[0], "toolong"); got != "" {
+		t.Errorf("oversized insert was stored: %q", got)
+	}
+}
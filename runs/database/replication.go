@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dorimon-1/protohackers/internal/kvstore"
+)
+
+const (
+	REPLICA_BACKLOG         = 4096
+	REPLICA_RECONNECT_DELAY = time.Second
+	// REPLICA_ACK_INTERVAL is how often a node acknowledges the writes it merged, even when there were none.
+	REPLICA_ACK_INTERVAL = time.Second
+	// REPLICA_TIMEOUT is how long a replica waits for an acknowledgement before it gives up on the link by default.
+	REPLICA_TIMEOUT = 5 * REPLICA_ACK_INTERVAL
+)
+
+type replicatedWrite struct {
+	key   string
+	entry kvstore.Entry
+}
+
+// Replica pushes the writes of this node to another node over a TCP link, using the write-ahead log record format.
+// Deletes are pushed as tombstones.
+// Writes are only pushed by the node that received them from a client, so every node has to replicate to every other node.
+//
+// A link starts with a record of an empty key whose timestamp carries the name of this node. The other node answers
+// with a record of an empty key whose timestamp is the newest write it merged from this node, and repeats it every
+// REPLICA_ACK_INTERVAL, which also tells us that it is still alive. The writes newer than the first acknowledgement are
+// pushed before the queued writes, in timestamp order, so every acknowledgement covers all the older writes.
+// Last-writer-wins makes pushing a write twice harmless.
+type Replica struct {
+	Addr   string
+	Server *Server
+	// Timeout is how long to wait for an acknowledgement before the link is dropped.
+	Timeout time.Duration
+
+	queue chan replicatedWrite
+	// resync is set when the queue overflowed, the next write triggers a push of everything that wasn't acknowledged instead.
+	resync atomic.Bool
+
+	mu    sync.Mutex
+	acked kvstore.Timestamp
+}
+
+func NewReplica(addr string, server *Server) *Replica {
+	return &Replica{
+		Addr:    addr,
+		Server:  server,
+		Timeout: REPLICA_TIMEOUT,
+		queue:   make(chan replicatedWrite, REPLICA_BACKLOG),
+	}
+}
+
+// Send queues a write without blocking.
+func (r *Replica) Send(key string, entry kvstore.Entry) {
+	select {
+	case r.queue <- replicatedWrite{key: key, entry: entry}:
+	default:
+		r.resync.Store(true)
+	}
+}
+
+// Run keeps a link to the other node, reconnecting whenever it is lost.
+func (r *Replica) Run() {
+	for {
+		conn, err := net.Dial("tcp", r.Addr)
+		if err != nil {
+			log.Printf("Failed to connect to replica %s: %s", r.Addr, err)
+		} else {
+			err = r.push(conn)
+			log.Printf("Lost link with replica %s: %s", r.Addr, err)
+			conn.Close()
+		}
+		time.Sleep(REPLICA_RECONNECT_DELAY)
+	}
+}
+
+func (r *Replica) push(conn net.Conn) error {
+	writer := bufio.NewWriter(conn)
+	hello := kvstore.Entry{Timestamp: kvstore.Timestamp{Node: r.Server.DB.Clock.Node}}
+	if _, err := writer.Write(kvstore.EncodeRecord("", hello)); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	// The acknowledgements are read on their own goroutine, a link that stops sending them is closed.
+	acked := make(chan struct{}, 1)
+	failed := make(chan error, 1)
+	go func() {
+		err := kvstore.ReadRecords(bufio.NewReader(deadlineReader{conn, r.Timeout}), func(_ string, ack kvstore.Entry) {
+			r.setAcked(ack.Timestamp)
+			select {
+			case acked <- struct{}{}:
+			default:
+			}
+		})
+		if err == nil {
+			err = errors.New("replica closed the link")
+		}
+		conn.Close()
+		failed <- err
+	}()
+
+	select {
+	case <-acked:
+	case err := <-failed:
+		return err
+	}
+	if err := r.pushSince(writer, r.ackedTimestamp()); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case write := <-r.queue:
+			if r.resync.Swap(false) {
+				if err := r.pushSince(writer, r.ackedTimestamp()); err != nil {
+					return err
+				}
+			}
+
+			if _, err := writer.Write(kvstore.EncodeRecord(write.key, write.entry)); err != nil {
+				return err
+			}
+			if len(r.queue) == 0 {
+				if err := writer.Flush(); err != nil {
+					return err
+				}
+			}
+		case err := <-failed:
+			return err
+		}
+	}
+}
+
+// pushSince drops the queued writes and sends every write newer than since instead, oldest first.
+// Writes that are queued while we read the database are sent again afterwards, which is harmless.
+func (r *Replica) pushSince(writer *bufio.Writer, since kvstore.Timestamp) error {
+	r.resync.Store(false)
+	for len(r.queue) > 0 {
+		<-r.queue
+	}
+
+	writes := make([]replicatedWrite, 0)
+	r.Server.DB.Entries(func(key string, entry kvstore.Entry) {
+		if since.Less(entry.Timestamp) {
+			writes = append(writes, replicatedWrite{key: key, entry: entry})
+		}
+	})
+	slices.SortFunc(writes, func(a, b replicatedWrite) int {
+		if a.entry.Timestamp.Less(b.entry.Timestamp) {
+			return -1
+		}
+		if b.entry.Timestamp.Less(a.entry.Timestamp) {
+			return 1
+		}
+		return 0
+	})
+
+	for _, write := range writes {
+		if _, err := writer.Write(kvstore.EncodeRecord(write.key, write.entry)); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+func (r *Replica) setAcked(ts kvstore.Timestamp) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.acked = ts
+}
+
+func (r *Replica) ackedTimestamp() kvstore.Timestamp {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.acked
+}
+
+// deadlineReader fails a read of conn that takes longer than timeout.
+type deadlineReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (d deadlineReader) Read(p []byte) (int, error) {
+	d.conn.SetReadDeadline(time.Now().Add(d.timeout))
+	return d.conn.Read(p)
+}
+
+// ServeReplication accepts links from the replicas of other nodes and merges the writes they push.
+func (srv *Server) ServeReplication(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Println("Error accepting replica: ", err)
+			continue
+		}
+
+		go func() {
+			defer conn.Close()
+			err := srv.mergeReplica(conn)
+			if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+				log.Printf("Replication link from %s failed: %s", conn.RemoteAddr().String(), err)
+			}
+		}()
+	}
+}
+
+// mergeReplica merges the writes pushed over a link. It acknowledges the newest of them as soon as it knows the node
+// pushing them and then every REPLICA_ACK_INTERVAL, until the link is closed.
+func (srv *Server) mergeReplica(conn net.Conn) error {
+	var (
+		mu      sync.Mutex
+		node    string
+		newest  kvstore.Timestamp
+		greeted bool
+	)
+	ack := func() error {
+		mu.Lock()
+		ts := newest
+		mu.Unlock()
+		srv.setMerged(node, ts)
+		conn.SetWriteDeadline(time.Now().Add(REPLICA_TIMEOUT))
+		_, err := conn.Write(kvstore.EncodeRecord("", kvstore.Entry{Timestamp: ts}))
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	acknowledge := func() {
+		ticker := time.NewTicker(REPLICA_ACK_INTERVAL)
+		defer ticker.Stop()
+		for err := ack(); err == nil; err = ack() {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+		conn.Close()
+	}
+
+	err := kvstore.ReadRecords(bufio.NewReader(conn), func(key string, entry kvstore.Entry) {
+		if !greeted {
+			greeted = true
+			node = entry.Timestamp.Node
+			newest = srv.merged(node)
+			go acknowledge()
+			return
+		}
+
+		srv.DB.Merge(key, entry)
+		mu.Lock()
+		if newest.Less(entry.Timestamp) {
+			newest = entry.Timestamp
+		}
+		mu.Unlock()
+	})
+	if greeted {
+		mu.Lock()
+		srv.setMerged(node, newest)
+		mu.Unlock()
+	}
+	return err
+}
+
+// merged returns the newest write merged from the replica of node, every older write of node was merged too.
+func (srv *Server) merged(node string) kvstore.Timestamp {
+	srv.mergedMu.Lock()
+	defer srv.mergedMu.Unlock()
+	return srv.mergedFrom[node]
+}
+
+func (srv *Server) setMerged(node string, ts kvstore.Timestamp) {
+	srv.mergedMu.Lock()
+	defer srv.mergedMu.Unlock()
+	if srv.mergedFrom[node].Less(ts) {
+		srv.mergedFrom[node] = ts
+	}
+}
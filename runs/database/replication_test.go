@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dorimon-1/protohackers/internal/kvstore"
+)
+
+type testNode struct {
+	server *Server
+	conn   *net.UDPConn
+	ln     net.Listener
+}
+
+// newNodes creates n servers listening on loopback ports, they are started by serveNodes.
+func newNodes(t *testing.T, n int) []testNode {
+	t.Helper()
+
+	nodes := make([]testNode, n)
+	for i := range nodes {
+		server := NewServer(kvstore.New(fmt.Sprintf("node%d", i)))
+
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			conn.Close()
+			ln.Close()
+		})
+
+		nodes[i] = testNode{server: server, conn: conn, ln: ln}
+	}
+	return nodes
+}
+
+func serveNodes(nodes []testNode) {
+	for _, node := range nodes {
+		go node.server.Serve(node.conn)
+		go node.server.ServeReplication(node.ln)
+	}
+}
+
+// linkNodes makes every node replicate to every other node, it has to be called before serveNodes.
+func linkNodes(nodes []testNode) {
+	for i := range nodes {
+		for j := range nodes {
+			if i == j {
+				continue
+			}
+			replica := NewReplica(nodes[j].ln.Addr().String(), nodes[i].server)
+			nodes[i].server.Replicas = append(nodes[i].server.Replicas, replica)
+			go replica.Run()
+		}
+	}
+}
+
+// request sends a single datagram to node and returns the response, or "" when none arrives.
+func request(t *testing.T, node testNode, msg string) string {
+	t.Helper()
+	conn, err := net.DialUDP("udp", nil, node.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if strings.ContainsRune(msg, '=') {
+		return ""
+	}
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	buf := make([]byte, 1000)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[:n])
+}
+
+// eventually retrieves key from node until it returns want.
+func eventually(t *testing.T, node testNode, key, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := request(t, node, key)
+		if got == key+"="+want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s returned %q for %s, want %q", node.server.DB.Clock.Node, got, key, want)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// eventuallyDeleted retrieves key from node until it is no longer set.
+func eventuallyDeleted(t *testing.T, node testNode, key string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for request(t, node, key) != "" {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s still has %s", node.server.DB.Clock.Node, key)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestReplicationReachesEveryNode(t *testing.T) {
+	nodes := newNodes(t, 3)
+	linkNodes(nodes)
+	serveNodes(nodes)
+
+	request(t, nodes[0], "foo=bar")
+	request(t, nodes[2], "baz=qux=1")
+
+	for _, node := range nodes {
+		eventually(t, node, "foo", "bar")
+		eventually(t, node, "baz", "qux=1")
+		eventually(t, node, "version", VERSION)
+	}
+
+	request(t, nodes[1], "foo=updated")
+	for _, node := range nodes {
+		eventually(t, node, "foo", "updated")
+	}
+
+	nodes[2].server.DB.Delete("foo")
+	for _, node := range nodes {
+		eventuallyDeleted(t, node, "foo")
+	}
+}
+
+func TestReplicationLastWriterWins(t *testing.T) {
+	nodes := newNodes(t, 2)
+	nodes[0].server.DB.Clock.WallTime = func() int64 { return 2000 }
+	nodes[1].server.DB.Clock.WallTime = func() int64 { return 1000 }
+
+	// Both nodes accept a write before they can see each other, the newer one has to win everywhere,
+	// no matter which node receives which write first.
+	nodes[1].server.DB.Set("key", "older")
+	nodes[0].server.DB.Set("key", "newer")
+	nodes[1].server.DB.Set("other", "only on node1")
+	linkNodes(nodes)
+	serveNodes(nodes)
+
+	for _, node := range nodes {
+		eventually(t, node, "key", "newer")
+		eventually(t, node, "other", "only on node1")
+	}
+
+	// node1 observed the newer timestamp, so its next write wins even though its wall clock is behind.
+	nodes[1].server.DB.Set("key", "after")
+	for _, node := range nodes {
+		eventually(t, node, "key", "after")
+	}
+}
+
+func TestReplicaPushesUnacknowledgedWrites(t *testing.T) {
+	db := kvstore.New("node0")
+	server := NewServer(db)
+	for _, key := range []string{"a", "b", "c"} {
+		db.Set(key, key)
+	}
+	var acked kvstore.Timestamp
+	db.Entries(func(key string, entry kvstore.Entry) {
+		if key == "a" {
+			acked = entry.Timestamp
+		}
+	})
+
+	replica := NewReplica("", server)
+	replica.Timeout = 200 * time.Millisecond
+	server.Replicas = append(server.Replicas, replica)
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	pushed := make(chan error, 1)
+	go func() { pushed <- replica.push(conn) }()
+
+	records := make(chan string, 16)
+	go kvstore.ReadRecords(peer, func(key string, entry kvstore.Entry) {
+		records <- key + "=" + entry.Value + "@" + entry.Timestamp.Node
+	})
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-records:
+			if got != want {
+				t.Fatalf("pushed %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("nothing pushed, want %q", want)
+		}
+	}
+
+	// The other node already merged a, only the newer writes are pushed, in order, and then the new ones.
+	expect("=@node0")
+	if _, err := peer.Write(kvstore.EncodeRecord("", kvstore.Entry{Timestamp: acked})); err != nil {
+		t.Fatal(err)
+	}
+	expect("b=b@node0")
+	expect("c=c@node0")
+	db.Set("d", "d")
+	expect("d=d@node0")
+
+	// Without further acknowledgements the link is dropped.
+	select {
+	case err := <-pushed:
+		if err == nil {
+			t.Error("push returned without an error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("push kept a link that stopped acknowledging")
+	}
+}
+
+func TestReplicationAcknowledgesMergedWrites(t *testing.T) {
+	nodes := newNodes(t, 2)
+	linkNodes(nodes)
+	serveNodes(nodes)
+
+	nodes[0].server.DB.Set("a", "1")
+	eventually(t, nodes[1], "a", "1")
+	var written kvstore.Timestamp
+	nodes[0].server.DB.Entries(func(key string, entry kvstore.Entry) {
+		if key == "a" {
+			written = entry.Timestamp
+		}
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for nodes[0].server.Replicas[0].ackedTimestamp() != written {
+		if time.Now().After(deadline) {
+			t.Fatalf("node1 acknowledged %s, want %s", nodes[0].server.Replicas[0].ackedTimestamp(), written)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if merged := nodes[1].server.merged("node0"); merged != written {
+		t.Errorf("node1 merged %s from node0, want %s", merged, written)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dorimon-1/protohackers/internal/kvstore"
+)
+
+const VERSION = "Ken's Key-Value Store 1.0"
+
+// WORKER_BACKLOG is how many datagrams may wait for a worker, further datagrams for it are dropped like the network would.
+const WORKER_BACKLOG = 1024
+
+// Server answers the UDP requests of a single node and replicates the writes of its clients.
+type Server struct {
+	DB       *kvstore.DB
+	Replicas []*Replica
+	// Workers is the number of goroutines processing requests, it is read when Serve starts.
+	Workers int
+	Log     *log.Logger
+	// Watchers enables subscriptions to key updates, nil disables them.
+	Watchers *Watchers
+
+	dropped atomic.Uint64
+	// conn is the socket notifications are sent from, it is set by Serve.
+	conn atomic.Pointer[net.UDPConn]
+
+	// mergedFrom is the newest write merged from the replica of each node, a new link of the node only pushes newer writes.
+	mergedMu   sync.Mutex
+	mergedFrom map[string]kvstore.Timestamp
+}
+
+type datagram struct {
+	addr netip.AddrPort
+	data []byte
+}
+
+// NewServer accepts the store of this node, it pins the version key and sends every write of a client to the replicas.
+func NewServer(db *kvstore.DB) *Server {
+	srv := &Server{DB: db, Workers: runtime.NumCPU(), Log: log.Default(), mergedFrom: make(map[string]kvstore.Timestamp)}
+	db.SetReadOnly("version", VERSION)
+	db.OnWrite = srv.replicate
+	db.OnChange = srv.notify
+	return srv
+}
+
+// Serve answers requests arriving on conn until it is closed.
+// Datagrams are read on this goroutine and processed by the workers. All the datagrams of a client go to the same worker,
+// so a client that inserts the same key twice in a row finds the second value.
+func (srv *Server) Serve(conn *net.UDPConn) error {
+	srv.conn.Store(conn)
+	workers := make([]chan datagram, max(srv.Workers, 1))
+	for i := range workers {
+		workers[i] = make(chan datagram, WORKER_BACKLOG)
+		go srv.work(conn, workers[i])
+	}
+	defer func() {
+		for _, worker := range workers {
+			close(worker)
+		}
+	}()
+
+	// A datagram that fills the whole buffer was MAX_DATAGRAM_SIZE bytes or more, the kernel dropped the rest of it.
+	buf := make([]byte, MAX_DATAGRAM_SIZE)
+	for {
+		n, addr, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			srv.Log.Println(err)
+			continue
+		}
+
+		if !dispatch(workers, datagram{addr: addr, data: append([]byte(nil), buf[:n]...)}) {
+			srv.Log.Printf("Dropping request from %s, its worker is busy (%d dropped)", addr, srv.dropped.Add(1))
+		}
+	}
+}
+
+// dispatch queues request for the worker of its client and reports whether the worker had room for it.
+func dispatch(workers []chan datagram, request datagram) bool {
+	select {
+	case workers[hashAddr(request.addr)%uint32(len(workers))] <- request:
+		return true
+	default:
+		return false
+	}
+}
+
+func (srv *Server) work(conn *net.UDPConn, requests chan datagram) {
+	for request := range requests {
+		srv.handle(conn, request)
+	}
+}
+
+// handle answers a single request, datagrams of MAX_DATAGRAM_SIZE bytes or more are dropped and so are retrieves whose response would be.
+func (srv *Server) handle(conn *net.UDPConn, request datagram) {
+	msg, err := ParseRequest(request.data)
+	if err != nil {
+		srv.Log.Printf("Dropping request from %s: %s", request.addr, err)
+		return
+	}
+	srv.Log.Printf("Message from %s: %q\n", request.addr, request.data)
+	if srv.Watchers != nil && srv.handleWatch(conn, request.addr, msg) {
+		return
+	}
+
+	switch msg.Type {
+	case INSERT:
+		if err := srv.DB.Set(msg.Key, msg.Value); err != nil && !errors.Is(err, kvstore.ErrReadOnly) {
+			srv.Log.Printf("Failed to insert %s: %s", msg.Key, err)
+		}
+
+	case RETRIEVE:
+		value, ok := srv.DB.Get(msg.Key)
+		if !ok {
+			srv.Log.Println("Failed to find value", msg.Key)
+			return
+		}
+		response, err := FormatResponse(msg.Key, value)
+		if err != nil {
+			srv.Log.Printf("Not answering retrieve of %s: %s", msg.Key, err)
+			return
+		}
+		srv.Log.Printf("RETRIVE: %s=%s", msg.Key, value)
+		if _, err := conn.WriteToUDPAddrPort(response, request.addr); err != nil {
+			srv.Log.Println(err)
+		}
+	}
+}
+
+// hashAddr is the FNV-1a hash of a client address, it picks the worker of the client.
+func hashAddr(addr netip.AddrPort) uint32 {
+	hash := uint32(2166136261)
+	ip := addr.Addr().As16()
+	for _, b := range ip {
+		hash ^= uint32(b)
+		hash *= 16777619
+	}
+	port := addr.Port()
+	for _, b := range []byte{byte(port >> 8), byte(port)} {
+		hash ^= uint32(b)
+		hash *= 16777619
+	}
+	return hash
+}
+
+// handleWatch answers the subscription requests and reports whether msg was one.
+func (srv *Server) handleWatch(conn *net.UDPConn, addr netip.AddrPort, msg Message) bool {
+	switch {
+	case msg.Type == INSERT && msg.Key == WATCH_KEY:
+		token, err := srv.Watchers.Watch(addr, msg.Value)
+		if err != nil {
+			srv.Log.Printf("Not watching %s for %s: %s", msg.Value, addr, err)
+			return true
+		}
+		if token == "" {
+			return true
+		}
+		response, _ := FormatResponse(CONFIRM_KEY, token)
+		if _, err := conn.WriteToUDPAddrPort(response, addr); err != nil {
+			srv.Log.Println(err)
+		}
+	case msg.Type == INSERT && msg.Key == CONFIRM_KEY:
+		if !srv.Watchers.Confirm(addr, msg.Value) {
+			srv.Log.Printf("Wrong confirmation from %s", addr)
+		}
+	case msg.Type == INSERT && msg.Key == UNWATCH_KEY:
+		srv.Watchers.Unwatch(addr, msg.Value)
+	case msg.Type == RETRIEVE && msg.Key == WATCH_KEY:
+		response, err := FormatResponse(WATCH_KEY, strings.Join(srv.Watchers.Patterns(addr), ","))
+		if err != nil {
+			srv.Log.Printf("Not answering retrieve of %s: %s", WATCH_KEY, err)
+			return true
+		}
+		if _, err := conn.WriteToUDPAddrPort(response, addr); err != nil {
+			srv.Log.Println(err)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// notify sends an update to every client watching key.
+func (srv *Server) notify(key string, entry kvstore.Entry) {
+	conn := srv.conn.Load()
+	if srv.Watchers == nil || entry.Deleted || conn == nil {
+		return
+	}
+	addrs := srv.Watchers.Matching(key)
+	if len(addrs) == 0 {
+		return
+	}
+
+	notification, err := FormatResponse(key, entry.Value)
+	if err != nil {
+		srv.Log.Printf("Not notifying the watchers of %s: %s", key, err)
+		return
+	}
+	for _, addr := range addrs {
+		if _, err := conn.WriteToUDPAddrPort(notification, addr); err != nil {
+			srv.Log.Println(err)
+		}
+	}
+}
+
+func (srv *Server) replicate(key string, entry kvstore.Entry) {
+	for _, replica := range srv.Replicas {
+		replica.Send(key, entry)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dorimon-1/protohackers/internal/kvstore"
+)
+
+func TestServerKeepsClientOrder(t *testing.T) {
+	srv := NewServer(kvstore.New("test"))
+	srv.Log = log.New(io.Discard, "", 0)
+	srv.DB.Logger = srv.Log
+
+	var wg sync.WaitGroup
+	workers := make([]chan datagram, 8)
+	for i := range workers {
+		workers[i] = make(chan datagram, WORKER_BACKLOG)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.work(nil, workers[i])
+		}()
+	}
+
+	// Every insert of a client goes to the same worker, so the last one a client sent is the one that is kept
+	// while the workers run in parallel.
+	const clients = 16
+	for i := 0; i < 100; i++ {
+		for client := 0; client < clients; client++ {
+			addr := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), uint16(1000+client))
+			request := datagram{addr: addr, data: []byte(fmt.Sprintf("counter/%d=%d", client, i))}
+			if !dispatch(workers, request) {
+				t.Fatalf("the worker of %s is full", addr)
+			}
+		}
+	}
+	for _, worker := range workers {
+		close(worker)
+	}
+	wg.Wait()
+
+	for client := 0; client < clients; client++ {
+		if value, _ := srv.DB.Get(fmt.Sprintf("counter/%d", client)); value != "99" {
+			t.Errorf("counter/%d = %q, want 99", client, value)
+		}
+	}
+}
+
+// BenchmarkServe measures retrieve round trips from parallel clients over loopback, lost datagrams are reported as lost/op.
+func BenchmarkServe(b *testing.B) {
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			srv := NewServer(kvstore.New("bench"))
+			srv.Workers = workers
+			srv.Log = log.New(io.Discard, "", 0)
+			srv.DB.Logger = srv.Log
+			srv.DB.Set("key", "value")
+
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			go srv.Serve(conn)
+
+			var lost atomic.Uint64
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer client.Close()
+
+				buf := make([]byte, MAX_DATAGRAM_SIZE)
+				for pb.Next() {
+					client.Write([]byte("key"))
+					client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+					if _, err := client.Read(buf); err != nil {
+						lost.Add(1)
+					}
+				}
+			})
+			b.ReportMetric(float64(lost.Load())/float64(b.N), "lost/op")
+		})
+	}
+}
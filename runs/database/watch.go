@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Subscriptions are requested with inserts of the WATCH_KEY and UNWATCH_KEY, when they are enabled:
+//
+//	watch=foo      notify the sender whenever foo is updated
+//	watch=users/*  notify the sender whenever a key starting with users/ is updated
+//	unwatch=foo    cancel a subscription, unwatch= cancels every subscription of the sender
+//	watch          answered with watch=<the subscriptions of the sender, comma separated>
+//
+// The first watch of an address is answered with confirm=<token>, and nothing is sent to the address until it
+// inserts confirm=<token> back, within CONFIRM_TIMEOUT. A spoofed source never sees the token, so it can't have
+// notifications sent to someone else.
+//
+// A notification is the datagram a retrieve of the updated key would be answered with, deletes aren't notified.
+// Subscriptions expire after the TTL, sending the same watch again renews it.
+const (
+	WATCH_KEY      = "watch"
+	UNWATCH_KEY    = "unwatch"
+	CONFIRM_KEY    = "confirm"
+	WATCH_WILDCARD = "*"
+	// CONFIRM_TIMEOUT is how long an address has to confirm its subscriptions before they are dropped.
+	CONFIRM_TIMEOUT = 30 * time.Second
+)
+
+var (
+	ErrTooManyWatches  = errors.New("too many subscriptions")
+	ErrTooManyWatchers = errors.New("too many subscribed addresses")
+)
+
+// Watchers holds the subscriptions of every client address.
+type Watchers struct {
+	TTL          time.Duration
+	MaxPerClient int
+	// MaxClients bounds the addresses with subscriptions and MaxTotal the subscriptions of all of them,
+	// confirmed or not, 0 means no limit.
+	MaxClients int
+	MaxTotal   int
+
+	mu      sync.RWMutex
+	clients map[netip.AddrPort]*watcher
+	total   int
+	// index holds the patterns of the confirmed addresses, so a write only looks at the subscriptions matching its key.
+	index watchIndex
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+// watcher is a subscribed address, its patterns are only notified once it confirmed the token.
+type watcher struct {
+	token     string
+	confirmed bool
+	deadline  time.Time
+	patterns  map[string]time.Time
+}
+
+func NewWatchers(ttl time.Duration, maxPerClient int) *Watchers {
+	return &Watchers{
+		TTL:          ttl,
+		MaxPerClient: maxPerClient,
+		clients:      make(map[netip.AddrPort]*watcher),
+		index:        newWatchIndex(),
+		now:          time.Now,
+	}
+}
+
+// Watch subscribes addr to pattern, or renews the subscription. It returns the token addr has to confirm,
+// or "" once it did.
+func (w *Watchers) Watch(addr netip.AddrPort, pattern string) (string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := w.now()
+	client, ok := w.clients[addr]
+	if ok {
+		w.expireClient(addr, client, now)
+		client, ok = w.clients[addr]
+	}
+	if !ok {
+		if w.MaxClients > 0 && len(w.clients) >= w.MaxClients {
+			return "", ErrTooManyWatchers
+		}
+		client = &watcher{token: newToken(), deadline: now.Add(CONFIRM_TIMEOUT), patterns: make(map[string]time.Time)}
+		w.clients[addr] = client
+	}
+
+	if _, ok := client.patterns[pattern]; !ok {
+		if w.MaxPerClient > 0 && len(client.patterns) >= w.MaxPerClient {
+			return "", ErrTooManyWatches
+		}
+		if w.MaxTotal > 0 && w.total >= w.MaxTotal {
+			return "", ErrTooManyWatches
+		}
+		w.total++
+		if client.confirmed {
+			w.index.add(pattern, addr)
+		}
+	}
+	client.patterns[pattern] = now.Add(w.TTL)
+	if client.confirmed {
+		return "", nil
+	}
+	return client.token, nil
+}
+
+// Confirm enables the notifications of addr when token is the one it was sent, and reports whether it was.
+func (w *Watchers) Confirm(addr netip.AddrPort, token string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	client, ok := w.clients[addr]
+	if !ok || client.confirmed || token != client.token || !w.now().Before(client.deadline) {
+		return false
+	}
+	client.confirmed = true
+	for pattern := range client.patterns {
+		w.index.add(pattern, addr)
+	}
+	return true
+}
+
+// Unwatch cancels the subscription of addr to pattern, an empty pattern cancels all of them.
+func (w *Watchers) Unwatch(addr netip.AddrPort, pattern string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	client, ok := w.clients[addr]
+	if !ok {
+		return
+	}
+	if pattern == "" {
+		w.remove(addr, client)
+		return
+	}
+	if _, ok := client.patterns[pattern]; ok {
+		w.deletePattern(addr, client, pattern)
+	}
+	if len(client.patterns) == 0 {
+		w.remove(addr, client)
+	}
+}
+
+// Patterns returns the live subscriptions of addr in sorted order, none until it confirmed them.
+func (w *Watchers) Patterns(addr netip.AddrPort) []string {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	now := w.now()
+	result := make([]string, 0)
+	client, ok := w.clients[addr]
+	if !ok || !client.confirmed {
+		return result
+	}
+	for pattern, expires := range client.patterns {
+		if now.Before(expires) {
+			result = append(result, pattern)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Matching returns the confirmed addresses with a live subscription matching key.
+func (w *Watchers) Matching(key string) []netip.AddrPort {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	now := w.now()
+	result := make([]netip.AddrPort, 0)
+	found := make(map[netip.AddrPort]bool)
+	w.index.match(key, func(pattern string, addr netip.AddrPort) {
+		if !found[addr] && now.Before(w.clients[addr].patterns[pattern]) {
+			found[addr] = true
+			result = append(result, addr)
+		}
+	})
+	return result
+}
+
+// Len returns how many addresses have subscriptions and how many subscriptions they have together.
+func (w *Watchers) Len() (int, int) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return len(w.clients), w.total
+}
+
+// Expire drops every subscription that outlived its TTL, and the addresses that didn't confirm in time.
+func (w *Watchers) Expire() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := w.now()
+	for addr, client := range w.clients {
+		w.expireClient(addr, client, now)
+	}
+}
+
+// RunJanitor calls Expire every interval, it never returns.
+func (w *Watchers) RunJanitor(interval time.Duration) {
+	for range time.Tick(interval) {
+		w.Expire()
+	}
+}
+
+func (w *Watchers) expireClient(addr netip.AddrPort, client *watcher, now time.Time) {
+	if !client.confirmed && !now.Before(client.deadline) {
+		w.remove(addr, client)
+		return
+	}
+	for pattern, expires := range client.patterns {
+		if !now.Before(expires) {
+			w.deletePattern(addr, client, pattern)
+		}
+	}
+	if len(client.patterns) == 0 {
+		w.remove(addr, client)
+	}
+}
+
+func (w *Watchers) deletePattern(addr netip.AddrPort, client *watcher, pattern string) {
+	delete(client.patterns, pattern)
+	w.total--
+	if client.confirmed {
+		w.index.remove(pattern, addr)
+	}
+}
+
+func (w *Watchers) remove(addr netip.AddrPort, client *watcher) {
+	for pattern := range client.patterns {
+		w.deletePattern(addr, client, pattern)
+	}
+	delete(w.clients, addr)
+}
+
+func newToken() string {
+	token := make([]byte, 8)
+	rand.Read(token)
+	return hex.EncodeToString(token)
+}
+
+// watchIndex finds the patterns matching a key without going over every subscription,
+// exact keys are looked up in a map and prefixes in a trie that is walked along the key.
+type watchIndex struct {
+	exact    map[string]map[netip.AddrPort]struct{}
+	prefixes *prefixNode
+}
+
+// prefixNode is the node of the prefix trie reached by a prefix, addrs are the addresses watching the prefix.
+type prefixNode struct {
+	children map[byte]*prefixNode
+	addrs    map[netip.AddrPort]struct{}
+}
+
+func newWatchIndex() watchIndex {
+	return watchIndex{exact: make(map[string]map[netip.AddrPort]struct{}), prefixes: &prefixNode{}}
+}
+
+func (idx watchIndex) add(pattern string, addr netip.AddrPort) {
+	if prefix, ok := strings.CutSuffix(pattern, WATCH_WILDCARD); ok {
+		node := idx.prefixes
+		for i := 0; i < len(prefix); i++ {
+			if node.children == nil {
+				node.children = make(map[byte]*prefixNode)
+			}
+			child, ok := node.children[prefix[i]]
+			if !ok {
+				child = &prefixNode{}
+				node.children[prefix[i]] = child
+			}
+			node = child
+		}
+		if node.addrs == nil {
+			node.addrs = make(map[netip.AddrPort]struct{})
+		}
+		node.addrs[addr] = struct{}{}
+		return
+	}
+
+	addrs, ok := idx.exact[pattern]
+	if !ok {
+		addrs = make(map[netip.AddrPort]struct{})
+		idx.exact[pattern] = addrs
+	}
+	addrs[addr] = struct{}{}
+}
+
+func (idx watchIndex) remove(pattern string, addr netip.AddrPort) {
+	if prefix, ok := strings.CutSuffix(pattern, WATCH_WILDCARD); ok {
+		idx.prefixes.remove(prefix, addr)
+		return
+	}
+	if addrs, ok := idx.exact[pattern]; ok {
+		delete(addrs, addr)
+		if len(addrs) == 0 {
+			delete(idx.exact, pattern)
+		}
+	}
+}
+
+// match calls fn with every pattern matching key and each address watching it.
+func (idx watchIndex) match(key string, fn func(pattern string, addr netip.AddrPort)) {
+	for addr := range idx.exact[key] {
+		fn(key, addr)
+	}
+	node := idx.prefixes
+	for i := 0; node != nil; i++ {
+		for addr := range node.addrs {
+			fn(key[:i]+WATCH_WILDCARD, addr)
+		}
+		if i == len(key) {
+			return
+		}
+		node = node.children[key[i]]
+	}
+}
+
+// remove drops addr from the node of prefix, it reports whether n is left empty so its parent can drop it.
+func (n *prefixNode) remove(prefix string, addr netip.AddrPort) bool {
+	if prefix == "" {
+		delete(n.addrs, addr)
+	} else if child, ok := n.children[prefix[0]]; ok && child.remove(prefix[1:], addr) {
+		delete(n.children, prefix[0])
+	}
+	return len(n.addrs) == 0 && len(n.children) == 0
+}
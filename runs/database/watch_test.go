@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dorimon-1/protohackers/internal/kvstore"
+)
+
+func TestWatchersLimitsAndExpiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	w := NewWatchers(time.Minute, 2)
+	w.now = func() time.Time { return now }
+	alice := netip.MustParseAddrPort("127.0.0.1:1000")
+	bob := netip.MustParseAddrPort("127.0.0.1:2000")
+
+	token, _ := w.Watch(alice, "foo")
+	w.Watch(alice, "users/*")
+	if _, err := w.Watch(alice, "bar"); !errors.Is(err, ErrTooManyWatches) {
+		t.Errorf("third watch = %v, want ErrTooManyWatches", err)
+	}
+	// Renewing a subscription doesn't count against the cap.
+	if _, err := w.Watch(alice, "foo"); err != nil {
+		t.Errorf("renewing foo: %v", err)
+	}
+	w.Confirm(alice, token)
+	token, _ = w.Watch(bob, "users/alice")
+	w.Confirm(bob, token)
+
+	tests := []struct {
+		key  string
+		want []netip.AddrPort
+	}{
+		{"foo", []netip.AddrPort{alice}},
+		{"foobar", []netip.AddrPort{}},
+		{"users/alice", []netip.AddrPort{alice, bob}},
+		{"users/bob", []netip.AddrPort{alice}},
+		{"users", []netip.AddrPort{}},
+	}
+	for _, test := range tests {
+		got := w.Matching(test.key)
+		slices.SortFunc(got, netip.AddrPort.Compare)
+		if !slices.Equal(got, test.want) {
+			t.Errorf("Matching(%s) = %v, want %v", test.key, got, test.want)
+		}
+	}
+
+	now = now.Add(30 * time.Second)
+	w.Watch(alice, "foo")
+	now = now.Add(45 * time.Second)
+	if got := w.Patterns(alice); !slices.Equal(got, []string{"foo"}) {
+		t.Errorf("after the TTL alice watches %v, want only the renewed foo", got)
+	}
+	w.Expire()
+	if got := w.Matching("users/alice"); len(got) != 0 {
+		t.Errorf("expired subscriptions still match: %v", got)
+	}
+	// The expired subscriptions free up room under the cap.
+	if _, err := w.Watch(alice, "bar"); err != nil {
+		t.Errorf("watch after expiry: %v", err)
+	}
+
+	w.Unwatch(alice, "")
+	if got := w.Patterns(alice); len(got) != 0 {
+		t.Errorf("unwatch= left %v", got)
+	}
+}
+
+// TestWatchersIndex checks the index against every pattern of every address, over random subscriptions.
+func TestWatchersIndex(t *testing.T) {
+	w := NewWatchers(time.Minute, 0)
+	random := rand.New(rand.NewPCG(1, 2))
+	addrs := make([]netip.AddrPort, 20)
+	for i := range addrs {
+		addrs[i] = netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), uint16(1000+i))
+	}
+	randomKey := func() string {
+		return []string{"", "a", "ab", "abc", "b", "ba", "abd"}[random.IntN(7)]
+	}
+	matches := func(pattern, key string) bool {
+		if prefix, ok := strings.CutSuffix(pattern, WATCH_WILDCARD); ok {
+			return strings.HasPrefix(key, prefix)
+		}
+		return pattern == key
+	}
+
+	for range 500 {
+		addr := addrs[random.IntN(len(addrs))]
+		pattern := randomKey()
+		if random.IntN(2) == 0 {
+			pattern += WATCH_WILDCARD
+		}
+		switch random.IntN(4) {
+		case 0, 1:
+			if token, _ := w.Watch(addr, pattern); token != "" && random.IntN(2) == 0 {
+				w.Confirm(addr, token)
+			}
+		case 2:
+			w.Unwatch(addr, pattern)
+		case 3:
+			w.Unwatch(addr, "")
+		}
+
+		key := randomKey()
+		want := make([]netip.AddrPort, 0)
+		for _, addr := range addrs {
+			if slices.ContainsFunc(w.Patterns(addr), func(pattern string) bool { return matches(pattern, key) }) {
+				want = append(want, addr)
+			}
+		}
+		got := w.Matching(key)
+		slices.SortFunc(got, netip.AddrPort.Compare)
+		if !slices.Equal(got, want) {
+			t.Fatalf("Matching(%q) = %v, want %v", key, got, want)
+		}
+	}
+
+	// Nothing is left behind in the index once every subscription is gone.
+	for _, addr := range addrs {
+		w.Unwatch(addr, "")
+	}
+	if len(w.index.exact) != 0 || len(w.index.prefixes.children) != 0 || len(w.index.prefixes.addrs) != 0 {
+		t.Errorf("index still holds %v and %+v", w.index.exact, w.index.prefixes)
+	}
+}
+
+func TestWatchersConfirmation(t *testing.T) {
+	now := time.Unix(1000, 0)
+	w := NewWatchers(time.Hour, 0)
+	w.now = func() time.Time { return now }
+	alice := netip.MustParseAddrPort("127.0.0.1:1000")
+	victim := netip.MustParseAddrPort("127.0.0.1:2000")
+
+	token, err := w.Watch(alice, "foo")
+	if err != nil || token == "" {
+		t.Fatalf("first watch = %q, %v, want a token to confirm", token, err)
+	}
+	if again, _ := w.Watch(alice, "bar"); again != token {
+		t.Errorf("second watch asked to confirm %q, want the same token %q", again, token)
+	}
+	if got := w.Matching("foo"); len(got) != 0 {
+		t.Errorf("unconfirmed subscriptions match: %v", got)
+	}
+	if w.Confirm(alice, "wrong") || w.Confirm(victim, token) {
+		t.Error("confirmed with a wrong token or from another address")
+	}
+	if !w.Confirm(alice, token) || len(w.Matching("foo")) != 1 {
+		t.Error("confirmed subscriptions don't match")
+	}
+	if again, _ := w.Watch(alice, "baz"); again != "" {
+		t.Errorf("watch after the confirmation asked to confirm %q", again)
+	}
+
+	// A spoofed victim never confirms, so its subscriptions are dropped.
+	w.Watch(victim, "foo")
+	now = now.Add(CONFIRM_TIMEOUT)
+	w.Expire()
+	if clients, total := w.Len(); clients != 1 || total != 3 {
+		t.Errorf("%d addresses with %d subscriptions left, want only the 3 of alice", clients, total)
+	}
+}
+
+func TestWatchersGlobalLimits(t *testing.T) {
+	w := NewWatchers(time.Hour, 0)
+	w.MaxClients = 2
+	w.MaxTotal = 3
+	addr := func(port uint16) netip.AddrPort {
+		return netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port)
+	}
+
+	w.Watch(addr(1), "a")
+	w.Watch(addr(1), "b")
+	if _, err := w.Watch(addr(2), "a"); err != nil {
+		t.Errorf("second address: %v", err)
+	}
+	if _, err := w.Watch(addr(3), "a"); !errors.Is(err, ErrTooManyWatchers) {
+		t.Errorf("third address = %v, want ErrTooManyWatchers", err)
+	}
+	if _, err := w.Watch(addr(2), "b"); !errors.Is(err, ErrTooManyWatches) {
+		t.Errorf("fourth subscription = %v, want ErrTooManyWatches", err)
+	}
+
+	w.Unwatch(addr(1), "")
+	if _, err := w.Watch(addr(3), "a"); err != nil {
+		t.Errorf("address after an unwatch: %v", err)
+	}
+	if clients, total := w.Len(); clients != 2 || total != 2 {
+		t.Errorf("%d addresses with %d subscriptions, want 2 and 2", clients, total)
+	}
+}
+
+func TestWatchNotifiesUpdates(t *testing.T) {
+	nodes := newNodes(t, 1)
+	nodes[0].server.Watchers = NewWatchers(time.Minute, 4)
+	serveNodes(nodes)
+
+	watcher, err := net.DialUDP("udp", nil, nodes[0].conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	receive := func() string {
+		t.Helper()
+		watcher.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, MAX_DATAGRAM_SIZE)
+		n, err := watcher.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	watcher.Write([]byte("watch=users/*"))
+	confirm := receive()
+	if !strings.HasPrefix(confirm, CONFIRM_KEY+"=") {
+		t.Fatalf("watch answered with %q, want a confirmation request", confirm)
+	}
+	watcher.Write([]byte(confirm))
+	watcher.Write([]byte("watch=exact"))
+
+	watcher.Write([]byte("watch"))
+	if got := receive(); got != "watch=exact,users/*" {
+		t.Fatalf("watch list = %q", got)
+	}
+
+	request(t, nodes[0], "other=1")
+	request(t, nodes[0], "users/alice=hi")
+	if got := receive(); got != "users/alice=hi" {
+		t.Errorf("notification = %q, want users/alice=hi", got)
+	}
+
+	// Writes of the other front-ends and of other nodes are notified too, deletes aren't.
+	nodes[0].server.DB.Delete("users/alice")
+	nodes[0].server.DB.Merge("exact", kvstore.Entry{Value: "replicated", Timestamp: nodes[0].server.DB.Clock.Now()})
+	if got := receive(); got != "exact=replicated" {
+		t.Errorf("notification = %q, want exact=replicated", got)
+	}
+
+	watcher.Write([]byte("unwatch=exact"))
+	request(t, nodes[0], "exact=again")
+	request(t, nodes[0], "users/bob=last")
+	if got := receive(); got != "users/bob=last" {
+		t.Errorf("notification = %q, want users/bob=last after unwatching exact", got)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dorimon-1/protohackers/internal/mitm"
+)
+
+const (
+	TEST_COIN           = "7F1u3wSD5RbOHQmupo9nx4TnhQ"
+	CHAT_WELCOME        = "Welcome to budgetchat! What shall I call you?"
+	CHAT_NAME_TAKEN     = "Invalid Username - %s is already taken"
+	CHAT_START_ATTEMPTS = 50
+)
+
+// startChat builds and runs the budgetchat server of runs/chat, it returns the address it accepts clients on.
+func startChat(t *testing.T) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("builds and runs the chat server")
+	}
+	bin := filepath.Join(t.TempDir(), "chat")
+	if out, err := exec.Command("go", "build", "-o", bin, "../chat").CombinedOutput(); err != nil {
+		t.Fatalf("building the chat server: %s\n%s", err, out)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	cmd := exec.Command(bin, "-listen", addr, "-node", "test")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	for range CHAT_START_ATTEMPTS {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return addr
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("chat server didn't start on %s", addr)
+	return ""
+}
+
+// startMiddlemob starts a chat server and a proxy with the default config in front of it,
+// it returns the addresses of the server and of the proxy.
+func startMiddlemob(t *testing.T) (string, string) {
+	t.Helper()
+	chatAddr := startChat(t)
+
+	config := DefaultConfig()
+	proxy := &mitm.Proxy{
+		Dial:  func() (net.Conn, error) { return net.Dial("tcp", chatAddr) },
+		Codec: config.NewCodec(),
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go proxy.Serve(ln)
+	return chatAddr, ln.Addr().String()
+}
+
+type chatClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialChat(t *testing.T, addr string, username string) *chatClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := &chatClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+	c.expect(CHAT_WELCOME)
+	c.send(username)
+	return c
+}
+
+func (c *chatClient) send(line string) {
+	c.t.Helper()
+	if _, err := fmt.Fprintf(c.conn, "%s\n", line); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *chatClient) expect(want string) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("reading line: %s", err)
+	}
+	if got := strings.TrimSuffix(line, "\n"); got != want {
+		c.t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestMiddlemobRewritesChat(t *testing.T) {
+	chatAddr, proxyAddr := startMiddlemob(t)
+
+	alice := dialChat(t, chatAddr, "alice")
+	alice.expect("* The room contains: ")
+	victim := dialChat(t, proxyAddr, "victim")
+	victim.expect("* The room contains: alice")
+	alice.expect("* victim has entered the room")
+
+	victim.send("send to " + TEST_COIN + " please")
+	alice.expect("[victim] send to " + TONY_ADDRESS + " please")
+	alice.send(TEST_COIN)
+	victim.expect("[alice] " + TONY_ADDRESS)
+
+	victim.conn.Close()
+	alice.expect("* victim has left the room")
+}
+
+func TestMiddlemobClosesWhenChatCloses(t *testing.T) {
+	chatAddr, proxyAddr := startMiddlemob(t)
+
+	alice := dialChat(t, chatAddr, "alice")
+	alice.expect("* The room contains: ")
+
+	// The server closes the session of a taken name, the proxy passes the close on to the client.
+	impostor := dialChat(t, proxyAddr, "alice")
+	impostor.expect(fmt.Sprintf(CHAT_NAME_TAKEN, "alice"))
+	impostor.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := impostor.reader.ReadByte(); err != io.EOF {
+		t.Errorf("read after the server closed = %v, want EOF", err)
+	}
+}
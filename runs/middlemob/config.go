@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/dorimon-1/protohackers/internal/mitm"
+)
+
+const (
+	CHAT_ADDRESS string = "chat.protohackers.com:16963"
+	TONY_ADDRESS string = "7YWHMfk9JZe0LM0g1ZauHuiSxhI"
+	// BOGUSCOIN_PATTERN is an address by the spec: a 7 and then alphanumerics, 26 to 35 characters in all.
+	BOGUSCOIN_PATTERN string = "7[a-zA-Z0-9]{25,34}"
+
+	LINE_CODEC  string = "line"
+	SPEED_CODEC string = "speed"
+)
+
+// Config is loaded from the JSON file given with -config, e.g
+//
+//	{
+//	  "listen": ":3000",
+//	  "upstream": "chat.protohackers.com:16963",
+//	  "upstreams": ["backup.example.com:16963"],
+//	  "capture": "capture.jsonl",
+//	  "coins": [
+//	    {"name": "boguscoin", "pattern": "7[a-zA-Z0-9]{25,34}", "address": "7YWHMfk9JZe0LM0g1ZauHuiSxhI"},
+//	    {"name": "fakecoin", "pattern": "F[A-F0-9]{39}", "address": "F00DF00DF00DF00DF00DF00DF00DF00DF00DF00D"}
+//	  ],
+//	  "rules": [
+//	    {"name": "shout", "regex": "(?i)hello", "replace": "HELLO", "direction": "c2s"}
+//	  ]
+//	}
+//
+// Addresses of every coin are rewritten in both directions before the rules are applied.
+//
+// With "codec": "speed" the proxy speaks the speed daemon protocol and rewrites with speedRules instead, e.g
+//
+//	"speedRules": [
+//	  {"name": "hide", "action": "redact-plate", "plate": "UN[0-9]+X", "direction": "c2s"},
+//	  {"name": "double", "action": "scale-speed", "factor": 2, "direction": "s2c"}
+//	]
+type Config struct {
+	Listen   string `json:"listen"`
+	Upstream string `json:"upstream"`
+	// Upstreams are failed over to, in order, when the ones before them can't be reached.
+	Upstreams []string `json:"upstreams"`
+	// Capture is the file both directions of every session are recorded to, empty records nothing.
+	Capture string `json:"capture"`
+	// Codec is line, the default, or speed.
+	Codec      string          `json:"codec"`
+	Coins      []Coin          `json:"coins"`
+	Rules      mitm.Rules      `json:"rules"`
+	SpeedRules mitm.SpeedRules `json:"speedRules"`
+
+	coinRules mitm.Rules
+}
+
+// Coin is a kind of address that is replaced with Address wherever a whole space separated word matches Pattern.
+type Coin struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	Address string `json:"address"`
+}
+
+// rule returns the token rule that rewrites the coin, it has yet to be compiled.
+func (coin Coin) rule() *mitm.Rule {
+	return &mitm.Rule{
+		Name:      coin.Name,
+		Token:     coin.Pattern,
+		Replace:   strings.ReplaceAll(coin.Address, "$", "$$"),
+		Direction: mitm.BOTH,
+	}
+}
+
+// LineRules are the rules of the line codec, the coins' and then Rules.
+func (c *Config) LineRules() mitm.Rules {
+	return append(slices.Clone(c.coinRules), c.Rules...)
+}
+
+// NewCodec returns the codec the config asked for with its rules.
+func (c *Config) NewCodec() mitm.Codec {
+	if c.Codec == SPEED_CODEC {
+		return mitm.SpeedCodec{Rules: c.SpeedRules}
+	}
+	return mitm.LineCodec{Rules: c.LineRules()}
+}
+
+// DefaultConfig is the Mob in the Middle solution, it sends every Boguscoin to Tony.
+func DefaultConfig() *Config {
+	config := &Config{
+		Listen:   ":3000",
+		Upstream: CHAT_ADDRESS,
+		Coins:    []Coin{{Name: "boguscoin", Pattern: BOGUSCOIN_PATTERN, Address: TONY_ADDRESS}},
+	}
+	if err := config.validate(); err != nil {
+		panic(err)
+	}
+	return config
+}
+
+// UpstreamAddrs returns Upstream followed by Upstreams.
+func (c *Config) UpstreamAddrs() []string {
+	if c.Upstream == "" {
+		return c.Upstreams
+	}
+	return append([]string{c.Upstream}, c.Upstreams...)
+}
+
+// LoadConfig reads the config file at path, listen defaults to :3000 and an upstream is required.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{Listen: ":3000"}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+func (c *Config) validate() error {
+	if len(c.UpstreamAddrs()) == 0 {
+		return errors.New("upstream is required")
+	}
+	if slices.Contains(c.Upstreams, "") {
+		return errors.New("upstreams can't be empty")
+	}
+	switch c.Codec {
+	case "":
+		c.Codec = LINE_CODEC
+	case LINE_CODEC, SPEED_CODEC:
+	default:
+		return fmt.Errorf("unknown codec %q, expected line or speed", c.Codec)
+	}
+	if c.Codec == LINE_CODEC && len(c.SpeedRules) > 0 {
+		return errors.New("speedRules need the speed codec")
+	}
+	if c.Codec == SPEED_CODEC && (len(c.Rules) > 0 || len(c.Coins) > 0) {
+		return errors.New("the speed codec rewrites with speedRules, not rules or coins")
+	}
+
+	c.coinRules = make(mitm.Rules, 0, len(c.Coins))
+	for _, coin := range c.Coins {
+		if coin.Pattern == "" || coin.Address == "" {
+			return fmt.Errorf("coin %q needs a pattern and an address", coin.Name)
+		}
+		rule := coin.rule()
+		if err := rule.Compile(); err != nil {
+			return err
+		}
+		c.coinRules = append(c.coinRules, rule)
+	}
+	for i, rule := range c.Rules {
+		if rule == nil {
+			return fmt.Errorf("rule %d is empty", i)
+		}
+		if err := rule.Compile(); err != nil {
+			return err
+		}
+	}
+	for i, rule := range c.SpeedRules {
+		if rule == nil {
+			return fmt.Errorf("speed rule %d is empty", i)
+		}
+		if err := rule.Compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
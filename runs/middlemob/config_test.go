@@ -0,0 +1,196 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/dorimon-1/protohackers/internal/mitm"
+)
+
+// TestDefaultRulesBoguscoinConformance runs the default rules over the edge cases of the spec and its checker:
+// an address is 26 to 35 alphanumerics starting with a 7, at the start of the message or after a space
+// and at the end of the message or before a space. Nothing else of the message may change.
+func TestDefaultRulesBoguscoinConformance(t *testing.T) {
+	codec := DefaultConfig().NewCodec()
+	coin := func(length int) string { return "7" + strings.Repeat("a1B", 12)[:length-1] }
+	tests := []struct {
+		name string
+		msg  string
+		want string
+	}{
+		{"no address", "Hi alice", "Hi alice"},
+		{"end of message", "Hi alice, please send payment to 7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX", "Hi alice, please send payment to " + TONY_ADDRESS},
+		{"start of message", "7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX please", TONY_ADDRESS + " please"},
+		{"whole message", "7F1u3wSD5RbOHQmupo9nx4TnhQ", TONY_ADDRESS},
+		{
+			"several addresses",
+			"Please pay the ticket price of 15 Boguscoins to one of these addresses: 7YWHMfk9JZe0LM0g1ZauHuiSxhI 7LOrwbDlS8NujgjddyogWgIM93MV5N2VR 7adNeSwJkMakpEcln9HEtthSRtxdmEHOT8T",
+			"Please pay the ticket price of 15 Boguscoins to one of these addresses: " + TONY_ADDRESS + " " + TONY_ADDRESS + " " + TONY_ADDRESS,
+		},
+		{"product id", "This is a product ID, not a Boguscoin: 7adNeSwJkMakpEcln9HEtthSRtxdmEHOT8T-1234", "This is a product ID, not a Boguscoin: 7adNeSwJkMakpEcln9HEtthSRtxdmEHOT8T-1234"},
+		{"shortest", "pay " + coin(26), "pay " + TONY_ADDRESS},
+		{"too short", "pay " + coin(25), "pay " + coin(25)},
+		{"longest", "pay " + coin(35), "pay " + TONY_ADDRESS},
+		{"too long", "pay " + coin(36), "pay " + coin(36)},
+		{"not a 7", "pay 8" + coin(30)[1:], "pay 8" + coin(30)[1:]},
+		{"non ascii", "pay " + coin(27) + "é", "pay " + coin(27) + "é"},
+		{"trailing comma", "pay " + coin(30) + ", thanks", "pay " + coin(30) + ", thanks"},
+		{"trailing period", "pay " + coin(30) + ".", "pay " + coin(30) + "."},
+		{"two spaces", "pay  " + coin(30) + "  now", "pay  " + TONY_ADDRESS + "  now"},
+		{"leading and trailing spaces", "  " + coin(30) + "  ", "  " + TONY_ADDRESS + "  "},
+		{"tab before", "pay\t" + coin(30), "pay\t" + coin(30)},
+		{"tab after", coin(30) + "\tnow", coin(30) + "\tnow"},
+		{"carriage return", "pay " + coin(30) + "\r", "pay " + coin(30) + "\r"},
+		{"tony already", "pay " + TONY_ADDRESS, "pay " + TONY_ADDRESS},
+		{"empty", "", ""},
+	}
+	for _, test := range tests {
+		for _, direction := range []mitm.Direction{mitm.CLIENT_TO_SERVER, mitm.SERVER_TO_CLIENT} {
+			got := codec.Rewrite(direction, []byte(test.msg+"\n"))
+			if string(got) != test.want+"\n" {
+				t.Errorf("%s: Rewrite(%s, %q) = %q, want %q", test.name, direction, test.msg, got, test.want+"\n")
+			}
+		}
+	}
+}
+
+func TestLoadConfigCoins(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{
+		"upstream": "localhost:4000",
+		"coins": [
+			{"name": "boguscoin", "pattern": "7[a-zA-Z0-9]{25,34}", "address": "7YWHMfk9JZe0LM0g1ZauHuiSxhI"},
+			{"name": "fakecoin", "pattern": "F[A-F0-9]{7}", "address": "F$00D"}
+		],
+		"rules": [{"name": "greeting", "regex": "hello", "replace": "hi"}]
+	}`), 0o644)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := "hello 7F1u3wSD5RbOHQmupo9nx4TnhQ FDEADBEE FDEADBEEF"
+	want := "hi " + TONY_ADDRESS + " F$00D FDEADBEEF"
+	if got := config.LineRules().Rewrite(mitm.CLIENT_TO_SERVER, msg); got != want {
+		t.Errorf("Rewrite(%q) = %q, want %q", msg, got, want)
+	}
+
+	for name, config := range map[string]string{
+		"no pattern":     `{"upstream": "x:1", "coins": [{"name": "a", "address": "b"}]}`,
+		"no address":     `{"upstream": "x:1", "coins": [{"name": "a", "pattern": "b"}]}`,
+		"bad pattern":    `{"upstream": "x:1", "coins": [{"name": "a", "pattern": "(", "address": "b"}]}`,
+		"coins on speed": `{"upstream": "x:1", "codec": "speed", "coins": [{"name": "a", "pattern": "b", "address": "c"}]}`,
+	} {
+		path := filepath.Join(t.TempDir(), "config.json")
+		os.WriteFile(path, []byte(config), 0o644)
+		if _, err := LoadConfig(path); err == nil {
+			t.Errorf("%s: loaded without an error", name)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{
+		"upstream": "localhost:4000",
+		"rules": [
+			{"name": "greeting", "regex": "(?i)\\bhello\\b", "replace": "hi", "direction": "c2s"},
+			{"name": "ids", "token": "id-([0-9]+)", "replace": "ID $1", "direction": "s2c"}
+		]
+	}`), 0o644)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Listen != ":3000" || config.Upstream != "localhost:4000" {
+		t.Errorf("got listen %q upstream %q", config.Listen, config.Upstream)
+	}
+
+	tests := []struct {
+		direction mitm.Direction
+		msg, want string
+	}{
+		{mitm.CLIENT_TO_SERVER, "Hello there, id-7", "hi there, id-7"},
+		{mitm.SERVER_TO_CLIENT, "Hello there, id-7", "Hello there, ID 7"},
+		{mitm.SERVER_TO_CLIENT, "user id-42 joined", "user ID 42 joined"},
+	}
+	for _, test := range tests {
+		if got := config.Rules.Rewrite(test.direction, test.msg); got != test.want {
+			t.Errorf("Rewrite(%s, %q) = %q, want %q", test.direction, test.msg, got, test.want)
+		}
+	}
+}
+
+func TestLoadConfigRejectsInvalidRules(t *testing.T) {
+	for name, config := range map[string]string{
+		"no upstream":    `{"rules": []}`,
+		"empty upstream": `{"upstream": "x:1", "upstreams": [""]}`,
+		"both matchers":  `{"upstream": "x:1", "rules": [{"regex": "a", "token": "b"}]}`,
+		"no matcher":     `{"upstream": "x:1", "rules": [{"replace": "b"}]}`,
+		"bad regex":      `{"upstream": "x:1", "rules": [{"regex": "("}]}`,
+		"bad direction":  `{"upstream": "x:1", "rules": [{"regex": "a", "direction": "up"}]}`,
+		"null rule":      `{"upstream": "x:1", "rules": [null]}`,
+		"malformed json": `{"upstream": `,
+	} {
+		path := filepath.Join(t.TempDir(), "config.json")
+		os.WriteFile(path, []byte(config), 0o644)
+		if _, err := LoadConfig(path); err == nil {
+			t.Errorf("%s: loaded without an error", name)
+		}
+	}
+}
+
+func TestLoadConfigSpeedCodec(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{
+		"upstream": "localhost:4000",
+		"codec": "speed",
+		"speedRules": [
+			{"name": "double", "action": "scale-speed", "factor": 2, "direction": "s2c"}
+		]
+	}`), 0o644)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec, ok := config.NewCodec().(mitm.SpeedCodec)
+	if !ok || len(codec.Rules) != 1 || codec.Rules[0].Factor != 2 {
+		t.Errorf("got codec %#v, want the speed codec with the double rule", config.NewCodec())
+	}
+
+	for name, config := range map[string]string{
+		"unknown codec":      `{"upstream": "x:1", "codec": "morse"}`,
+		"speed rule on line": `{"upstream": "x:1", "speedRules": [{"action": "redact-plate"}]}`,
+		"line rule on speed": `{"upstream": "x:1", "codec": "speed", "rules": [{"regex": "a"}]}`,
+		"bad speed rule":     `{"upstream": "x:1", "codec": "speed", "speedRules": [{"action": "scale-speed"}]}`,
+	} {
+		path := filepath.Join(t.TempDir(), "config.json")
+		os.WriteFile(path, []byte(config), 0o644)
+		if _, err := LoadConfig(path); err == nil {
+			t.Errorf("%s: loaded without an error", name)
+		}
+	}
+}
+
+func TestLoadConfigUpstreams(t *testing.T) {
+	for config, want := range map[string][]string{
+		`{"upstream": "a:1"}`:                              {"a:1"},
+		`{"upstream": "a:1", "upstreams": ["b:1", "c:1"]}`: {"a:1", "b:1", "c:1"},
+		`{"upstreams": ["b:1", "c:1"]}`:                    {"b:1", "c:1"},
+	} {
+		path := filepath.Join(t.TempDir(), "config.json")
+		os.WriteFile(path, []byte(config), 0o644)
+		loaded, err := LoadConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := loaded.UpstreamAddrs(); !slices.Equal(got, want) {
+			t.Errorf("%s: upstreams %v, want %v", config, got, want)
+		}
+	}
+}
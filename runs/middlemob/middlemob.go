@@ -1,131 +1,62 @@
 package main
 
 import (
-	"bufio"
-	"io"
+	"flag"
 	"log"
 	"net"
-	"strings"
-)
+	"time"
 
-const (
-	CHAT_ADDRESS string = "chat.protohackers.com:16963"
-	TONY_ADDRESS string = "7YWHMfk9JZe0LM0g1ZauHuiSxhI"
+	"github.com/dorimon-1/protohackers/internal/mitm"
 )
 
 func main() {
-	ln, err := net.Listen("tcp", ":3000")
-	if err != nil {
-		log.Fatalln(err)
-	}
-
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Println(err)
-		}
-
-		server, err := net.Dial("tcp", CHAT_ADDRESS)
-		if err != nil {
-			conn.Close()
-			continue
-		}
-
-		go ServerToClient(conn, server)
-		go ClientToServer(conn, server)
-	}
-}
-
-func ServerToClient(conn net.Conn, server net.Conn) {
-	reader := bufio.NewReader(server)
-	for {
-		msg, err := reader.ReadString('\n')
-		msg = strings.TrimSuffix(msg, "\n")
-		log.Printf("[Server]Message Received: %s", msg)
-		switch {
-		case err == io.EOF || err == io.ErrUnexpectedEOF:
-			log.Println("[Server]Error reading string: ", err)
-			return
-		case err != nil:
-			log.Println("[Server]Error reading string: ", err)
-			return
-		default:
-			err := SendMessage(RewriteMessage(msg), conn)
-			if err != nil {
-				log.Println("[Server]Error sending message: ", err)
-			}
+	configPath := flag.String("config", "", "JSON file with the listen and upstream addresses and the rewrite rules, empty rewrites Boguscoins for the budgetchat server")
+	capture := flag.String("capture", "", "record every session to this file, overrides the capture of the config")
+	healthInterval := flag.Duration("health", 10*time.Second, "how often to check which upstreams are reachable, 0 disables the checks")
+	dialTimeout := flag.Duration("dial-timeout", 5*time.Second, "how long to wait for an upstream to answer")
+	retries := flag.Int("retries", 2, "how many more times to go over the upstreams when none could be reached")
+	backoff := flag.Duration("backoff", 100*time.Millisecond, "pause before the first retry, doubled for every retry after it")
+	pool := flag.Int("pool", 4, "how many upstream connections are kept open ahead of the clients, 0 dials for every client")
+	maxIdle := flag.Duration("pool-idle", 30*time.Second, "how long a pooled connection may wait for a client before it is opened again")
+	flag.Parse()
+
+	config := DefaultConfig()
+	if *configPath != "" {
+		var err error
+		if config, err = LoadConfig(*configPath); err != nil {
+			log.Fatalln(err)
 		}
 	}
-}
-func ClientToServer(conn net.Conn, server net.Conn) {
-	defer func() {
-		server.Close()
-		conn.Close()
-	}()
 
-	reader := bufio.NewReader(conn)
-	for {
-		msg, err := reader.ReadString('\n')
-		msg = strings.TrimSuffix(msg, "\n")
-		log.Printf("[Client] Message Received: %s", msg)
-		switch {
-		case err == io.EOF || err == io.ErrUnexpectedEOF:
-			log.Println("[Client]Error reading string: ", err)
-			return
-		case err != nil:
-			log.Println("[Client]Error reading string: ", err)
-			return
-		default:
-			err := SendMessage(RewriteMessage(msg), server)
-			if err != nil {
-				log.Println("[Client]Error sending message: ", err)
-			}
-		}
+	if *capture != "" {
+		config.Capture = *capture
 	}
-}
-
-func SendMessage(msg string, conn net.Conn) error {
-	msg = msg + string('\n')
-	log.Printf("Writing from %s to %s: %v\n", conn.LocalAddr().String(), conn.RemoteAddr().String(), msg)
-	_, err := conn.Write([]byte(msg))
-	return err
-}
 
-func RewriteMessage(msg string) string {
-	slicedMsg := strings.Split(msg, " ")
-	var caught = false
-
-	for i, subStr := range slicedMsg {
-		if isBoguscoin(subStr) {
-			slicedMsg[i] = TONY_ADDRESS
-			caught = true
-		}
+	ln, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		log.Fatalln(err)
 	}
+	log.Printf("Proxying %s to %v with the %s codec and %d rules", config.Listen, config.UpstreamAddrs(), config.Codec, len(config.LineRules())+len(config.SpeedRules))
 
-	// For optimized messagew write
-	if caught {
-		return strings.Join(slicedMsg, " ")
+	upstreams := mitm.NewUpstreams(config.UpstreamAddrs()...)
+	upstreams.DialTimeout = *dialTimeout
+	upstreams.Retries = *retries
+	upstreams.Backoff = *backoff
+	upstreams.PoolSize = *pool
+	upstreams.MaxIdle = *maxIdle
+	if *healthInterval > 0 {
+		go upstreams.RunHealthChecks(*healthInterval)
 	}
 
-	return msg
-}
-
-func isBoguscoin(substr string) bool {
-	if strlen := len(substr); strlen >= 26 && strlen <= 35 {
-		if substr[0] != '7' || !verifyNumericOnly(substr) {
-			return false
-		}
-		return true
+	proxy := &mitm.Proxy{
+		Dial:  upstreams.Dial,
+		Codec: config.NewCodec(),
 	}
-	return false
-}
-
-func verifyNumericOnly(str string) bool {
-	for _, char := range str {
-		if char >= 65 && char <= 90 || char >= 97 && char <= 122 || char >= 48 && char <= 57 {
-			continue
+	if config.Capture != "" {
+		if proxy.Recorder, err = mitm.CreateRecorder(config.Capture); err != nil {
+			log.Fatalln("Failed to open capture: ", err)
 		}
-		return false
+		log.Printf("Recording sessions to %s", config.Capture)
 	}
-	return true
+	log.Fatalln(proxy.Serve(ln))
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestConformance runs the server main builds on a loopback port and checks it against the Prime Time spec,
+// every case is a connection that sends its requests and reads responses until the server closes it.
+func TestConformance(t *testing.T) {
+	addr := servePipeline(t, newPipeline(false, DEFAULT_PIPELINE_DEPTH, DEFAULT_MAX_LINE, NewQuotas(0, 0, 0)))
+	prime := func(prime bool) string {
+		if prime {
+			return `{"method":"isPrime","prime":true}`
+		}
+		return `{"method":"isPrime","prime":false}`
+	}
+
+	cases := []struct {
+		name     string
+		requests []string
+		want     []string
+	}{
+		{"prime", []string{`{"method":"isPrime","number":7}`}, []string{prime(true)}},
+		{"composite", []string{`{"method":"isPrime","number":91}`}, []string{prime(false)}},
+		{"zero and one", []string{`{"method":"isPrime","number":0}`, `{"method":"isPrime","number":1}`},
+			[]string{prime(false), prime(false)}},
+		{"negative", []string{`{"method":"isPrime","number":-7}`}, []string{prime(false)}},
+		{"float", []string{`{"method":"isPrime","number":7.5}`}, []string{prime(false)}},
+		{"integral float", []string{`{"method":"isPrime","number":7.0}`}, []string{prime(true)}},
+		{"big prime", []string{`{"method":"isPrime","number":170141183460469231731687303715884105727}`},
+			[]string{prime(true)}},
+		{"big composite", []string{`{"method":"isPrime","number":170141183460469231731687303715884105729}`},
+			[]string{prime(false)}},
+		{"key order and extra fields", []string{`{"extra":[1,{"a":null}],"number":13,"method":"isPrime"}`},
+			[]string{prime(true)}},
+		{"extra field of another method", []string{`{"method":"isPrime","number":7,"numbers":"x","from":[]}`},
+			[]string{prime(true)}},
+		{"whitespace", []string{` { "method" : "isPrime" , "number" : 13 } `}, []string{prime(true)}},
+		{"pipelined", []string{
+			`{"method":"isPrime","number":2}`, `{"method":"isPrime","number":4}`, `{"method":"isPrime","number":5}`,
+		}, []string{prime(true), prime(false), prime(true)}},
+
+		{"invalid json", []string{`{"method":"isPrime","number":7`, `{"method":"isPrime","number":7}`},
+			[]string{MALFORMED}},
+		{"empty line", []string{``, `{"method":"isPrime","number":7}`}, []string{MALFORMED}},
+		{"not an object", []string{`[7]`}, []string{MALFORMED}},
+		{"missing method", []string{`{"number":7}`}, []string{MALFORMED}},
+		{"wrong method", []string{`{"method":"isprime","number":7}`}, []string{MALFORMED}},
+		{"missing number", []string{`{"method":"isPrime"}`}, []string{MALFORMED}},
+		{"string number", []string{`{"method":"isPrime","number":"7"}`}, []string{MALFORMED}},
+		{"boolean number", []string{`{"method":"isPrime","number":true}`}, []string{MALFORMED}},
+		{"after valid requests", []string{
+			`{"method":"isPrime","number":3}`, `{"method":"isPrime","number":"3"}`, `{"method":"isPrime","number":3}`,
+		}, []string{prime(true), MALFORMED}},
+
+		// Longer than the 64KB a bufio.Scanner accepts.
+		{"long line", []string{`{"method":"isPrime","padding":"` + strings.Repeat("x", 1<<19) + `","number":11}`},
+			[]string{prime(true)}},
+		{"long number", []string{`{"method":"isPrime","number":1` + strings.Repeat("0", 200000) + `}`},
+			[]string{prime(false)}},
+		{"long malformed line", []string{strings.Repeat("x", 1<<19), `{"method":"isPrime","number":7}`},
+			[]string{MALFORMED}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := exchange(t, addr, c.requests...); strings.Join(got, "\n") != strings.Join(c.want, "\n") {
+				t.Errorf("got %.200q, want %q", got, c.want)
+			}
+		})
+	}
+}
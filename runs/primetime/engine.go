@@ -0,0 +1,235 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"math/big"
+	"math/bits"
+	"sync"
+)
+
+const (
+	// SIEVE_LIMIT is the size of the sieve, numbers below it are looked up instead of tested.
+	SIEVE_LIMIT = 1 << 16
+	// CACHE_SHARDS splits the cache so connections testing different numbers don't wait on each other.
+	CACHE_SHARDS = 16
+	// DEFAULT_CACHE_SIZE is how many answers the engine remembers unless -cache says otherwise.
+	DEFAULT_CACHE_SIZE = 1 << 16
+)
+
+// smallPrimesProduct is the product of the smallPrimes, it fits a uint64 so a single division by it finds them all.
+var smallPrimesProduct = func() *big.Int {
+	product := uint64(1)
+	for _, p := range smallPrimes {
+		product *= p
+	}
+	return new(big.Int).SetUint64(product)
+}()
+
+// sieve[n] reports whether n < SIEVE_LIMIT is a prime.
+var sieve = newSieve(SIEVE_LIMIT)
+
+func newSieve(limit int) []bool {
+	prime := make([]bool, limit)
+	for i := 2; i < limit; i++ {
+		prime[i] = true
+	}
+	for i := 2; i*i < limit; i++ {
+		if prime[i] {
+			for j := i * i; j < limit; j += i {
+				prime[j] = false
+			}
+		}
+	}
+	return prime
+}
+
+// millerRabinBases are the first 12 primes, testing them is deterministic for every n < 3.3*10^24 and so every uint64.
+var millerRabinBases = []uint64{2, 3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37}
+
+// isPrime64 is exact for every uint64, it looks small numbers up in the sieve and runs a deterministic
+// Miller-Rabin on the others that have no small factor.
+func isPrime64(n uint64) bool {
+	if n < SIEVE_LIMIT {
+		return sieve[n]
+	}
+	for _, p := range smallPrimes {
+		if n%p == 0 {
+			return false
+		}
+	}
+	return millerRabin(n)
+}
+
+// millerRabin tests an odd n greater than every base.
+func millerRabin(n uint64) bool {
+	s := bits.TrailingZeros64(n - 1)
+	d := (n - 1) >> s
+
+	for _, a := range millerRabinBases {
+		x := powMod(a, d, n)
+		if x == 1 || x == n-1 {
+			continue
+		}
+		witness := true
+		for r := 1; r < s; r++ {
+			x = mulMod(x, x, n)
+			if x == n-1 {
+				witness = false
+				break
+			}
+		}
+		if witness {
+			return false
+		}
+	}
+	return true
+}
+
+func mulMod(a, b, m uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	return bits.Rem64(hi, lo, m)
+}
+
+func powMod(base, exponent, m uint64) uint64 {
+	result := uint64(1)
+	base %= m
+	for ; exponent > 0; exponent >>= 1 {
+		if exponent&1 == 1 {
+			result = mulMod(result, base, m)
+		}
+		base = mulMod(base, base, m)
+	}
+	return result
+}
+
+// Engine answers whether numbers are primes, remembering the answers for numbers above 64 bits in an LRU cache.
+// Numbers that fit 64 bits are tested faster than they are looked up, so they aren't cached. The cache keys on
+// the SHA-256 of a number, so an entry takes the same memory however long the number is.
+// It is safe for concurrent use and is shared by every connection.
+//
+// A number above 64 bits without a small factor takes cubic time in its length to test, so at most the capacity
+// of bigTests run at once and the cores left over keep answering everything else.
+type Engine struct {
+	shards   [CACHE_SHARDS]cacheShard
+	bigTests chan struct{}
+}
+
+type cacheShard struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[cacheKey]*list.Element
+	order    *list.List
+}
+
+type cacheKey [sha256.Size]byte
+
+type cacheEntry struct {
+	key   cacheKey
+	prime bool
+}
+
+// NewEngine returns an engine that caches up to capacity answers, 0 caches nothing.
+func NewEngine(capacity int) *Engine {
+	e := &Engine{}
+	for i := range e.shards {
+		e.shards[i] = cacheShard{
+			capacity: (capacity + CACHE_SHARDS - 1) / CACHE_SHARDS,
+			entries:  make(map[cacheKey]*list.Element),
+			order:    list.New(),
+		}
+	}
+	return e
+}
+
+func (e *Engine) IsPrime(n Number) bool {
+	if n.Negative || n.Exponent != 0 {
+		return false
+	}
+	if n.Digits.IsUint64() {
+		return isPrime64(n.Digits.Uint64())
+	}
+
+	// Numbers with a small factor are answered faster than they are looked up.
+	if hasSmallFactor(n.Digits) {
+		return false
+	}
+
+	key := cacheKey(sha256.Sum256(n.Digits.Bytes()))
+	shard := &e.shards[key[0]%CACHE_SHARDS]
+	if prime, ok := shard.get(key); ok {
+		return prime
+	}
+	if e.bigTests != nil {
+		e.bigTests <- struct{}{}
+		defer func() { <-e.bigTests }()
+	}
+	prime := isPrimeBig(n.Digits)
+	shard.put(key, prime)
+	return prime
+}
+
+// LimitBigTests bounds how many numbers above 64 bits are tested at once, the others wait. 0 means no limit,
+// it has to be called before the engine is used.
+func (e *Engine) LimitBigTests(n int) {
+	e.bigTests = nil
+	if n > 0 {
+		e.bigTests = make(chan struct{}, n)
+	}
+}
+
+// hasSmallFactor reports whether one of the smallPrimes divides n, which is larger than all of them.
+func hasSmallFactor(n *big.Int) bool {
+	r := new(big.Int).Mod(n, smallPrimesProduct).Uint64()
+	for _, p := range smallPrimes {
+		if r%p == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrimeBig runs Baillie-PSW with 20 extra Miller-Rabin rounds, there is no known number it gets wrong.
+func isPrimeBig(n *big.Int) bool {
+	return n.ProbablyPrime(20)
+}
+
+func (s *cacheShard) get(key cacheKey) (bool, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	element, ok := s.entries[key]
+	if !ok {
+		return false, false
+	}
+	s.order.MoveToFront(element)
+	return element.Value.(*cacheEntry).prime, true
+}
+
+func (s *cacheShard) put(key cacheKey, prime bool) {
+	if s.capacity == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if element, ok := s.entries[key]; ok {
+		s.order.MoveToFront(element)
+		return
+	}
+	s.entries[key] = s.order.PushFront(&cacheEntry{key: key, prime: prime})
+	if s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Len returns how many answers are cached.
+func (e *Engine) Len() int {
+	n := 0
+	for i := range e.shards {
+		e.shards[i].mu.Lock()
+		n += e.shards[i].order.Len()
+		e.shards[i].mu.Unlock()
+	}
+	return n
+}
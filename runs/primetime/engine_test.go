@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestSieve(t *testing.T) {
+	count := 0
+	for _, prime := range sieve {
+		if prime {
+			count++
+		}
+	}
+	if count != 6542 {
+		t.Errorf("sieve has %d primes below 2^16, want 6542", count)
+	}
+}
+
+func TestIsPrime64MatchesBigInt(t *testing.T) {
+	numbers := []uint64{
+		0, 1, 2, 3, 4, SIEVE_LIMIT - 1, SIEVE_LIMIT, SIEVE_LIMIT + 1, 65537,
+		// Strong pseudoprimes to the first few prime bases.
+		2047, 1373653, 25326001, 3215031751, 2152302898747, 3474749660383, 341550071728321,
+		3825123056546413051,
+		4294967291 * 4294967279, math.MaxUint64, math.MaxUint64 - 58,
+	}
+	for n := uint64(0); n < 100000; n++ {
+		numbers = append(numbers, n)
+	}
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		numbers = append(numbers, random.Uint64(), random.Uint64()>>32|1)
+	}
+
+	for _, n := range numbers {
+		// ProbablyPrime is exact below 2^64.
+		if got, want := isPrime64(n), new(big.Int).SetUint64(n).ProbablyPrime(0); got != want {
+			t.Errorf("isPrime64(%d) = %v, want %v", n, got, want)
+		}
+	}
+}
+
+func TestEngineCachesBigNumbers(t *testing.T) {
+	e := NewEngine(CACHE_SHARDS)
+	mersenne := func(p uint) *big.Int {
+		return new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), p), big.NewInt(1))
+	}
+	prime := Number{Digits: mersenne(127)}
+	// Neither factor is small, so the composite has to be tested like a prime.
+	composite := Number{Digits: new(big.Int).Mul(mersenne(61), mersenne(89))}
+
+	for i := 0; i < 2; i++ {
+		if !e.IsPrime(prime) || e.IsPrime(composite) {
+			t.Fatalf("round %d: wrong answers for 2^127-1 and (2^61-1)(2^89-1)", i)
+		}
+	}
+	if e.Len() != 2 {
+		t.Errorf("cached %d answers, want 2", e.Len())
+	}
+	if e.IsPrime(Number{Digits: new(big.Int).Add(prime.Digits, big.NewInt(2))}) || e.Len() != 2 {
+		t.Errorf("2^127+1 is a multiple of 3, it is answered without being cached, got %d answers", e.Len())
+	}
+
+	if !e.IsPrime(Number{Digits: big.NewInt(7)}) || e.Len() != 2 {
+		t.Errorf("small numbers are tested, not cached, got %d answers", e.Len())
+	}
+
+	// One answer fits every shard, so filling the engine evicts the oldest answers.
+	for i := 0; i < 10*CACHE_SHARDS; i++ {
+		e.IsPrime(Number{Digits: new(big.Int).Add(composite.Digits, big.NewInt(int64(2*i+2)))})
+	}
+	if e.Len() > CACHE_SHARDS {
+		t.Errorf("cached %d answers, want at most %d", e.Len(), CACHE_SHARDS)
+	}
+
+	if NewEngine(0).IsPrime(prime) != true {
+		t.Error("an engine without a cache got 2^127-1 wrong")
+	}
+}
+
+func TestEngineLimitsBigTests(t *testing.T) {
+	e := NewEngine(0)
+	e.LimitBigTests(1)
+	prime := Number{Digits: new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 521), big.NewInt(1))}
+
+	// Hold the only slot, a big test waits for it while small numbers and small factors are still answered.
+	e.bigTests <- struct{}{}
+	done := make(chan bool)
+	go func() { done <- e.IsPrime(prime) }()
+	if !e.IsPrime(Number{Digits: big.NewInt(7)}) || e.IsPrime(Number{Digits: new(big.Int).Add(prime.Digits, big.NewInt(1))}) {
+		t.Error("wrong answers while the big tests are busy")
+	}
+	select {
+	case <-done:
+		t.Fatal("a big test ran beyond the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	<-e.bigTests
+	if !<-done {
+		t.Error("2^521-1 is a prime")
+	}
+}
+
+// mixedWorkload are request lines like the ones the checker sends, mostly small and 32 bit integers,
+// some 53 and 64 bit ones, floats, and big numbers that repeat.
+func mixedWorkload() [][]byte {
+	random := rand.New(rand.NewSource(2))
+	lines := make([][]byte, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		var number string
+		switch i % 10 {
+		case 0, 1, 2:
+			number = fmt.Sprint(random.Intn(SIEVE_LIMIT))
+		case 3, 4, 5:
+			number = fmt.Sprint(random.Uint32())
+		case 6:
+			number = fmt.Sprint(random.Int63n(1 << 53))
+		case 7:
+			number = fmt.Sprint(random.Int63())
+		case 8:
+			number = fmt.Sprintf("%d.5", random.Intn(1000))
+		case 9:
+			top := new(big.Int).Lsh(big.NewInt(1), 127)
+			number = top.Sub(top, big.NewInt(int64(random.Intn(10)))).String()
+		}
+		lines = append(lines, []byte(`{"method":"isPrime","number":`+number+`}`))
+	}
+	return lines
+}
+
+// legacyIsPrime is how isPrime was answered before the engine, through a float64 and 11 rounds of ProbablyPrime.
+func legacyIsPrime(line []byte) bool {
+	var req struct {
+		Method string   `json:"method"`
+		Number *float64 `json:"number"`
+	}
+	json.Unmarshal(line, &req)
+	if float64(int(*req.Number)) != *req.Number {
+		return false
+	}
+	return big.NewInt(int64(*req.Number)).ProbablyPrime(11)
+}
+
+func engineIsPrime(e *Engine, line []byte) bool {
+	var req request
+	json.Unmarshal(line, &req)
+	number, _ := ParseNumber(req.Number)
+	return e.IsPrime(number)
+}
+
+func BenchmarkLegacyMixed(b *testing.B) {
+	lines := mixedWorkload()
+	for i := 0; i < b.N; i++ {
+		legacyIsPrime(lines[i%len(lines)])
+	}
+}
+
+func BenchmarkEngineMixed(b *testing.B) {
+	lines := mixedWorkload()
+	e := NewEngine(DEFAULT_CACHE_SIZE)
+	for i := 0; i < b.N; i++ {
+		engineIsPrime(e, lines[i%len(lines)])
+	}
+}
+
+func BenchmarkEngineMixedUncached(b *testing.B) {
+	lines := mixedWorkload()
+	e := NewEngine(0)
+	for i := 0; i < b.N; i++ {
+		engineIsPrime(e, lines[i%len(lines)])
+	}
+}
+
+func BenchmarkLegacyMixedParallel(b *testing.B) {
+	lines := mixedWorkload()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			legacyIsPrime(lines[i%len(lines)])
+		}
+	})
+}
+
+func BenchmarkEngineMixedParallel(b *testing.B) {
+	lines := mixedWorkload()
+	e := NewEngine(DEFAULT_CACHE_SIZE)
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			engineIsPrime(e, lines[i%len(lines)])
+		}
+	})
+}
+
+func BenchmarkIsPrime64(b *testing.B) {
+	random := rand.New(rand.NewSource(3))
+	numbers := make([]uint64, 1024)
+	for i := range numbers {
+		numbers[i] = random.Uint64() | 1
+	}
+	b.Run("engine", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			isPrime64(numbers[i%len(numbers)])
+		}
+	})
+	b.Run("ProbablyPrime(11)", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			new(big.Int).SetUint64(numbers[i%len(numbers)]).ProbablyPrime(11)
+		}
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+)
+
+// JSON-RPC 2.0 error codes.
+const (
+	PARSE_ERROR      = -32700
+	INVALID_REQUEST  = -32600
+	METHOD_NOT_FOUND = -32601
+	INVALID_PARAMS   = -32602
+	INTERNAL_ERROR   = -32603
+)
+
+// rpcRequest is a JSON-RPC 2.0 request, ID is nil for a notification and "null" when the id is null.
+// Params are by name and are the fields of a classic request, e.g {"number":7} or {"from":10,"to":20}.
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  *string         `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    string `json:"data,omitempty"`
+}
+
+// rpcResponse has either a Result, the response the method has in the classic mode, or an Error.
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+var nullID = json.RawMessage("null")
+
+func newRPCError(id json.RawMessage, code int, message string, data string) *rpcResponse {
+	return &rpcResponse{JSONRPC: "2.0", Error: &rpcError{Code: code, Message: message, Data: data}, ID: id}
+}
+
+// answerJSONRPCLine answers a line holding a JSON-RPC 2.0 request or batch. Unlike the classic mode a bad request
+// is answered with an error object and the connection stays open.
+func answerJSONRPCLine(line []byte) ([]byte, bool) {
+	return answerJSONRPC(line), false
+}
+
+// answerJSONRPC returns the response to a line holding a request or a batch of them,
+// nil when the line only held notifications.
+func answerJSONRPC(line []byte) []byte {
+	if !json.Valid(line) {
+		return marshalRPC(newRPCError(nullID, PARSE_ERROR, "Parse error", ""))
+	}
+
+	trimmed := bytes.TrimSpace(line)
+	if len(trimmed) == 0 || trimmed[0] != '[' {
+		resp := answerRPCRequest(trimmed)
+		if resp == nil {
+			return nil
+		}
+		return marshalRPC(resp)
+	}
+
+	var batch []json.RawMessage
+	json.Unmarshal(trimmed, &batch)
+	if len(batch) == 0 {
+		return marshalRPC(newRPCError(nullID, INVALID_REQUEST, "Invalid Request", "empty batch"))
+	}
+	responses := make([]*rpcResponse, 0, len(batch))
+	for _, raw := range batch {
+		if resp := answerRPCRequest(raw); resp != nil {
+			responses = append(responses, resp)
+		}
+	}
+	if len(responses) == 0 {
+		return nil
+	}
+	return marshalRPC(responses)
+}
+
+// answerRPCRequest answers a single request, it returns nil for a notification, even one that failed.
+func answerRPCRequest(raw json.RawMessage) *rpcResponse {
+	var req rpcRequest
+	if err := json.Unmarshal(raw, &req); err != nil || req.JSONRPC != "2.0" || req.Method == nil || !validID(req.ID) {
+		return newRPCError(requestID(raw), INVALID_REQUEST, "Invalid Request", "")
+	}
+
+	resp := answerRPCMethod(*req.Method, req.Params)
+	if req.ID == nil {
+		return nil
+	}
+	resp.ID = req.ID
+	return resp
+}
+
+func answerRPCMethod(name string, params json.RawMessage) *rpcResponse {
+	method, ok := methods[name]
+	if !ok {
+		return newRPCError(nil, METHOD_NOT_FOUND, "Method not found", name)
+	}
+
+	var req request
+	if params != nil && !bytes.Equal(params, nullID) {
+		if err := json.Unmarshal(params, &req); err != nil {
+			return newRPCError(nil, INVALID_PARAMS, "Invalid params", "params have to be an object of named numbers")
+		}
+	}
+	req.Method = name
+
+	result, err := method(req)
+	if err != nil {
+		return newRPCError(nil, INVALID_PARAMS, "Invalid params", err.Error())
+	}
+	return &rpcResponse{JSONRPC: "2.0", Result: result}
+}
+
+// requestID returns the id of an invalid request, or null when it has none that is valid.
+func requestID(raw json.RawMessage) json.RawMessage {
+	var req struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if err := json.Unmarshal(raw, &req); err != nil || req.ID == nil || !validID(req.ID) {
+		return nullID
+	}
+	return req.ID
+}
+
+// validID reports whether id is missing, a string, a number or null, the spec allows nothing else.
+func validID(id json.RawMessage) bool {
+	if id == nil {
+		return true
+	}
+	switch id[0] {
+	case '"', 'n', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return true
+	}
+	return false
+}
+
+func marshalRPC(v any) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Println("failed to marshal", err)
+		return marshalRPC(newRPCError(nullID, INTERNAL_ERROR, "Internal error", ""))
+	}
+	return data
+}
@@ -0,0 +1,87 @@
+package main
+
+import "testing"
+
+func TestAnswerJSONRPC(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{
+			"result",
+			`{"jsonrpc":"2.0","method":"isPrime","params":{"number":7},"id":1}`,
+			`{"jsonrpc":"2.0","result":{"method":"isPrime","prime":true},"id":1}`,
+		},
+		{
+			"string id",
+			`{"jsonrpc":"2.0","method":"factorize","params":{"number":12},"id":"abc"}`,
+			`{"jsonrpc":"2.0","result":{"method":"factorize","factors":[2,2,3]},"id":"abc"}`,
+		},
+		{
+			"null id is not a notification",
+			`{"jsonrpc":"2.0","method":"nextPrime","params":{"number":7},"id":null}`,
+			`{"jsonrpc":"2.0","result":{"method":"nextPrime","number":11},"id":null}`,
+		},
+		{"notification", `{"jsonrpc":"2.0","method":"isPrime","params":{"number":7}}`, ``},
+		{"failed notification", `{"jsonrpc":"2.0","method":"nope"}`, ``},
+		{
+			"parse error",
+			`{"jsonrpc":"2.0","method":"isPrime"`,
+			`{"jsonrpc":"2.0","error":{"code":-32700,"message":"Parse error"},"id":null}`,
+		},
+		{
+			"wrong version",
+			`{"jsonrpc":"1.0","method":"isPrime","params":{"number":7},"id":3}`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":3}`,
+		},
+		{
+			"method not a string",
+			`{"jsonrpc":"2.0","method":1,"id":4}`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":4}`,
+		},
+		{
+			"object id",
+			`{"jsonrpc":"2.0","method":"isPrime","id":{}}`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}`,
+		},
+		{
+			"not an object",
+			`"isPrime"`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}`,
+		},
+		{
+			"method not found",
+			`{"jsonrpc":"2.0","method":"isEven","params":{"number":2},"id":5}`,
+			`{"jsonrpc":"2.0","error":{"code":-32601,"message":"Method not found","data":"isEven"},"id":5}`,
+		},
+		{
+			"invalid params",
+			`{"jsonrpc":"2.0","method":"isPrime","params":{"number":"7"},"id":6}`,
+			`{"jsonrpc":"2.0","error":{"code":-32602,"message":"Invalid params","data":"not a JSON number"},"id":6}`,
+		},
+		{
+			"positional params",
+			`{"jsonrpc":"2.0","method":"isPrime","params":[7],"id":7}`,
+			`{"jsonrpc":"2.0","error":{"code":-32602,"message":"Invalid params","data":"params have to be an object of named numbers"},"id":7}`,
+		},
+		{
+			"batch",
+			`[{"jsonrpc":"2.0","method":"isPrime","params":{"number":4},"id":1},{"jsonrpc":"2.0","method":"isPrime","params":{"number":5}},1,{"jsonrpc":"2.0","method":"gcd","params":{"numbers":[4,6]},"id":2}]`,
+			`[{"jsonrpc":"2.0","result":{"method":"isPrime","prime":false},"id":1},` +
+				`{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null},` +
+				`{"jsonrpc":"2.0","result":{"method":"gcd","number":2},"id":2}]`,
+		},
+		{"batch of notifications", `[{"jsonrpc":"2.0","method":"isPrime","params":{"number":5}}]`, ``},
+		{
+			"empty batch",
+			`[]`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request","data":"empty batch"},"id":null}`,
+		},
+	}
+	for _, test := range tests {
+		if got := string(answerJSONRPC([]byte(test.line))); got != test.want {
+			t.Errorf("%s:\n got %s\nwant %s", test.name, got, test.want)
+		}
+	}
+}
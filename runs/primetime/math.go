@@ -0,0 +1,182 @@
+package main
+
+import (
+	"math/big"
+	"math/bits"
+	"slices"
+)
+
+var smallPrimes = []uint64{2, 3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37, 41, 43, 47}
+
+// Factorize returns the prime factors of n in ascending order, with repetitions. 1 has none and 0 has no factorization.
+func Factorize(n uint64) []uint64 {
+	factors := make([]uint64, 0)
+	if n == 0 {
+		return factors
+	}
+	for _, p := range smallPrimes {
+		for n%p == 0 {
+			factors = append(factors, p)
+			n /= p
+		}
+	}
+	factors = factorize(n, factors)
+	slices.Sort(factors)
+	return factors
+}
+
+func factorize(n uint64, factors []uint64) []uint64 {
+	if n == 1 {
+		return factors
+	}
+	if isPrime64(n) {
+		return append(factors, n)
+	}
+	d := pollardRho(n)
+	factors = factorize(d, factors)
+	return factorize(n/d, factors)
+}
+
+// pollardRho returns a non trivial divisor of n, an odd composite.
+func pollardRho(n uint64) uint64 {
+	for c := uint64(1); ; c++ {
+		f := func(x uint64) uint64 {
+			r, carry := bits.Add64(mulMod(x, x, n), c, 0)
+			if carry != 0 || r >= n {
+				r -= n
+			}
+			return r
+		}
+
+		x, y, d := uint64(2), uint64(2), uint64(1)
+		for d == 1 {
+			x = f(x)
+			y = f(f(y))
+			d = gcd64(max(x, y)-min(x, y), n)
+		}
+		if d != n {
+			return d
+		}
+	}
+}
+
+func gcd64(a, b uint64) uint64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// IsPerfect reports whether n is the sum of its proper divisors, like 6 = 1 + 2 + 3.
+func IsPerfect(n uint64) bool {
+	if n < 2 {
+		return false
+	}
+
+	// The sum of the divisors of p^k is (p^(k+1) - 1) / (p - 1), and the sum is multiplicative.
+	sum := big.NewInt(1)
+	factors := Factorize(n)
+	for i := 0; i < len(factors); {
+		p, k := factors[i], 0
+		for i < len(factors) && factors[i] == p {
+			i++
+			k++
+		}
+		bigP := new(big.Int).SetUint64(p)
+		term := new(big.Int).Exp(bigP, big.NewInt(int64(k+1)), nil)
+		term.Sub(term, big.NewInt(1))
+		term.Div(term, bigP.Sub(bigP, big.NewInt(1)))
+		sum.Mul(sum, term)
+	}
+
+	twice := new(big.Int).SetUint64(n)
+	return sum.Cmp(twice.Lsh(twice, 1)) == 0
+}
+
+// NextPrime returns the smallest prime greater than n.
+func NextPrime(n *big.Int) *big.Int {
+	two := big.NewInt(2)
+	if n.Cmp(two) < 0 {
+		return two
+	}
+
+	candidate := new(big.Int).Add(n, big.NewInt(1))
+	if candidate.Bit(0) == 0 {
+		candidate.Add(candidate, big.NewInt(1))
+	}
+	for !candidate.ProbablyPrime(20) {
+		candidate.Add(candidate, two)
+	}
+	return candidate
+}
+
+// SEGMENT_SIZE is how many numbers PrimesInRange sieves at a time.
+const SEGMENT_SIZE = 1 << 15
+
+// sievePrimes are the primes below SIEVE_LIMIT, they cross out the composites of a segment.
+var sievePrimes = func() []uint64 {
+	primes := make([]uint64, 0)
+	for n, prime := range sieve {
+		if prime {
+			primes = append(primes, uint64(n))
+		}
+	}
+	return primes
+}()
+
+// PrimesInRange returns the primes between from and to, both included, in ascending order.
+// It stops after limit primes and reports whether there were more.
+// The range is sieved a segment at a time with the sievePrimes, which leaves only primes below SIEVE_LIMIT^2.
+// Above it the few numbers left have no factor below SIEVE_LIMIT and are tested with Miller-Rabin.
+func PrimesInRange(from, to uint64, limit int) ([]uint64, bool) {
+	primes := make([]uint64, 0)
+	composite := make([]bool, SEGMENT_SIZE)
+	for low := from; low <= to; low += SEGMENT_SIZE {
+		high := to
+		if to-low >= SEGMENT_SIZE {
+			high = low + SEGMENT_SIZE - 1
+		}
+		size := high - low + 1
+		clear(composite[:size])
+
+		for _, p := range sievePrimes {
+			if p*p > high {
+				break
+			}
+			// Multiples of p below p*p have a smaller factor, they are crossed out by it and p itself stays.
+			offset := (p - low%p) % p
+			if offset >= size {
+				continue
+			}
+			start := max(low+offset, p*p) - low
+			for i := start; i < size; i += p {
+				composite[i] = true
+			}
+		}
+
+		for i := range size {
+			n := low + i
+			if composite[i] || n < 2 || n >= SIEVE_LIMIT*SIEVE_LIMIT && !millerRabin(n) {
+				continue
+			}
+			if len(primes) == limit {
+				return primes, true
+			}
+			primes = append(primes, n)
+		}
+
+		if high == to {
+			break
+		}
+	}
+	return primes, false
+}
+
+// GCD returns the greatest common divisor of numbers, which is never negative.
+func GCD(numbers ...*big.Int) *big.Int {
+	gcd := new(big.Int)
+	for _, n := range numbers {
+		gcd.GCD(nil, nil, gcd, new(big.Int).Abs(n))
+	}
+	return gcd
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+const (
+	// MAX_RANGE_PRIMES caps the primes a primesInRange response lists.
+	MAX_RANGE_PRIMES = 10000
+	// MAX_NEXT_PRIME_DIGITS bounds the numbers nextPrime searches after, the search is quadratic in their size.
+	MAX_NEXT_PRIME_DIGITS = 150
+	// MAX_GCD_DIGITS and MAX_GCD_NUMBERS bound the numbers of a gcd request.
+	MAX_GCD_DIGITS  = 10000
+	MAX_GCD_NUMBERS = 1000
+)
+
+// engine answers isPrime for every connection.
+var engine = NewEngine(DEFAULT_CACHE_SIZE)
+
+// methods answer a request, every error makes the request malformed.
+var methods = map[string]func(request) (any, error){
+	"isPrime":       isPrimeMethod,
+	"factorize":     factorizeMethod,
+	"isPerfect":     isPerfectMethod,
+	"nextPrime":     nextPrimeMethod,
+	"primesInRange": primesInRangeMethod,
+	"gcd":           gcdMethod,
+}
+
+type factorsResponse struct {
+	Method  string   `json:"method"`
+	Factors []uint64 `json:"factors"`
+}
+
+type perfectResponse struct {
+	Method  string `json:"method"`
+	Perfect bool   `json:"perfect"`
+}
+
+type numberResponse struct {
+	Method string   `json:"method"`
+	Number *big.Int `json:"number"`
+}
+
+type primesResponse struct {
+	Method string   `json:"method"`
+	Primes []uint64 `json:"primes"`
+	// Truncated is set when the range had more than MAX_RANGE_PRIMES primes.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// isPrimeMethod answers {"method":"isPrime","number":7} with {"method":"isPrime","prime":true}.
+func isPrimeMethod(req request) (any, error) {
+	number, err := ParseNumber(req.Number)
+	if err != nil {
+		return nil, err
+	}
+	return newResponse(req.Method, engine.IsPrime(number)), nil
+}
+
+// factorizeMethod answers {"method":"factorize","number":12} with {"method":"factorize","factors":[2,2,3]},
+// number has to be an integer from 1 to 2^64-1.
+func factorizeMethod(req request) (any, error) {
+	n, err := parseUint64(req.Number)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, errors.New("0 has no factorization")
+	}
+	return &factorsResponse{Method: req.Method, Factors: Factorize(n)}, nil
+}
+
+// isPerfectMethod answers {"method":"isPerfect","number":28} with {"method":"isPerfect","perfect":true},
+// number has to be an integer from 0 to 2^64-1.
+func isPerfectMethod(req request) (any, error) {
+	n, err := parseUint64(req.Number)
+	if err != nil {
+		return nil, err
+	}
+	return &perfectResponse{Method: req.Method, Perfect: IsPerfect(n)}, nil
+}
+
+// nextPrimeMethod answers {"method":"nextPrime","number":7} with {"method":"nextPrime","number":11},
+// number has to be an integer of at most MAX_NEXT_PRIME_DIGITS digits.
+func nextPrimeMethod(req request) (any, error) {
+	n, err := parseInt(req.Number, MAX_NEXT_PRIME_DIGITS)
+	if err != nil {
+		return nil, err
+	}
+	return &numberResponse{Method: req.Method, Number: NextPrime(n)}, nil
+}
+
+// primesInRangeMethod answers {"method":"primesInRange","from":10,"to":20} with
+// {"method":"primesInRange","primes":[11,13,17,19]}, from and to are included and are integers from 0 to 2^64-1.
+// Only the first MAX_RANGE_PRIMES primes are listed, with "truncated":true.
+func primesInRangeMethod(req request) (any, error) {
+	from, err := parseUint64(req.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseUint64(req.To)
+	if err != nil {
+		return nil, err
+	}
+	primes, truncated := PrimesInRange(from, to, MAX_RANGE_PRIMES)
+	return &primesResponse{Method: req.Method, Primes: primes, Truncated: truncated}, nil
+}
+
+// gcdMethod answers {"method":"gcd","numbers":[12,-18]} with {"method":"gcd","number":6},
+// numbers has to hold between 1 and MAX_GCD_NUMBERS integers of at most MAX_GCD_DIGITS digits.
+func gcdMethod(req request) (any, error) {
+	// numbers is only decoded here, every other method ignores it like any extra field.
+	var raws []json.RawMessage
+	if err := json.Unmarshal(req.Numbers, &raws); err != nil {
+		return nil, errors.New("numbers has to be an array")
+	}
+	if len(raws) == 0 || len(raws) > MAX_GCD_NUMBERS {
+		return nil, fmt.Errorf("gcd needs between 1 and %d numbers", MAX_GCD_NUMBERS)
+	}
+	numbers := make([]*big.Int, len(raws))
+	for i, raw := range raws {
+		n, err := parseInt(raw, MAX_GCD_DIGITS)
+		if err != nil {
+			return nil, err
+		}
+		numbers[i] = n
+	}
+	return &numberResponse{Method: req.Method, Number: GCD(numbers...)}, nil
+}
+
+func parseInt(raw json.RawMessage, maxDigits int) (*big.Int, error) {
+	number, err := ParseNumber(raw)
+	if err != nil {
+		return nil, err
+	}
+	return number.Int(maxDigits)
+}
+
+func parseUint64(raw json.RawMessage) (uint64, error) {
+	number, err := ParseNumber(raw)
+	if err != nil {
+		return 0, err
+	}
+	return number.Uint64()
+}
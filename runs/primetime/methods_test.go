@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFactorize(t *testing.T) {
+	tests := []struct {
+		n    uint64
+		want []uint64
+	}{
+		{1, []uint64{}},
+		{2, []uint64{2}},
+		{12, []uint64{2, 2, 3}},
+		{97, []uint64{97}},
+		{1 << 20, []uint64{2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2}},
+		{600851475143, []uint64{71, 839, 1471, 6857}},
+		{18446744073709551557, []uint64{18446744073709551557}},
+		{4294967291 * 4294967279, []uint64{4294967279, 4294967291}},
+		{4294967291 * 4294967291, []uint64{4294967291, 4294967291}},
+		{math.MaxUint64, []uint64{3, 5, 17, 257, 641, 65537, 6700417}},
+	}
+	for _, test := range tests {
+		if got := Factorize(test.n); !slices.Equal(got, test.want) {
+			t.Errorf("Factorize(%d) = %v, want %v", test.n, got, test.want)
+		}
+	}
+}
+
+func TestIsPerfect(t *testing.T) {
+	perfect := []uint64{6, 28, 496, 8128, 33550336, 8589869056, 137438691328, 2305843008139952128}
+	for n := uint64(0); n < 10000; n++ {
+		if got, want := IsPerfect(n), slices.Contains(perfect, n); got != want {
+			t.Errorf("IsPerfect(%d) = %v", n, got)
+		}
+	}
+	for _, n := range perfect {
+		if !IsPerfect(n) {
+			t.Errorf("IsPerfect(%d) = false", n)
+		}
+	}
+}
+
+func TestPrimesInRange(t *testing.T) {
+	if got, truncated := PrimesInRange(0, 30, 100); !slices.Equal(got, []uint64{2, 3, 5, 7, 11, 13, 17, 19, 23, 29}) || truncated {
+		t.Errorf("PrimesInRange(0, 30) = %v, %v", got, truncated)
+	}
+	if got, truncated := PrimesInRange(0, 30, 3); !slices.Equal(got, []uint64{2, 3, 5}) || !truncated {
+		t.Errorf("PrimesInRange(0, 30) limited to 3 = %v, %v", got, truncated)
+	}
+	if got, truncated := PrimesInRange(0, 5, 3); !slices.Equal(got, []uint64{2, 3, 5}) || truncated {
+		t.Errorf("PrimesInRange(0, 5) limited to 3 = %v, %v, want exactly 3 primes", got, truncated)
+	}
+	if got, _ := PrimesInRange(math.MaxUint64-100, math.MaxUint64, 100); !slices.Equal(got, []uint64{18446744073709551521, 18446744073709551533, 18446744073709551557}) {
+		t.Errorf("PrimesInRange at the top of uint64 = %v", got)
+	}
+	if got, _ := PrimesInRange(20, 10, 100); len(got) != 0 {
+		t.Errorf("PrimesInRange(20, 10) = %v, want none", got)
+	}
+
+	// The sieve agrees with isPrime64 across segments, around the squares of the sievePrimes and the end of the sieved range.
+	for _, r := range [][2]uint64{
+		{0, 3 * SEGMENT_SIZE},
+		{SIEVE_LIMIT*SIEVE_LIMIT - 2*SEGMENT_SIZE + 7, SIEVE_LIMIT*SIEVE_LIMIT + 2*SEGMENT_SIZE},
+		{math.MaxUint64 - 2*SEGMENT_SIZE, math.MaxUint64},
+	} {
+		want := make([]uint64, 0)
+		for n := r[0]; n <= r[1] && n >= r[0]; n++ {
+			if isPrime64(n) {
+				want = append(want, n)
+			}
+		}
+		if got, truncated := PrimesInRange(r[0], r[1], len(want)); !slices.Equal(got, want) || truncated {
+			t.Errorf("PrimesInRange(%d, %d) found %d primes, want the %d isPrime64 finds", r[0], r[1], len(got), len(want))
+		}
+	}
+}
+
+// answer runs a request line through validateRequest and returns the JSON response, or "malformed".
+func answer(t *testing.T, line string) string {
+	t.Helper()
+	var req request
+	if err := json.Unmarshal([]byte(line), &req); err != nil {
+		return "malformed"
+	}
+	resp, err := validateRequest(req)
+	if err != nil {
+		return "malformed"
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestMethods(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`{"method":"isPrime","number":7}`, `{"method":"isPrime","prime":true}`},
+		// 10^500+1 is a multiple of 10^4+1, big numbers are answered however long they are.
+		{`{"method":"isPrime","number":1` + strings.Repeat("0", 499) + `1}`, `{"method":"isPrime","prime":false}`},
+		{`{"method":"isPrime","number":2` + strings.Repeat("0", 4999) + `2}`, `{"method":"isPrime","prime":false}`},
+		{`{"method":"isPrime","number":-1` + strings.Repeat("0", 499) + `1}`, `{"method":"isPrime","prime":false}`},
+		{`{"method":"isPrime","number":1` + strings.Repeat("0", 500) + `}`, `{"method":"isPrime","prime":false}`},
+		{`{"method":"factorize","number":360}`, `{"method":"factorize","factors":[2,2,2,3,3,5]}`},
+		{`{"method":"factorize","number":1}`, `{"method":"factorize","factors":[]}`},
+		{`{"method":"factorize","number":18446744073709551615}`, `{"method":"factorize","factors":[3,5,17,257,641,65537,6700417]}`},
+		{`{"method":"factorize","number":1.2e3}`, `{"method":"factorize","factors":[2,2,2,2,3,5,5]}`},
+		{`{"method":"factorize","number":0}`, `malformed`},
+		{`{"method":"factorize","number":-4}`, `malformed`},
+		{`{"method":"factorize","number":4.5}`, `malformed`},
+		{`{"method":"factorize","number":18446744073709551616}`, `malformed`},
+		{`{"method":"isPerfect","number":8128}`, `{"method":"isPerfect","perfect":true}`},
+		{`{"method":"isPerfect","number":8127}`, `{"method":"isPerfect","perfect":false}`},
+		{`{"method":"nextPrime","number":7}`, `{"method":"nextPrime","number":11}`},
+		{`{"method":"nextPrime","number":-100}`, `{"method":"nextPrime","number":2}`},
+		{`{"method":"nextPrime","number":1}`, `{"method":"nextPrime","number":2}`},
+		{`{"method":"nextPrime","number":2}`, `{"method":"nextPrime","number":3}`},
+		{`{"method":"nextPrime","number":18446744073709551557}`, `{"method":"nextPrime","number":18446744073709551629}`},
+		{`{"method":"nextPrime","number":1e200}`, `malformed`},
+		{`{"method":"nextPrime","number":7.5}`, `malformed`},
+		{`{"method":"primesInRange","from":10,"to":20}`, `{"method":"primesInRange","primes":[11,13,17,19]}`},
+		{`{"method":"primesInRange","from":20,"to":10}`, `{"method":"primesInRange","primes":[]}`},
+		{`{"method":"primesInRange","from":10}`, `malformed`},
+		{`{"method":"primesInRange","from":-1,"to":10}`, `malformed`},
+		{`{"method":"gcd","numbers":[12,-18]}`, `{"method":"gcd","number":6}`},
+		{`{"method":"gcd","numbers":[0,0]}`, `{"method":"gcd","number":0}`},
+		{`{"method":"gcd","numbers":[5e30,2.5e31]}`, `{"method":"gcd","number":5000000000000000000000000000000}`},
+		{`{"method":"gcd","numbers":[-7]}`, `{"method":"gcd","number":7}`},
+		{`{"method":"gcd","numbers":[]}`, `malformed`},
+		{`{"method":"gcd","numbers":[12,"18"]}`, `malformed`},
+		{`{"method":"gcd","numbers":12}`, `malformed`},
+		{`{"method":"gcd"}`, `malformed`},
+		{`{"method":"gcd","numbers":[1.5]}`, `malformed`},
+		{`{"method":"isEven","number":2}`, `malformed`},
+	}
+	for _, test := range tests {
+		if got := answer(t, test.line); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.line, got, test.want)
+		}
+	}
+}
+
+func TestPrimesInRangeIsCapped(t *testing.T) {
+	got := answer(t, `{"method":"primesInRange","from":0,"to":1e9}`)
+	var resp primesResponse
+	if err := json.Unmarshal([]byte(got), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Primes) != MAX_RANGE_PRIMES || !resp.Truncated {
+		t.Errorf("got %d primes, truncated %v, want %d truncated", len(resp.Primes), resp.Truncated, MAX_RANGE_PRIMES)
+	}
+	if !strings.HasSuffix(got, `,"truncated":true}`) {
+		t.Errorf("response ends with %s, want truncated last", got[len(got)-40:])
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// MAX_EXPONENT bounds the exponents ParseNumber keeps exactly, anything further from zero is saturated.
+// A saturated exponent still classifies exactly: a big positive one makes a multiple of 10, a big negative one
+// a fraction, and neither is ever prime.
+const MAX_EXPONENT = 1 << 40
+
+var (
+	ErrNotNumber  = errors.New("not a JSON number")
+	ErrNotInteger = errors.New("not an integer")
+	ErrTooLarge   = errors.New("number is too large")
+	ErrNegative   = errors.New("number is negative")
+)
+
+// Number is the exact value of a JSON number, Digits * 10^Exponent. It is normalized so that Digits has no
+// trailing zeros, and zero is always Digits 0 and Exponent 0.
+// Nothing is ever expanded, so numbers like 1e1000000000 take as little memory as they take to write.
+type Number struct {
+	Negative bool
+	Digits   *big.Int
+	Exponent int64
+}
+
+// ParseNumber parses the literal of a JSON number, e.g from a json.RawMessage. Strings, booleans, null
+// and everything else that isn't a number, like "7", are rejected.
+func ParseNumber(raw json.RawMessage) (Number, error) {
+	literal := string(raw)
+	if !json.Valid(raw) || literal == "" || (literal[0] != '-' && (literal[0] < '0' || literal[0] > '9')) {
+		return Number{}, ErrNotNumber
+	}
+
+	n := Number{}
+	literal, n.Negative = strings.CutPrefix(literal, "-")
+	mantissa, exponent, hasExponent := strings.Cut(strings.ToLower(literal), "e")
+	integer, fraction, _ := strings.Cut(mantissa, ".")
+
+	if hasExponent {
+		n.Exponent = parseExponent(exponent)
+	}
+	n.Exponent -= int64(len(fraction))
+
+	digits := strings.TrimLeft(integer+fraction, "0")
+	trimmed := strings.TrimRight(digits, "0")
+	if trimmed == "" {
+		return Number{Negative: n.Negative, Digits: new(big.Int)}, nil
+	}
+	n.Exponent += int64(len(digits) - len(trimmed))
+	n.Digits, _ = new(big.Int).SetString(trimmed, 10)
+	return n, nil
+}
+
+// parseExponent parses the exponent of a number, which the JSON grammar already validated, saturating it at MAX_EXPONENT.
+func parseExponent(exponent string) int64 {
+	value, err := strconv.ParseInt(exponent, 10, 64)
+	if err != nil || value > MAX_EXPONENT || value < -MAX_EXPONENT {
+		if strings.HasPrefix(exponent, "-") {
+			return -MAX_EXPONENT
+		}
+		return MAX_EXPONENT
+	}
+	return value
+}
+
+// IsInteger reports whether the number has no fractional part, 7.0 and 70e-1 are integers.
+func (n Number) IsInteger() bool {
+	return n.Exponent >= 0
+}
+
+// IsPrime reports whether the number is a prime. Only positive integers can be, and an integer with a positive
+// exponent is a multiple of 10, so only the digits of an integer with a zero exponent are tested.
+//
+// The test is exact below 2^64 and Baillie-PSW above it, which has no known counterexample.
+// Engine.IsPrime gives the same answers, remembers the expensive ones and bounds how many of them run at once.
+func (n Number) IsPrime() bool {
+	if n.Negative || n.Exponent != 0 {
+		return false
+	}
+	if n.Digits.IsUint64() {
+		return isPrime64(n.Digits.Uint64())
+	}
+	return isPrimeBig(n.Digits)
+}
+
+// Int returns the integer, as long as it has no more than maxDigits decimal digits.
+func (n Number) Int(maxDigits int) (*big.Int, error) {
+	if !n.IsInteger() {
+		return nil, ErrNotInteger
+	}
+	digits := n.Digits.String()
+	if n.Digits.Sign() != 0 && int64(len(digits))+n.Exponent > int64(maxDigits) {
+		return nil, ErrTooLarge
+	}
+
+	i := new(big.Int).Exp(big.NewInt(10), big.NewInt(n.Exponent), nil)
+	i.Mul(i, n.Digits)
+	if n.Negative {
+		i.Neg(i)
+	}
+	return i, nil
+}
+
+// Uint64 returns the integer when it is between 0 and 2^64-1.
+func (n Number) Uint64() (uint64, error) {
+	i, err := n.Int(20)
+	if err != nil {
+		return 0, err
+	}
+	if i.Sign() < 0 {
+		return 0, ErrNegative
+	}
+	if !i.IsUint64() {
+		return 0, ErrTooLarge
+	}
+	return i.Uint64(), nil
+}
+
+func (n Number) String() string {
+	s := n.Digits.String()
+	if n.Exponent != 0 {
+		s += "e" + strconv.FormatInt(n.Exponent, 10)
+	}
+	if n.Negative && n.Digits.Sign() != 0 {
+		s = "-" + s
+	}
+	return s
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseNumberClassifies(t *testing.T) {
+	tests := []struct {
+		literal string
+		integer bool
+		prime   bool
+	}{
+		{"0", true, false},
+		{"-0", true, false},
+		{"1", true, false},
+		{"2", true, true},
+		{"7", true, true},
+		{"-7", true, false},
+		{"7.0", true, true},
+		{"7.000", true, true},
+		{"70e-1", true, true},
+		{"0.7e1", true, true},
+		{"700E-2", true, true},
+		{"7.5", false, false},
+		{"-7.5", false, false},
+		{"0.5", false, false},
+		{"1e30", true, false},
+		{"1e1000000000", true, false},
+		{"1e99999999999999999999", true, false},
+		{"1e-400", false, false},
+		{"1e-99999999999999999999", false, false},
+		{"0e99999999999999999999", true, false},
+		{"0.0", true, false},
+		{"37551482", true, false},
+		// Integers above 2^53 that a float64 rounds to a neighbour.
+		{"9007199254740997", true, true},
+		{"9007199254740993", true, false},
+		{"18446744073709551557", true, true},
+		{"170141183460469231731687303715884105727", true, true},
+		{"170141183460469231731687303715884105729", true, false},
+		{"1701411834604692317316873037158841057270e-1", true, true},
+		{"170141183460469231731687303715884105727.0000001", false, false},
+	}
+	for _, test := range tests {
+		n, err := ParseNumber(json.RawMessage(test.literal))
+		if err != nil {
+			t.Errorf("ParseNumber(%s): %s", test.literal, err)
+			continue
+		}
+		if n.IsInteger() != test.integer {
+			t.Errorf("%s (%s) IsInteger = %v, want %v", test.literal, n, n.IsInteger(), test.integer)
+		}
+		if n.IsPrime() != test.prime {
+			t.Errorf("%s (%s) IsPrime = %v, want %v", test.literal, n, n.IsPrime(), test.prime)
+		}
+	}
+}
+
+func TestParseNumberRejects(t *testing.T) {
+	for _, literal := range []string{``, `"7"`, `true`, `null`, `[7]`, `{"n":7}`, `07`, `7.`, `+7`, `0x7`} {
+		if n, err := ParseNumber(json.RawMessage(literal)); err == nil {
+			t.Errorf("ParseNumber(%s) = %s, want an error", literal, n)
+		}
+	}
+}
+
+func TestValidateRequestNumbers(t *testing.T) {
+	tests := []struct {
+		line  string
+		prime bool
+		bad   bool
+	}{
+		{`{"method":"isPrime","number":9007199254740997}`, true, false},
+		{`{"method":"isPrime","number":1e30}`, false, false},
+		{`{"method":"isPrime","number":` + strings.Repeat("9", 400) + `}`, false, false},
+		{`{"method":"isPrime","number":"7"}`, false, true},
+		{`{"method":"isPrime","number":null}`, false, true},
+		{`{"method":"isPrime"}`, false, true},
+	}
+	for _, test := range tests {
+		var req request
+		if err := json.Unmarshal([]byte(test.line), &req); err != nil {
+			t.Fatalf("%s: %s", test.line, err)
+		}
+		resp, err := validateRequest(req)
+		if test.bad {
+			if err == nil {
+				t.Errorf("%s: answered %+v, want a malformed request", test.line, resp)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.line, err)
+		} else if resp.(*Response).Prime != test.prime {
+			t.Errorf("%s: prime %v, want %v", test.line, resp.(*Response).Prime, test.prime)
+		}
+	}
+}
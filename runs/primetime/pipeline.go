@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// DEFAULT_PIPELINE_DEPTH is how many requests of a connection may be read ahead of the response being written.
+	DEFAULT_PIPELINE_DEPTH = 256
+	// DEFAULT_MAX_LINE is how long a request line may be unless -max-line says otherwise.
+	DEFAULT_MAX_LINE = 1 << 20
+)
+
+var ErrLineTooLong = errors.New("line is too long")
+
+// Quotas bound how many requests clients may send, zero values mean no limit.
+type Quotas struct {
+	// PerConnection is how many requests a connection may send before it is closed.
+	PerConnection int
+	// PerIP is how many requests the connections of an address may send together in every Window,
+	// a connection that goes over it is closed.
+	PerIP  int
+	Window time.Duration
+
+	mu        sync.Mutex
+	ips       map[netip.Addr]*ipQuota
+	nextSweep time.Time
+}
+
+type ipQuota struct {
+	used   int
+	resets time.Time
+}
+
+func NewQuotas(perConnection, perIP int, window time.Duration) *Quotas {
+	return &Quotas{PerConnection: perConnection, PerIP: perIP, Window: window, ips: make(map[netip.Addr]*ipQuota)}
+}
+
+// allowIP counts a request of ip and reports whether it is within the quota.
+func (q *Quotas) allowIP(ip netip.Addr, now time.Time) bool {
+	if q.PerIP == 0 {
+		return true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Forget the addresses whose window is over once every window, so the map only holds recent clients.
+	if now.After(q.nextSweep) {
+		for addr, quota := range q.ips {
+			if now.After(quota.resets) {
+				delete(q.ips, addr)
+			}
+		}
+		q.nextSweep = now.Add(q.Window)
+	}
+
+	quota, ok := q.ips[ip]
+	if !ok || now.After(quota.resets) {
+		quota = &ipQuota{resets: now.Add(q.Window)}
+		q.ips[ip] = quota
+	}
+	quota.used++
+	return quota.used <= q.PerIP
+}
+
+// Pipeline answers the request lines of a connection concurrently and writes the responses in the order
+// of the requests through a buffered writer. At most Depth requests are read ahead of the response
+// being written, after that the connection isn't read until the responses catch up.
+type Pipeline struct {
+	// Answer returns the response to a line without a newline, nil to send nothing,
+	// and whether the connection is closed once the response was written.
+	Answer func(line []byte) (resp []byte, closing bool)
+	Depth  int
+	Quotas *Quotas
+	// MaxLine bounds the length of a line, 0 means no limit. A longer line is answered with TooLong
+	// and closes the connection, without being read further than the read buffer.
+	MaxLine int
+	TooLong []byte
+}
+
+type result struct {
+	resp    []byte
+	closing bool
+}
+
+// Serve answers conn until it closes, a response closes it or it goes over its quota.
+func (p *Pipeline) Serve(conn net.Conn) {
+	defer func() {
+		log.Println("Closing connection from:", conn.RemoteAddr().String())
+		conn.Close()
+	}()
+
+	pending := make(chan chan result, max(p.Depth, 1))
+	done := make(chan struct{})
+	defer close(done)
+	go p.read(conn, pending, done)
+
+	writer := bufio.NewWriter(conn)
+	for {
+		slot, ok := receive(pending, writer)
+		if !ok {
+			break
+		}
+		r, _ := receive(slot, writer)
+		if r.resp != nil {
+			if _, err := writer.Write(append(r.resp, '\n')); err != nil {
+				log.Println("failed to write response", err)
+				return
+			}
+		}
+		if r.closing {
+			break
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		log.Println("failed to write responses", err)
+	}
+}
+
+// read queues a slot for the answer of every line of conn and answers the line in the background,
+// until conn closes, it goes over its quota or done is closed.
+func (p *Pipeline) read(conn net.Conn, pending chan<- chan result, done <-chan struct{}) {
+	defer close(pending)
+
+	ip, ipErr := netip.ParseAddrPort(conn.RemoteAddr().String())
+	// A reader rather than a scanner, a scanner gives up on lines longer than its buffer.
+	reader := bufio.NewReader(conn)
+	for requests := 1; ; requests++ {
+		line, err := p.readLine(reader)
+		if errors.Is(err, ErrLineTooLong) {
+			log.Println("Too long a line from", conn.RemoteAddr())
+			slot := make(chan result, 1)
+			slot <- result{resp: p.TooLong, closing: true}
+			select {
+			case pending <- slot:
+			case <-done:
+			}
+			return
+		}
+		if len(line) == 0 && err != nil {
+			return
+		}
+
+		if p.Quotas != nil {
+			overConnection := p.Quotas.PerConnection > 0 && requests > p.Quotas.PerConnection
+			if overConnection || (ipErr == nil && !p.Quotas.allowIP(ip.Addr(), time.Now())) {
+				log.Println("Too many requests from", conn.RemoteAddr())
+				return
+			}
+		}
+
+		slot := make(chan result, 1)
+		select {
+		case pending <- slot:
+		case <-done:
+			return
+		}
+		go func() {
+			resp, closing := p.Answer(line)
+			slot <- result{resp: resp, closing: closing}
+		}()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readLine returns the next line of reader without its newline, or ErrLineTooLong once more than MaxLine bytes of it were read.
+func (p *Pipeline) readLine(reader *bufio.Reader) ([]byte, error) {
+	line := make([]byte, 0)
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if p.MaxLine > 0 && len(bytes.TrimSuffix(line, []byte("\n"))) > p.MaxLine {
+			return nil, ErrLineTooLong
+		}
+		if err != bufio.ErrBufferFull {
+			return bytes.TrimSuffix(line, []byte("\n")), err
+		}
+	}
+}
+
+// receive returns the next value of ch, flushing writer first when it would have to wait for it,
+// so responses that are ready are never held back by a slow one.
+func receive[T any](ch <-chan T, writer *bufio.Writer) (T, bool) {
+	select {
+	case v, ok := <-ch:
+		return v, ok
+	default:
+	}
+	if writer.Buffered() > 0 {
+		writer.Flush()
+	}
+	v, ok := <-ch
+	return v, ok
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// servePipeline serves p on a loopback port and returns its address.
+func servePipeline(t *testing.T, p *Pipeline) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.Serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// exchange sends lines on a new connection, closes its writing half and returns every line it got back.
+func exchange(t *testing.T, addr string, lines ...string) []string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		io.WriteString(conn, strings.Join(lines, "\n")+"\n")
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]string, 0)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		got = append(got, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestPipelineKeepsOrder(t *testing.T) {
+	// Earlier requests take longer, so they finish after the ones behind them.
+	addr := servePipeline(t, &Pipeline{
+		Depth: 16,
+		Answer: func(line []byte) ([]byte, bool) {
+			n, _ := strconv.Atoi(string(line))
+			time.Sleep(time.Duration(100-n%100) * 50 * time.Microsecond)
+			return line, false
+		},
+	})
+
+	lines := make([]string, 1000)
+	for i := range lines {
+		lines[i] = strconv.Itoa(i)
+	}
+	got := exchange(t, addr, lines...)
+	if strings.Join(got, ",") != strings.Join(lines, ",") {
+		t.Fatalf("got %d responses out of order, starting %v", len(got), got[:min(len(got), 10)])
+	}
+}
+
+func TestPipelineBackpressure(t *testing.T) {
+	const depth = 4
+	var started atomic.Int32
+	release := make(chan struct{})
+	addr := servePipeline(t, &Pipeline{
+		Depth: depth,
+		Answer: func(line []byte) ([]byte, bool) {
+			started.Add(1)
+			<-release
+			return line, false
+		},
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go fmt.Fprint(conn, strings.Repeat("x\n", 100))
+
+	time.Sleep(100 * time.Millisecond)
+	// The writer holds the first slot and the queue the next depth, the reader waits with one more.
+	if n := started.Load(); n > depth+1 {
+		t.Errorf("%d requests were answered at once, want at most %d", n, depth+1)
+	}
+	close(release)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	scanner := bufio.NewScanner(conn)
+	for i := 0; i < 100; i++ {
+		if !scanner.Scan() {
+			t.Fatalf("got %d responses, want 100: %v", i, scanner.Err())
+		}
+	}
+}
+
+func TestPipelineClosesOnMalformed(t *testing.T) {
+	addr := servePipeline(t, &Pipeline{Depth: 8, Answer: answerClassic})
+	got := exchange(t, addr,
+		`{"method":"isPrime","number":7}`,
+		`{"method":"isPrime","number":8}`,
+		`{"method":"isPrime"}`,
+		`{"method":"isPrime","number":11}`,
+	)
+	want := []string{`{"method":"isPrime","prime":true}`, `{"method":"isPrime","prime":false}`, MALFORMED}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPipelineClosesOnLongLine(t *testing.T) {
+	addr := servePipeline(t, &Pipeline{
+		Depth:   8,
+		Answer:  func(line []byte) ([]byte, bool) { return line, false },
+		MaxLine: 10,
+		TooLong: []byte("too long"),
+	})
+	if got := exchange(t, addr, "0123456789", "x"); strings.Join(got, ",") != "0123456789,x" {
+		t.Errorf("got %q, want a line of MaxLine bytes answered", got)
+	}
+
+	// The line never ends, the server answers once its buffer is full rather than waiting for the newline.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, strings.Repeat("x", 4096))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "too long\n" {
+		t.Errorf("got %q, want the TooLong response and the connection closed", got)
+	}
+}
+
+func TestPipelineConnectionQuota(t *testing.T) {
+	addr := servePipeline(t, &Pipeline{
+		Depth:  8,
+		Answer: func(line []byte) ([]byte, bool) { return line, false },
+		Quotas: NewQuotas(3, 0, time.Minute),
+	})
+	if got := exchange(t, addr, "1", "2", "3", "4", "5"); strings.Join(got, ",") != "1,2,3" {
+		t.Errorf("got %v, want the first 3 requests answered", got)
+	}
+	// The quota is per connection, a new one starts over.
+	if got := exchange(t, addr, "6", "7"); strings.Join(got, ",") != "6,7" {
+		t.Errorf("got %v on a new connection, want both requests answered", got)
+	}
+}
+
+func TestPipelineIPQuota(t *testing.T) {
+	addr := servePipeline(t, &Pipeline{
+		Depth:  8,
+		Answer: func(line []byte) ([]byte, bool) { return line, false },
+		Quotas: NewQuotas(0, 4, time.Minute),
+	})
+	if got := exchange(t, addr, "1", "2", "3"); len(got) != 3 {
+		t.Errorf("got %v, want 3 responses", got)
+	}
+	if got := exchange(t, addr, "4", "5", "6"); strings.Join(got, ",") != "4" {
+		t.Errorf("got %v, want only the 4th request of the address answered", got)
+	}
+}
+
+func TestQuotasWindow(t *testing.T) {
+	q := NewQuotas(0, 2, time.Minute)
+	ip, other := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	now := time.Now()
+
+	if !q.allowIP(ip, now) || !q.allowIP(ip, now) || q.allowIP(ip, now) {
+		t.Error("the quota didn't allow exactly 2 requests")
+	}
+	if !q.allowIP(other, now) {
+		t.Error("another address shares the quota")
+	}
+	if !q.allowIP(ip, now.Add(time.Minute+time.Second)) {
+		t.Error("the quota didn't reset after the window")
+	}
+	if len(q.ips) != 1 {
+		t.Errorf("remembered %d addresses, want the expired one forgotten", len(q.ips))
+	}
+}
@@ -2,16 +2,16 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 	"testing"
 )
 
 func TestUnmarshal(t *testing.T) {
 	str := `{"number":37551482,"method":"isPrime"}`
-	var resp Response
-	err := json.Unmarshal([]byte(str), &resp)
-	if err != nil {
-		t.Errorf(err.Error())
+	var req request
+	if err := json.Unmarshal([]byte(str), &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != "isPrime" || string(req.Number) != "37551482" {
+		t.Errorf("got method %q and number %s, want isPrime and 37551482", req.Method, req.Number)
 	}
-	fmt.Println(resp)
 }
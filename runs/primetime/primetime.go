@@ -1,13 +1,13 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"math/big"
-	"net"
+	"runtime"
+	"time"
 
 	"github.com/dorimon-1/protohackers"
 )
@@ -21,65 +21,88 @@ func newResponse(method string, isPrime bool) *Response {
 	return &Response{Method: method, Prime: isPrime}
 }
 
+// request keeps the numbers raw, decoding them into float64s would round integers above 2^53 and overflow past 1e308.
+// Which of the numbers are needed depends on the method.
 type request struct {
-	Method string   `json:"method"`
-	Number *float64 `json:"number"`
+	Method  string          `json:"method"`
+	Number  json.RawMessage `json:"number"`
+	From    json.RawMessage `json:"from"`
+	To      json.RawMessage `json:"to"`
+	Numbers json.RawMessage `json:"numbers"`
 }
 
 func (r *request) String() string {
-	return fmt.Sprintf("method: %s, number: %f", r.Method, *r.Number)
+	return fmt.Sprintf("method: %s, number: %s", r.Method, r.Number)
 }
 
-const MAX_REQUESTS = 5000
+// MALFORMED is the response to a malformed request, the spec wants anything that isn't a well-formed response
+// before the connection is closed.
+const MALFORMED = "malformed request"
 
 func main() {
-	protohackers.NewProtoListener(handleConnetions)
+	jsonrpc := flag.Bool("jsonrpc", false, "speak JSON-RPC 2.0 instead of the protohackers protocol")
+	cacheSize := flag.Int("cache", DEFAULT_CACHE_SIZE, "how many answers for numbers above 64 bits to remember, 0 remembers none")
+	depth := flag.Int("depth", DEFAULT_PIPELINE_DEPTH, "how many requests of a connection are answered ahead of the response being written")
+	perConnection := flag.Int("max-requests", 5000, "how many requests a connection may send, 0 for no limit")
+	perIP := flag.Int("ip-requests", 0, "how many requests an address may send every -ip-window, 0 for no limit")
+	ipWindow := flag.Duration("ip-window", time.Minute, "the window of -ip-requests")
+	maxLine := flag.Int("max-line", DEFAULT_MAX_LINE, "how long a request line may be in bytes, 0 for no limit")
+	bigTests := flag.Int("big-tests", max(runtime.NumCPU()/2, 1), "how many isPrime tests of numbers above 64 bits run at once, 0 for no limit")
+	flag.Parse()
+
+	engine = NewEngine(*cacheSize)
+	engine.LimitBigTests(*bigTests)
+	if *jsonrpc {
+		log.Println("Serving JSON-RPC 2.0")
+	}
+	pipeline := newPipeline(*jsonrpc, *depth, *maxLine, NewQuotas(*perConnection, *perIP, *ipWindow))
+	protohackers.NewProtoListener(pipeline.Serve)
 }
 
-func handleConnetions(conn net.Conn) {
-	defer func() {
-		log.Println("Closing connection from:", conn.RemoteAddr().String())
-		conn.Close()
-	}()
-
-	requests := 0
-	for scanner := bufio.NewScanner(conn); scanner.Scan() && requests < MAX_REQUESTS; requests++ {
-		data := scanner.Text()
-
-		var req request
-		if err := json.Unmarshal([]byte(data), &req); err != nil {
-			fmt.Println("failed to unmarshal", err)
-			return
-		}
-
-		resp, err := validateRequest(req)
-		if err != nil {
-			log.Println("failed to marshal", err)
-			return
-		}
+// newPipeline returns the pipeline that serves every connection, answering the protohackers protocol or JSON-RPC 2.0.
+func newPipeline(jsonrpc bool, depth int, maxLine int, quotas *Quotas) *Pipeline {
+	pipeline := &Pipeline{
+		Answer:  answerClassic,
+		Depth:   depth,
+		Quotas:  quotas,
+		MaxLine: maxLine,
+		TooLong: []byte(MALFORMED),
+	}
+	if jsonrpc {
+		pipeline.Answer = answerJSONRPCLine
+		pipeline.TooLong = marshalRPC(newRPCError(nullID, INVALID_REQUEST, "Invalid Request", ErrLineTooLong.Error()))
+	}
+	return pipeline
+}
 
-		marshledData, err := json.Marshal(*resp)
-		if err != nil {
-			log.Println("failed to marshal", err)
-			return
-		}
+// answerClassic answers a line of the protohackers protocol, a malformed request is answered with MALFORMED
+// and closes the connection.
+func answerClassic(line []byte) ([]byte, bool) {
+	var req request
+	if err := json.Unmarshal(line, &req); err != nil {
+		log.Println("failed to unmarshal", err)
+		return []byte(MALFORMED), true
+	}
 
-		marshledData = append(marshledData, byte('\n'))
-		conn.Write(marshledData)
+	resp, err := validateRequest(req)
+	if err != nil {
+		log.Println("bad request", err)
+		return []byte(MALFORMED), true
 	}
-	if requests == MAX_REQUESTS {
-		log.Println("Too many requests from", conn.RemoteAddr())
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		log.Println("failed to marshal", err)
+		return []byte(MALFORMED), true
 	}
+	return data, false
 }
 
-func validateRequest(req request) (*Response, error) {
-	if req.Method != "isPrime" || req.Number == nil {
+// validateRequest answers req with the response of its method, or returns an error when req is malformed.
+func validateRequest(req request) (any, error) {
+	method, ok := methods[req.Method]
+	if !ok {
 		return nil, errors.New("bad request")
 	}
-
-	isPrime := false
-	if float64(int(*req.Number)) == *req.Number {
-		isPrime = big.NewInt(int64(*req.Number)).ProbablyPrime(11)
-	}
-	return newResponse(req.Method, isPrime), nil
+	return method(req)
 }